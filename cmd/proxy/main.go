@@ -66,7 +66,7 @@ func main() {
 	}
 
 	// Initialize control API server
-	controlServer := api.NewControlServer("8889")
+	controlServer := api.NewControlServer("8889", proxyServer.GetLoadBalancer(), cfg.Admin.Token)
 	go func() {
 		logrus.Info("Starting control API server on :8889")
 		if err := controlServer.Start(); err != nil {
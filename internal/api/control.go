@@ -3,22 +3,33 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
 	"os/exec"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/os-dev/quic-reverse-proxy/internal/middleware"
+	"github.com/os-dev/quic-reverse-proxy/internal/proxy"
 	"github.com/sirupsen/logrus"
 )
 
 // ControlServer handles backend control operations
 type ControlServer struct {
-	port string
+	port         string
+	loadBalancer *proxy.LoadBalancer
+	adminToken   string // Bearer token required to change backend state
 }
 
-// NewControlServer creates a new control server
-func NewControlServer(port string) *ControlServer {
-	return &ControlServer{port: port}
+// NewControlServer creates a new control server. Requests changing the
+// state of backends must carry adminToken; they are refused if it is empty.
+func NewControlServer(port string, loadBalancer *proxy.LoadBalancer, adminToken string) *ControlServer {
+	return &ControlServer{port: port, loadBalancer: loadBalancer, adminToken: adminToken}
 }
 
 // Start starts the control API server
@@ -27,12 +38,20 @@ func (cs *ControlServer) Start() error {
 	http.HandleFunc("/control", cs.handleControlPanel)
 
 	// API endpoints with CORS
-	http.HandleFunc("/api/backend/stop", cs.corsMiddleware(cs.handleStopBackend))
+	http.HandleFunc("/api/backend/drain", cs.corsMiddleware(cs.adminMiddleware(cs.handleDrainBackend)))
+	http.HandleFunc("/api/backend/undrain", cs.corsMiddleware(cs.adminMiddleware(cs.handleUndrainBackend)))
+	http.HandleFunc("/api/backend/health", cs.corsMiddleware(cs.adminMiddleware(cs.handleBackendHealth)))
+	http.HandleFunc("/api/backend/stop", cs.corsMiddleware(cs.adminMiddleware(cs.handleDrainBackend))) // Kept for existing scripts
 	http.HandleFunc("/api/backend/start", cs.corsMiddleware(cs.handleStartBackend))
 	http.HandleFunc("/api/backend/restart", cs.corsMiddleware(cs.handleRestartBackend))
 	http.HandleFunc("/api/backends/status", cs.corsMiddleware(cs.handleBackendsStatus))
+	http.HandleFunc("/api/events", cs.corsMiddleware(cs.handleEvents))
 	http.HandleFunc("/api/load/generate", cs.corsMiddleware(cs.handleGenerateLoad))
 
+	if cs.adminToken == "" {
+		logrus.Warn("No admin token configured, the control API refuses to change backend state")
+	}
+
 	logrus.WithField("port", cs.port).Info("Starting control API server")
 	return http.ListenAndServe(":"+cs.port, nil)
 }
@@ -53,6 +72,44 @@ func (cs *ControlServer) corsMiddleware(next http.HandlerFunc) http.HandlerFunc
 	}
 }
 
+// adminMiddleware guards the requests changing the state of backends
+// against cross-site requests. They must send their parameters as a JSON
+// body, which browsers only send to another origin after a preflight, and
+// carry the admin token. Requests only reading the state pass through.
+func (cs *ControlServer) adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	authenticated := middleware.AuthMiddleware(cs.adminToken, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		authenticated.ServeHTTP(w, r)
+	}
+}
+
+// requestParams returns the parameters of a request: the fields of its JSON
+// body, if it has one, with the query string filling in the others
+func requestParams(r *http.Request) (url.Values, error) {
+	params := r.URL.Query()
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return params, nil
+	}
+
+	var body map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid JSON body: %w", err)
+	}
+	for key, value := range body {
+		params.Set(key, value)
+	}
+	return params, nil
+}
+
 // handleControlPanel serves the control panel HTML
 func (cs *ControlServer) handleControlPanel(w http.ResponseWriter, r *http.Request) {
 	paths := []string{"./www/control.html", "/app/www/control.html", "../www/control.html"}
@@ -66,37 +123,302 @@ func (cs *ControlServer) handleControlPanel(w http.ResponseWriter, r *http.Reque
 	http.Error(w, "Control panel not found", http.StatusNotFound)
 }
 
-// handleStopBackend stops a backend container
-func (cs *ControlServer) handleStopBackend(w http.ResponseWriter, r *http.Request) {
+// handleDrainBackend stops new requests from being assigned to a backend.
+// GET reports the drain progress; POST starts draining and, with a wait
+// duration, blocks until the requests in flight have completed.
+func (cs *ControlServer) handleDrainBackend(w http.ResponseWriter, r *http.Request) {
+	params, err := requestParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := params.Get("name")
+	if name == "" {
+		http.Error(w, "Backend name is required", http.StatusBadRequest)
+		return
+	}
+
+	var backends []*proxy.Backend
+	switch r.Method {
+	case http.MethodGet:
+		if backends = cs.loadBalancer.FindBackends(name); len(backends) == 0 {
+			http.Error(w, fmt.Sprintf("Backend %s not found", name), http.StatusNotFound)
+			return
+		}
+
+	case http.MethodPost:
+		var wait time.Duration
+		if value := params.Get("wait"); value != "" {
+			if wait, err = time.ParseDuration(value); err != nil || wait < 0 {
+				http.Error(w, "Invalid wait duration", http.StatusBadRequest)
+				return
+			}
+		}
+
+		logrus.WithField("backend", name).Info("Draining backend via API")
+
+		if backends, err = cs.loadBalancer.DrainBackend(name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if wait > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), wait)
+			defer cancel()
+			proxy.WaitDrained(ctx, backends)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(drainStatus(name, backends))
+}
+
+// handleUndrainBackend lets a drained backend receive requests again
+func (cs *ControlServer) handleUndrainBackend(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	name := r.URL.Query().Get("name")
+	params, err := requestParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := params.Get("name")
 	if name == "" {
 		http.Error(w, "Backend name is required", http.StatusBadRequest)
 		return
 	}
 
-	logrus.WithField("backend", name).Info("Stopping backend via API")
+	logrus.WithField("backend", name).Info("Undraining backend via API")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	backends, err := cs.loadBalancer.UndrainBackend(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 
-	cmd := exec.CommandContext(ctx, "docker", "stop", name)
-	output, err := cmd.CombinedOutput()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(drainStatus(name, backends))
+}
+
+// drainStatus describes the drain state of the backends matching name.
+// drained turns true once none of them has requests in flight, at which
+// point the instance can be stopped safely.
+func drainStatus(name string, backends []*proxy.Backend) map[string]interface{} {
+	var connections int32
+	details := make([]map[string]interface{}, 0, len(backends))
+	for _, backend := range backends {
+		connections += backend.GetConnections()
+		details = append(details, map[string]interface{}{
+			"name":        backend.Name,
+			"url":         backend.URL,
+			"draining":    backend.IsDraining(),
+			"connections": backend.GetConnections(),
+		})
+	}
+
+	return map[string]interface{}{
+		"success":     true,
+		"name":        name,
+		"backends":    details,
+		"connections": connections,
+		"drained":     connections == 0,
+	}
+}
+
+// handleBackendHealth forces the health of a backend, overriding its health
+// checks. GET reports the override and recent probe results; POST sets state
+// to healthy or unhealthy, optionally for a ttl, or back to auto to follow
+// the health checks again.
+func (cs *ControlServer) handleBackendHealth(w http.ResponseWriter, r *http.Request) {
+	params, err := requestParams(r)
 	if err != nil {
-		logrus.WithError(err).WithField("output", string(output)).Error("Failed to stop backend")
-		http.Error(w, fmt.Sprintf("Failed to stop backend: %v", err), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := params.Get("name")
+	if name == "" {
+		http.Error(w, "Backend name is required", http.StatusBadRequest)
+		return
+	}
+
+	var backends []*proxy.Backend
+	switch r.Method {
+	case http.MethodGet:
+		if backends = cs.loadBalancer.FindBackends(name); len(backends) == 0 {
+			http.Error(w, fmt.Sprintf("Backend %s not found", name), http.StatusNotFound)
+			return
+		}
+
+	case http.MethodPost:
+		var ttl time.Duration
+		if value := params.Get("ttl"); value != "" {
+			if ttl, err = time.ParseDuration(value); err != nil || ttl < 0 {
+				http.Error(w, "Invalid ttl", http.StatusBadRequest)
+				return
+			}
+		}
+
+		state := params.Get("state")
+		logrus.WithFields(logrus.Fields{
+			"backend": name,
+			"state":   state,
+			"ttl":     ttl.String(),
+		}).Info("Overriding backend health via API")
+
+		switch state {
+		case "healthy":
+			backends, err = cs.loadBalancer.OverrideHealth(name, true, ttl)
+		case "unhealthy":
+			backends, err = cs.loadBalancer.OverrideHealth(name, false, ttl)
+		case "auto":
+			backends, err = cs.loadBalancer.ClearHealthOverride(name)
+		default:
+			http.Error(w, "State must be healthy, unhealthy or auto", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": fmt.Sprintf("Backend %s stopped", name),
-	})
+	json.NewEncoder(w).Encode(healthStatus(name, backends))
+}
+
+// healthStatus describes the health, health override and recent health
+// check results of the backends matching name
+func healthStatus(name string, backends []*proxy.Backend) map[string]interface{} {
+	details := make([]map[string]interface{}, 0, len(backends))
+	for _, backend := range backends {
+		detail := map[string]interface{}{
+			"name":     backend.Name,
+			"url":      backend.URL,
+			"healthy":  backend.IsHealthy(),
+			"override": "auto",
+			"checks":   backend.HealthCheckStats(),
+		}
+		if healthy, until, ok := backend.HealthOverride(); ok {
+			detail["override"] = "unhealthy"
+			if healthy {
+				detail["override"] = "healthy"
+			}
+			if !until.IsZero() {
+				detail["until"] = until.Format(time.RFC3339)
+			}
+		}
+		details = append(details, detail)
+	}
+
+	return map[string]interface{}{
+		"success":  true,
+		"name":     name,
+		"backends": details,
+	}
+}
+
+// eventHeartbeatInterval is how often an idle event stream sends a comment
+// so proxies and browsers keep the connection open
+const eventHeartbeatInterval = 15 * time.Second
+
+// handleEvents streams backend lifecycle events as Server-Sent Events.
+// Clients reconnecting with Last-Event-ID, or the last_event_id parameter,
+// first receive the recent events they missed. The types parameter limits
+// the stream to a comma separated list of event types. A client falling too
+// far behind receives a reset event carrying the ID to reconnect with, and
+// the stream ends.
+func (cs *ControlServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	bus := cs.loadBalancer.Events()
+	after := bus.LastID()
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	if lastEventID != "" {
+		id, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid last event id", http.StatusBadRequest)
+			return
+		}
+		after = id
+	}
+
+	var types map[proxy.EventType]bool
+	if value := r.URL.Query().Get("types"); value != "" {
+		types = make(map[proxy.EventType]bool)
+		for _, eventType := range strings.Split(value, ",") {
+			types[proxy.EventType(strings.TrimSpace(eventType))] = true
+		}
+	}
+
+	events, unsubscribe := bus.Subscribe("sse", after, 64)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case event, ok := <-events:
+			if !ok {
+				// Clients reconnect with the ID of the reset event and
+				// catch up from the recent events
+				fmt.Fprintf(w, "id: %d\nevent: reset\ndata: {\"last_event_id\":%d}\n\n", after, after)
+				flusher.Flush()
+				return
+			}
+			after = event.ID
+
+			if types != nil && !types[event.Type] {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
 }
 
 // handleStartBackend starts a backend container
@@ -165,12 +487,11 @@ func (cs *ControlServer) handleRestartBackend(w http.ResponseWriter, r *http.Req
 	})
 }
 
-// handleBackendsStatus returns status of all containers via docker CLI (simple placeholder)
+// handleBackendsStatus returns the status of all backends
 func (cs *ControlServer) handleBackendsStatus(w http.ResponseWriter, r *http.Request) {
-	// For now return a simple OK so UI can function; UI already uses /health for backend details
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"backends": []string{"backend1", "backend2"},
+		"backends": cs.loadBalancer.GetBackendStatus(),
 	})
 }
 
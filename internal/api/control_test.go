@@ -0,0 +1,466 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+	"github.com/os-dev/quic-reverse-proxy/internal/proxy"
+)
+
+// newTestProxy returns a proxy handler and control server for a group
+// balancing over the given upstreams
+func newTestProxy(t *testing.T, urls ...string) (http.Handler, *ControlServer) {
+	t.Helper()
+
+	group := config.BackendConfig{Name: "web", Protocol: "http", LoadBalancer: "round_robin", Weight: 1}
+	for _, url := range urls {
+		group.Targets = append(group.Targets, config.TargetConfig{URL: url})
+	}
+	cfg := &config.Config{Backends: []config.BackendConfig{group}}
+
+	router, err := proxy.NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+	lb, err := proxy.NewLoadBalancer(cfg.Backends, nil)
+	if err != nil {
+		t.Fatalf("NewLoadBalancer: %v", err)
+	}
+	return proxy.NewHandler(router, lb, nil), NewControlServer("0", lb, "secret")
+}
+
+// decodeStatus decodes a drain status response
+func decodeStatus(t *testing.T, rec *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var status map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	return status
+}
+
+func TestDrainEndpoint(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	handler, cs := newTestProxy(t, slow.URL, fast.URL)
+
+	// Round robin sends the first request to the slow upstream
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		done <- rec
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for cs.loadBalancer.FindBackends(slow.URL)[0].GetConnections() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("request never reached the slow upstream")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	cs.handleDrainBackend(rec, httptest.NewRequest("POST", "/api/backend/drain?name="+slow.URL, nil))
+	if status := decodeStatus(t, rec); status["drained"] != false || status["connections"] != float64(1) {
+		t.Fatalf("status %v while a request is in flight", status)
+	}
+
+	// New requests avoid the draining backend
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Body.String() != "fast" {
+			t.Fatalf("request served by the draining backend")
+		}
+	}
+
+	// The request in flight completes while a drain call waits for it
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	rec = httptest.NewRecorder()
+	cs.handleDrainBackend(rec, httptest.NewRequest("POST", "/api/backend/drain?name="+slow.URL+"&wait=5s", nil))
+	if status := decodeStatus(t, rec); status["drained"] != true {
+		t.Errorf("status %v after waiting for the drain", status)
+	}
+	if inflight := <-done; inflight.Code != http.StatusOK || inflight.Body.String() != "slow" {
+		t.Errorf("request in flight got %d %q", inflight.Code, inflight.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	cs.handleDrainBackend(rec, httptest.NewRequest("GET", "/api/backend/drain?name="+slow.URL, nil))
+	if status := decodeStatus(t, rec); status["drained"] != true {
+		t.Errorf("status %v, want drained", status)
+	}
+}
+
+func TestDrainEndpointErrors(t *testing.T) {
+	_, cs := newTestProxy(t, "http://a:80")
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		code   int
+	}{
+		{name: "missing name", method: "POST", query: "", code: http.StatusBadRequest},
+		{name: "unknown backend", method: "POST", query: "?name=http://b:80", code: http.StatusNotFound},
+		{name: "invalid wait", method: "POST", query: "?name=http://a:80&wait=soon", code: http.StatusBadRequest},
+		{name: "method", method: "DELETE", query: "?name=http://a:80", code: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		cs.handleDrainBackend(rec, httptest.NewRequest(tt.method, "/api/backend/drain"+tt.query, nil))
+		if rec.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.code)
+		}
+	}
+}
+
+func TestAdminEndpointsRequireJSONAndToken(t *testing.T) {
+	_, cs := newTestProxy(t, "http://a:80")
+	backend := cs.loadBalancer.FindBackends("http://a:80")[0]
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		token       string
+		body        string
+		code        int
+		draining    bool
+		unhealthy   bool
+	}{
+		{name: "form post", method: "POST", path: "/api/backend/drain?name=http://a:80", contentType: "application/x-www-form-urlencoded", token: "secret", code: http.StatusUnsupportedMediaType},
+		{name: "plain post", method: "POST", path: "/api/backend/drain?name=http://a:80", token: "secret", code: http.StatusUnsupportedMediaType},
+		{name: "without token", method: "POST", path: "/api/backend/drain", contentType: "application/json", body: `{"name": "http://a:80"}`, code: http.StatusUnauthorized},
+		{name: "wrong token", method: "POST", path: "/api/backend/drain", contentType: "application/json", token: "guess", body: `{"name": "http://a:80"}`, code: http.StatusUnauthorized},
+		{name: "invalid body", method: "POST", path: "/api/backend/drain", contentType: "application/json", token: "secret", body: `name=a`, code: http.StatusBadRequest},
+		{name: "drain", method: "POST", path: "/api/backend/drain", contentType: "application/json", token: "secret", body: `{"name": "http://a:80"}`, code: http.StatusOK, draining: true},
+		{name: "status", method: "GET", path: "/api/backend/drain?name=http://a:80", code: http.StatusOK, draining: true},
+		{name: "undrain without token", method: "POST", path: "/api/backend/undrain", contentType: "application/json", body: `{"name": "http://a:80"}`, code: http.StatusUnauthorized, draining: true},
+		{name: "undrain", method: "POST", path: "/api/backend/undrain?name=http://a:80", contentType: "application/json; charset=utf-8", token: "secret", code: http.StatusOK},
+		{name: "stop without token", method: "POST", path: "/api/backend/stop", contentType: "application/json", body: `{"name": "http://a:80"}`, code: http.StatusUnauthorized},
+		{name: "stop", method: "POST", path: "/api/backend/stop", contentType: "application/json", token: "secret", body: `{"name": "http://a:80"}`, code: http.StatusOK, draining: true},
+		{name: "health form post", method: "POST", path: "/api/backend/health?name=http://a:80&state=unhealthy", contentType: "text/plain", token: "secret", code: http.StatusUnsupportedMediaType, draining: true},
+		{name: "health without token", method: "POST", path: "/api/backend/health", contentType: "application/json", body: `{"name": "http://a:80", "state": "unhealthy"}`, code: http.StatusUnauthorized, draining: true},
+		{name: "health", method: "POST", path: "/api/backend/health", contentType: "application/json", token: "secret", body: `{"name": "http://a:80", "state": "unhealthy", "ttl": "1h"}`, code: http.StatusOK, draining: true, unhealthy: true},
+		{name: "health status", method: "GET", path: "/api/backend/health?name=http://a:80", code: http.StatusOK, draining: true, unhealthy: true},
+	}
+
+	handlers := map[string]http.HandlerFunc{
+		"/api/backend/drain":   cs.adminMiddleware(cs.handleDrainBackend),
+		"/api/backend/undrain": cs.adminMiddleware(cs.handleUndrainBackend),
+		"/api/backend/stop":    cs.adminMiddleware(cs.handleDrainBackend),
+		"/api/backend/health":  cs.adminMiddleware(cs.handleBackendHealth),
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+
+		rec := httptest.NewRecorder()
+		handlers[req.URL.Path](rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.code)
+		}
+		if backend.IsDraining() != tt.draining {
+			t.Errorf("%s: draining = %v, want %v", tt.name, backend.IsDraining(), tt.draining)
+		}
+		if backend.IsHealthy() == tt.unhealthy {
+			t.Errorf("%s: healthy = %v, want %v", tt.name, backend.IsHealthy(), !tt.unhealthy)
+		}
+	}
+
+	// Without a configured token nothing gets through
+	open := NewControlServer("0", cs.loadBalancer, "")
+	req := httptest.NewRequest("POST", "/api/backend/undrain", strings.NewReader(`{"name": "http://a:80"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer ")
+	rec := httptest.NewRecorder()
+	open.adminMiddleware(open.handleUndrainBackend)(rec, req)
+	if rec.Code != http.StatusUnauthorized || !backend.IsDraining() {
+		t.Errorf("status %d without an admin token, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestHealthEndpoint(t *testing.T) {
+	_, cs := newTestProxy(t, "http://a:80")
+	backend := cs.loadBalancer.FindBackends("http://a:80")[0]
+
+	tests := []struct {
+		query   string
+		code    int
+		healthy bool
+	}{
+		{query: "?name=http://a:80&state=unhealthy&ttl=1h", code: http.StatusOK, healthy: false},
+		{query: "?name=http://a:80&state=auto", code: http.StatusOK, healthy: true},
+		{query: "?name=http://a:80&state=down", code: http.StatusBadRequest, healthy: true},
+		{query: "?name=http://a:80&state=unhealthy&ttl=-1s", code: http.StatusBadRequest, healthy: true},
+		{query: "?name=http://b:80&state=unhealthy", code: http.StatusNotFound, healthy: true},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		cs.handleBackendHealth(rec, httptest.NewRequest("POST", "/api/backend/health"+tt.query, nil))
+		if rec.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.query, rec.Code, tt.code)
+		}
+		if backend.IsHealthy() != tt.healthy {
+			t.Errorf("%s: healthy = %v, want %v", tt.query, backend.IsHealthy(), tt.healthy)
+		}
+	}
+}
+
+func TestHealthEndpointHistory(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+
+	group := config.BackendConfig{Name: "web", Protocol: "http", LoadBalancer: "round_robin", Weight: 1}
+	group.Targets = []config.TargetConfig{{URL: upstream.URL}}
+	group.HealthCheck = config.HealthCheckConfig{
+		Enabled:            true,
+		Path:               "/health",
+		Interval:           10 * time.Millisecond,
+		Timeout:            time.Second,
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+		HistorySize:        2,
+	}
+	lb, err := proxy.NewLoadBalancer([]config.BackendConfig{group}, nil)
+	if err != nil {
+		t.Fatalf("NewLoadBalancer: %v", err)
+	}
+	lb.StartHealthChecks()
+	defer lb.StopHealthChecks()
+	cs := NewControlServer("0", lb, "secret")
+
+	// The recent probes of the target are listed with its health
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rec := httptest.NewRecorder()
+		cs.handleBackendHealth(rec, httptest.NewRequest("GET", "/api/backend/health?name="+upstream.URL, nil))
+		backends := decodeStatus(t, rec)["backends"].([]interface{})
+		checks, _ := backends[0].(map[string]interface{})["checks"].(map[string]interface{})
+
+		var history []interface{}
+		if checks != nil {
+			history = checks["history"].([]interface{})
+		}
+		if len(history) == 2 {
+			for _, entry := range history {
+				if probe := entry.(map[string]interface{}); probe["result"] != "unhealthy" || probe["status"] != "503" {
+					t.Errorf("probe %v, want an unhealthy 503", probe)
+				}
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("history %v, want 2 probes", history)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// readEvent reads the next event of a Server-Sent Events stream, returning
+// its id and type
+func readEvent(t *testing.T, stream *bufio.Reader) (string, string) {
+	t.Helper()
+
+	var id, eventType string
+	for {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && eventType != "":
+			return id, eventType
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		}
+	}
+}
+
+// openEvents connects to the event stream with the given Last-Event-ID,
+// if any
+func openEvents(t *testing.T, url, lastEventID string) *bufio.Reader {
+	t.Helper()
+
+	req, _ := http.NewRequest("GET", url, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return bufio.NewReader(resp.Body)
+}
+
+func TestEventsEndpoint(t *testing.T) {
+	_, cs := newTestProxy(t, "http://a:80")
+	bus := cs.loadBalancer.Events()
+	server := httptest.NewServer(http.HandlerFunc(cs.handleEvents))
+	t.Cleanup(server.Close) // Runs after the streams opened below are closed
+
+	bus.Publish(proxy.Event{Type: proxy.EventBackendAdded, Backend: "a"})
+	bus.Publish(proxy.Event{Type: proxy.EventBackendEjected, Backend: "a"})
+
+	// A new client receives the events published from now on
+	stream := openEvents(t, server.URL, "")
+	bus.Publish(proxy.Event{Type: proxy.EventBackendUnejected, Backend: "a"})
+	if id, eventType := readEvent(t, stream); id != "3" || eventType != string(proxy.EventBackendUnejected) {
+		t.Errorf("event %s %s, want 3 %s", id, eventType, proxy.EventBackendUnejected)
+	}
+
+	// A reconnecting client first receives the events it missed, of the
+	// requested types
+	stream = openEvents(t, server.URL+"?types=backend_ejected,backend_unejected", "1")
+	for _, want := range []string{"2", "3"} {
+		if id, _ := readEvent(t, stream); id != want {
+			t.Errorf("event %s after reconnecting, want %s", id, want)
+		}
+	}
+	bus.Publish(proxy.Event{Type: proxy.EventBackendRemoved, Backend: "a"})
+	bus.Publish(proxy.Event{Type: proxy.EventBackendEjected, Backend: "a"})
+	if id, _ := readEvent(t, stream); id != "5" {
+		t.Errorf("event %s, want 5 skipping the filtered types", id)
+	}
+
+	for _, tt := range []struct {
+		method      string
+		lastEventID string
+		code        int
+	}{
+		{method: "GET", lastEventID: "latest", code: http.StatusBadRequest},
+		{method: "POST", code: http.StatusMethodNotAllowed},
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(tt.method, "/api/events", nil)
+		req.Header.Set("Last-Event-ID", tt.lastEventID)
+		cs.handleEvents(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s with Last-Event-ID %q: status %d, want %d", tt.method, tt.lastEventID, rec.Code, tt.code)
+		}
+	}
+}
+
+// stalledWriter is a response writer whose first event blocks until the
+// writer is released
+type stalledWriter struct {
+	*httptest.ResponseRecorder
+	started chan struct{} // Closed once the stream starts
+	stalled chan struct{} // Closed once an event is blocked
+	release chan struct{}
+	once    sync.Once
+}
+
+func (w *stalledWriter) WriteHeader(code int) {
+	w.ResponseRecorder.WriteHeader(code)
+	close(w.started)
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	if bytes.HasPrefix(p, []byte("id: ")) {
+		w.once.Do(func() {
+			close(w.stalled)
+			<-w.release
+		})
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestEventsEndpointReset(t *testing.T) {
+	_, cs := newTestProxy(t, "http://a:80")
+	bus := cs.loadBalancer.Events()
+
+	w := &stalledWriter{
+		ResponseRecorder: httptest.NewRecorder(),
+		started:          make(chan struct{}),
+		stalled:          make(chan struct{}),
+		release:          make(chan struct{}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		cs.handleEvents(w, httptest.NewRequest("GET", "/api/events", nil).WithContext(ctx))
+		close(done)
+	}()
+	<-w.started
+
+	// The client falls behind by more than the stream buffers
+	bus.Publish(proxy.Event{Type: proxy.EventBackendAdded})
+	<-w.stalled
+	for i := 0; i < 100; i++ {
+		bus.Publish(proxy.Event{Type: proxy.EventBackendAdded})
+	}
+	close(w.release)
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("stream did not end after falling behind")
+	}
+
+	// The stream ends with a reset event carrying the last event sent
+	stream := bufio.NewReader(w.Body)
+	var id, eventType string
+	for events := 0; eventType != "reset"; events++ {
+		id, eventType = readEvent(t, stream)
+		if want := events + 1; eventType != "reset" && id != strconv.Itoa(want) {
+			t.Fatalf("event %s, want %d", id, want)
+		}
+	}
+	if id != "65" {
+		t.Errorf("reset to event %s, want 65", id)
+	}
+
+	// Reconnecting with its ID resumes right after it
+	server := httptest.NewServer(http.HandlerFunc(cs.handleEvents))
+	t.Cleanup(server.Close) // Runs after the streams opened below are closed
+	if next, _ := readEvent(t, openEvents(t, server.URL, id)); next != "66" {
+		t.Errorf("event %s after reconnecting, want 66", next)
+	}
+}
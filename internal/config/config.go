@@ -2,9 +2,14 @@ package config
 
 import (
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
+	"github.com/os-dev/quic-reverse-proxy/pkg/health"
 	"gopkg.in/yaml.v3"
 )
 
@@ -34,6 +39,24 @@ func Load(path string) (*Config, error) {
 	return &cfg, nil
 }
 
+// enabled reports whether any discovery provider is configured
+func (d DiscoveryConfig) enabled() bool {
+	return len(d.FileSD) > 0 || len(d.Kubernetes) > 0
+}
+
+// UnmarshalYAML accepts a target written as a plain URL string as well as
+// the mapping form
+func (t *TargetConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*t = TargetConfig{}
+		return value.Decode(&t.URL)
+	}
+
+	// Decode through an alias type so this method is not called recursively
+	type target TargetConfig
+	return value.Decode((*target)(t))
+}
+
 // setDefaults applies default values to configuration
 func setDefaults(cfg *Config) error {
 	// Server defaults
@@ -76,14 +99,120 @@ func setDefaults(cfg *Config) error {
 		if backend.Timeout == 0 {
 			backend.Timeout = 10 * time.Second
 		}
-		if backend.RetryCount == 0 {
-			backend.RetryCount = 3
+		if backend.RetryCount == nil {
+			retries := 3
+			backend.RetryCount = &retries
+		}
+		if len(backend.RetryPolicy.RetryOn) == 0 {
+			backend.RetryPolicy.RetryOn = []int{502, 503, 504}
+		}
+		if backend.RetryPolicy.BackoffBase == 0 {
+			backend.RetryPolicy.BackoffBase = 25 * time.Millisecond
+		}
+		if backend.RetryPolicy.BackoffMax == 0 {
+			backend.RetryPolicy.BackoffMax = 250 * time.Millisecond
+		}
+		if backend.RetryPolicy.BudgetPercent == 0 {
+			backend.RetryPolicy.BudgetPercent = 20
+		}
+		if backend.RetryPolicy.MinRetriesPerSecond == 0 {
+			backend.RetryPolicy.MinRetriesPerSecond = 3
+		}
+		if backend.LoadBalancer == "consistent_hash" && backend.HashKey.Source == "" {
+			backend.HashKey.Source = "client_ip"
+		}
+		if backend.LoadBalancer == "p2c_ewma" && backend.EWMADecay == 0 {
+			backend.EWMADecay = 10 * time.Second
+		}
+
+		// Sticky session defaults
+		if backend.StickySession.Enabled {
+			if backend.StickySession.CookieName == "" {
+				backend.StickySession.CookieName = "qrp_affinity"
+			}
+			if backend.StickySession.Fallback == "" {
+				backend.StickySession.Fallback = "rebalance"
+			}
+		}
+
+		// Outlier detection defaults
+		if backend.OutlierDetection.Enabled {
+			od := &backend.OutlierDetection
+			if od.Consecutive5xx == 0 {
+				od.Consecutive5xx = 5
+			}
+			if od.ConsecutiveGatewayErrors == 0 {
+				od.ConsecutiveGatewayErrors = 3
+			}
+			if od.ConsecutiveSlow == 0 {
+				od.ConsecutiveSlow = 5
+			}
+			if od.BaseEjectionTime == 0 {
+				od.BaseEjectionTime = 30 * time.Second
+			}
+			if od.MaxEjectionTime == 0 {
+				od.MaxEjectionTime = 5 * time.Minute
+			}
+			if od.MaxEjectionPercent == 0 {
+				od.MaxEjectionPercent = 50
+			}
+		}
+
+		// Circuit breaker defaults
+		if backend.CircuitBreaker.Enabled {
+			cb := &backend.CircuitBreaker
+			if cb.ErrorThreshold == 0 {
+				cb.ErrorThreshold = 50
+			}
+			if cb.MinRequests == 0 {
+				cb.MinRequests = 20
+			}
+			if cb.Window == 0 {
+				cb.Window = 10 * time.Second
+			}
+			if cb.OpenDuration == 0 {
+				cb.OpenDuration = 30 * time.Second
+			}
+			if cb.HalfOpenRequests == 0 {
+				cb.HalfOpenRequests = 3
+			}
+		}
+
+		// Slow start defaults
+		if backend.SlowStart.Enabled {
+			ss := &backend.SlowStart
+			if ss.Window == 0 {
+				ss.Window = 30 * time.Second
+			}
+			if ss.Curve == "" {
+				ss.Curve = "linear"
+			}
+			if ss.MinWeightPercent == 0 {
+				ss.MinWeightPercent = 10
+			}
+		}
+
+		// DNS discovery defaults
+		if backend.DNS.Enabled {
+			dns := &backend.DNS
+			if dns.Type == "" {
+				dns.Type = "A"
+			}
+			if dns.Scheme == "" {
+				dns.Scheme = "http"
+			}
+			if dns.RefreshInterval == 0 {
+				dns.RefreshInterval = 30 * time.Second
+			}
 		}
 
 		// Health check defaults
 		if !backend.HealthCheck.Enabled {
 			continue
 		}
+		if backend.HealthCheck.Type == "" {
+			backend.HealthCheck.Type = backend.Protocol
+		}
 		if backend.HealthCheck.Path == "" {
 			backend.HealthCheck.Path = "/health"
 		}
@@ -99,6 +228,65 @@ func setDefaults(cfg *Config) error {
 		if backend.HealthCheck.UnhealthyThreshold == 0 {
 			backend.HealthCheck.UnhealthyThreshold = 3
 		}
+		if backend.HealthCheck.Jitter == 0 {
+			backend.HealthCheck.Jitter = backend.HealthCheck.Interval / 10
+		}
+		if backend.HealthCheck.HistorySize == 0 {
+			backend.HealthCheck.HistorySize = 10
+		}
+		if backend.HealthCheck.Method == "" {
+			backend.HealthCheck.Method = "GET"
+		}
+		if backend.HealthCheck.DegradedWeightPercent == 0 {
+			backend.HealthCheck.DegradedWeightPercent = 50
+		}
+	}
+
+	// Hedging defaults
+	for i := range cfg.Routing.Rules {
+		hedge := &cfg.Routing.Rules[i].Hedge
+		if !hedge.Enabled {
+			continue
+		}
+		if hedge.Delay == 0 {
+			hedge.Delay = 100 * time.Millisecond
+		}
+		if hedge.MaxExtraLoadPercent == 0 {
+			hedge.MaxExtraLoadPercent = 10
+		}
+	}
+
+	// Discovery defaults
+	for i := range cfg.Discovery.FileSD {
+		if cfg.Discovery.FileSD[i].RefreshInterval == 0 {
+			cfg.Discovery.FileSD[i].RefreshInterval = 5 * time.Second
+		}
+	}
+	for i := range cfg.Discovery.Kubernetes {
+		k8s := &cfg.Discovery.Kubernetes[i]
+		if k8s.Scheme == "" {
+			k8s.Scheme = "http"
+		}
+		if k8s.TokenFile == "" {
+			k8s.TokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+		}
+		if k8s.CAFile == "" {
+			k8s.CAFile = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+		}
+	}
+
+	// Event webhook defaults
+	for i := range cfg.Events.Webhooks {
+		webhook := &cfg.Events.Webhooks[i]
+		if webhook.Timeout == 0 {
+			webhook.Timeout = 5 * time.Second
+		}
+		if webhook.MaxRetries == 0 {
+			webhook.MaxRetries = 3
+		}
+		if webhook.RetryBackoff == 0 {
+			webhook.RetryBackoff = time.Second
+		}
 	}
 
 	// Telemetry defaults
@@ -184,19 +372,38 @@ func validate(cfg *Config) error {
 		}
 		backendNames[backend.Name] = true
 
-		if len(backend.Targets) == 0 {
+		if len(backend.Targets) == 0 && !cfg.Discovery.enabled() && !backend.DNS.Enabled {
 			return fmt.Errorf("backend[%d].targets cannot be empty", i)
 		}
+		for j, target := range backend.Targets {
+			if err := validateTarget(target); err != nil {
+				return fmt.Errorf("backend[%d].targets[%d]: %w", i, j, err)
+			}
+		}
 
 		validLBMethods := map[string]bool{
 			"round_robin":       true,
 			"least_connections": true,
 			"weighted":          true,
+			"consistent_hash":   true,
+			"p2c_ewma":          true,
 		}
 		if !validLBMethods[backend.LoadBalancer] {
 			return fmt.Errorf("invalid load balancer method: %s", backend.LoadBalancer)
 		}
 
+		if backend.LoadBalancer == "consistent_hash" {
+			switch backend.HashKey.Source {
+			case "client_ip", "path":
+			case "header", "cookie":
+				if backend.HashKey.Name == "" {
+					return fmt.Errorf("backend[%d].hash_key.name is required for source %s", i, backend.HashKey.Source)
+				}
+			default:
+				return fmt.Errorf("invalid hash key source: %s", backend.HashKey.Source)
+			}
+		}
+
 		validProtocols := map[string]bool{
 			"http":  true,
 			"https": true,
@@ -206,15 +413,187 @@ func validate(cfg *Config) error {
 			return fmt.Errorf("invalid backend protocol: %s", backend.Protocol)
 		}
 
+		if backend.TLSCAFile != "" {
+			if _, err := os.Stat(backend.TLSCAFile); os.IsNotExist(err) {
+				return fmt.Errorf("backend[%d]: tls ca file does not exist: %s", i, backend.TLSCAFile)
+			}
+		}
+
+		if backend.HealthCheck.Enabled {
+			if err := validateHealthCheck(i, backend); err != nil {
+				return err
+			}
+		}
+
 		if backend.Weight <= 0 {
 			return fmt.Errorf("backend[%d].weight must be positive", i)
 		}
 		if backend.Timeout <= 0 {
 			return fmt.Errorf("backend[%d].timeout must be positive", i)
 		}
-		if backend.RetryCount < 0 {
+		if backend.Retries() < 0 {
 			return fmt.Errorf("backend[%d].retry_count cannot be negative", i)
 		}
+		if err := validateRetryPolicy(i, backend.RetryPolicy); err != nil {
+			return err
+		}
+		if backend.EWMADecay < 0 {
+			return fmt.Errorf("backend[%d].ewma_decay cannot be negative", i)
+		}
+
+		if od := backend.OutlierDetection; od.Enabled {
+			if od.Consecutive5xx < 0 || od.ConsecutiveGatewayErrors < 0 || od.ConsecutiveSlow < 0 {
+				return fmt.Errorf("backend[%d].outlier_detection: consecutive counts cannot be negative", i)
+			}
+			if od.LatencyThreshold < 0 {
+				return fmt.Errorf("backend[%d].outlier_detection.latency_threshold cannot be negative", i)
+			}
+			if od.BaseEjectionTime <= 0 || od.MaxEjectionTime < od.BaseEjectionTime {
+				return fmt.Errorf("backend[%d].outlier_detection: max_ejection_time must be at least base_ejection_time", i)
+			}
+			if od.MaxEjectionPercent < 0 || od.MaxEjectionPercent > 100 {
+				return fmt.Errorf("backend[%d].outlier_detection.max_ejection_percent must be between 0 and 100", i)
+			}
+		}
+
+		if cb := backend.CircuitBreaker; cb.Enabled {
+			if cb.ErrorThreshold <= 0 || cb.ErrorThreshold > 100 {
+				return fmt.Errorf("backend[%d].circuit_breaker.error_threshold must be between 0 and 100", i)
+			}
+			if cb.MinRequests < 1 || cb.HalfOpenRequests < 1 {
+				return fmt.Errorf("backend[%d].circuit_breaker: min_requests and half_open_requests must be positive", i)
+			}
+			if cb.Window <= 0 || cb.OpenDuration <= 0 {
+				return fmt.Errorf("backend[%d].circuit_breaker: window and open_duration must be positive", i)
+			}
+			if cb.MaxConcurrentRequests < 0 {
+				return fmt.Errorf("backend[%d].circuit_breaker.max_concurrent_requests cannot be negative", i)
+			}
+		}
+
+		if ss := backend.SlowStart; ss.Enabled {
+			if ss.Window <= 0 {
+				return fmt.Errorf("backend[%d].slow_start.window must be positive", i)
+			}
+			if ss.Curve != "linear" && ss.Curve != "exponential" {
+				return fmt.Errorf("invalid slow start curve: %s", ss.Curve)
+			}
+			if ss.MinWeightPercent <= 0 || ss.MinWeightPercent > 100 {
+				return fmt.Errorf("backend[%d].slow_start.min_weight_percent must be between 0 and 100", i)
+			}
+		}
+
+		for j, tier := range backend.Tiers {
+			if tier.Name == "" {
+				return fmt.Errorf("backend[%d].tiers[%d].name is required", i, j)
+			}
+			if len(tier.Targets) == 0 {
+				return fmt.Errorf("backend[%d].tiers[%d].targets cannot be empty", i, j)
+			}
+			for k, target := range tier.Targets {
+				if err := validateTarget(target); err != nil {
+					return fmt.Errorf("backend[%d].tiers[%d].targets[%d]: %w", i, j, k, err)
+				}
+			}
+		}
+		if backend.FailoverThreshold < 0 || backend.FailoverThreshold > 100 {
+			return fmt.Errorf("backend[%d].failover_threshold must be between 0 and 100", i)
+		}
+		if backend.FailoverBackend == backend.Name {
+			return fmt.Errorf("backend[%d].failover_backend cannot refer to itself", i)
+		}
+
+		if dns := backend.DNS; dns.Enabled {
+			if dns.Name == "" {
+				return fmt.Errorf("backend[%d].dns.name is required", i)
+			}
+			switch dns.Type {
+			case "SRV":
+			case "A":
+				if dns.Port <= 0 || dns.Port > 65535 {
+					return fmt.Errorf("backend[%d].dns.port must be between 1 and 65535", i)
+				}
+			default:
+				return fmt.Errorf("invalid dns record type: %s", dns.Type)
+			}
+			if dns.RefreshInterval <= 0 {
+				return fmt.Errorf("backend[%d].dns.refresh_interval must be positive", i)
+			}
+		}
+
+		if lr := backend.LocalityRouting; lr.Enabled {
+			if lr.MinHealthyPercent < 0 || lr.MinHealthyPercent > 100 {
+				return fmt.Errorf("backend[%d].locality_routing.min_healthy_percent must be between 0 and 100", i)
+			}
+			if lr.MaxConnections < 0 {
+				return fmt.Errorf("backend[%d].locality_routing.max_connections cannot be negative", i)
+			}
+		}
+
+		if backend.StickySession.Enabled {
+			if backend.StickySession.Fallback != "rebalance" && backend.StickySession.Fallback != "fail" {
+				return fmt.Errorf("invalid sticky session fallback: %s", backend.StickySession.Fallback)
+			}
+			if backend.StickySession.TTL < 0 {
+				return fmt.Errorf("backend[%d].sticky_session.ttl cannot be negative", i)
+			}
+		}
+	}
+
+	for i, backend := range cfg.Backends {
+		if backend.FailoverBackend != "" && !backendNames[backend.FailoverBackend] {
+			return fmt.Errorf("backend[%d]: failover backend not found: %s", i, backend.FailoverBackend)
+		}
+	}
+
+	for i, fileSD := range cfg.Discovery.FileSD {
+		if len(fileSD.Files) == 0 {
+			return fmt.Errorf("discovery.file_sd[%d].files cannot be empty", i)
+		}
+		for _, pattern := range fileSD.Files {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return fmt.Errorf("discovery.file_sd[%d]: invalid file pattern %s", i, pattern)
+			}
+		}
+		if fileSD.Backend != "" && !backendNames[fileSD.Backend] {
+			return fmt.Errorf("discovery.file_sd[%d]: backend not found: %s", i, fileSD.Backend)
+		}
+		if fileSD.RefreshInterval <= 0 {
+			return fmt.Errorf("discovery.file_sd[%d].refresh_interval must be positive", i)
+		}
+	}
+
+	for i, k8s := range cfg.Discovery.Kubernetes {
+		if k8s.Backend == "" {
+			return fmt.Errorf("discovery.kubernetes[%d].backend is required", i)
+		}
+		if !backendNames[k8s.Backend] {
+			return fmt.Errorf("discovery.kubernetes[%d]: backend not found: %s", i, k8s.Backend)
+		}
+		if k8s.Service == "" {
+			return fmt.Errorf("discovery.kubernetes[%d].service is required", i)
+		}
+		if k8s.APIServer != "" {
+			if _, err := url.Parse(k8s.APIServer); err != nil {
+				return fmt.Errorf("discovery.kubernetes[%d]: invalid api_server %s", i, k8s.APIServer)
+			}
+		}
+	}
+
+	for i, webhook := range cfg.Events.Webhooks {
+		u, err := url.Parse(webhook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("events.webhooks[%d]: invalid url %s", i, webhook.URL)
+		}
+		if webhook.Timeout < 0 {
+			return fmt.Errorf("events.webhooks[%d].timeout cannot be negative", i)
+		}
+		if webhook.MaxRetries < 0 {
+			return fmt.Errorf("events.webhooks[%d].max_retries cannot be negative", i)
+		}
+		if webhook.RetryBackoff < 0 {
+			return fmt.Errorf("events.webhooks[%d].retry_backoff cannot be negative", i)
+		}
 	}
 
 	// Validate routing configuration
@@ -225,8 +604,16 @@ func validate(cfg *Config) error {
 	}
 
 	for i, rule := range cfg.Routing.Rules {
-		if rule.Path == "" && rule.PathPrefix == "" {
-			return fmt.Errorf("routing.rules[%d]: either path or path_prefix is required", i)
+		if rule.Path == "" && rule.PathPrefix == "" && rule.PathRegex == "" {
+			return fmt.Errorf("routing.rules[%d]: either path, path_prefix or path_regex is required", i)
+		}
+		if rule.PathRegex != "" {
+			if _, err := regexp.Compile(rule.PathRegex); err != nil {
+				return fmt.Errorf("routing.rules[%d]: invalid path_regex %s: %w", i, rule.PathRegex, err)
+			}
+		}
+		if rule.Rewrite != "" && !strings.HasPrefix(rule.Rewrite, "/") {
+			return fmt.Errorf("routing.rules[%d].rewrite must start with /", i)
 		}
 		if rule.Backend == "" {
 			return fmt.Errorf("routing.rules[%d].backend is required", i)
@@ -234,6 +621,17 @@ func validate(cfg *Config) error {
 		if !backendNames[rule.Backend] {
 			return fmt.Errorf("routing.rules[%d]: backend not found: %s", i, rule.Backend)
 		}
+		if hedge := rule.Hedge; hedge.Enabled {
+			if hedge.Delay <= 0 {
+				return fmt.Errorf("routing.rules[%d].hedge.delay must be positive", i)
+			}
+			if hedge.Percentile < 0 || hedge.Percentile >= 100 {
+				return fmt.Errorf("routing.rules[%d].hedge.percentile must be between 0 and 100", i)
+			}
+			if hedge.MaxExtraLoadPercent <= 0 || hedge.MaxExtraLoadPercent > 100 {
+				return fmt.Errorf("routing.rules[%d].hedge.max_extra_load_percent must be between 0 and 100", i)
+			}
+		}
 	}
 
 	// Validate telemetry configuration
@@ -265,3 +663,91 @@ func validate(cfg *Config) error {
 
 	return nil
 }
+
+// validateRetryPolicy checks the retry policy of backend i
+func validateRetryPolicy(i int, policy RetryPolicyConfig) error {
+	for _, code := range policy.RetryOn {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("backend[%d].retry_policy.retry_on: invalid status code %d", i, code)
+		}
+	}
+	if policy.PerTryTimeout < 0 {
+		return fmt.Errorf("backend[%d].retry_policy.per_try_timeout cannot be negative", i)
+	}
+	if policy.BackoffBase <= 0 || policy.BackoffMax < policy.BackoffBase {
+		return fmt.Errorf("backend[%d].retry_policy: backoff_max must be at least backoff_base", i)
+	}
+	if policy.BudgetPercent < 0 || policy.BudgetPercent > 100 {
+		return fmt.Errorf("backend[%d].retry_policy.budget_percent must be between 0 and 100", i)
+	}
+	if policy.MinRetriesPerSecond < 0 {
+		return fmt.Errorf("backend[%d].retry_policy.min_retries_per_second cannot be negative", i)
+	}
+	return nil
+}
+
+// validateHealthCheck checks the health check settings of backend i
+func validateHealthCheck(i int, backend BackendConfig) error {
+	hc := backend.HealthCheck
+
+	validProbeTypes := map[string]bool{
+		"http":  true,
+		"https": true,
+		"h3":    true,
+		"grpc":  true,
+		"tcp":   true,
+		"tls":   true,
+	}
+	if !validProbeTypes[hc.Type] {
+		return fmt.Errorf("invalid health check type: %s", hc.Type)
+	}
+	// gRPC runs over h2c for http backends and h2 for https ones
+	if hc.Type == "grpc" && backend.Protocol == "h3" {
+		return fmt.Errorf("backend[%d]: grpc health checks require an http or https backend", i)
+	}
+
+	if hc.Interval <= 0 || hc.Timeout <= 0 {
+		return fmt.Errorf("backend[%d].health_check: interval and timeout must be positive", i)
+	}
+	if hc.Jitter < 0 || hc.Jitter > hc.Interval {
+		return fmt.Errorf("backend[%d].health_check.jitter must be between 0 and the interval", i)
+	}
+	if hc.HistorySize < -1 {
+		return fmt.Errorf("backend[%d].health_check.history_size must be positive, or -1 to keep no history", i)
+	}
+	if hc.DegradedWeightPercent <= 0 || hc.DegradedWeightPercent > 100 {
+		return fmt.Errorf("backend[%d].health_check.degraded_weight_percent must be between 0 and 100", i)
+	}
+	if _, err := health.ParseStatusRanges(hc.Expect.Status); err != nil {
+		return fmt.Errorf("backend[%d].health_check.expect.status: %w", i, err)
+	}
+	if _, err := health.ParseStatusRanges(hc.Expect.DegradedStatus); err != nil {
+		return fmt.Errorf("backend[%d].health_check.expect.degraded_status: %w", i, err)
+	}
+	if hc.Expect.BodyRegex != "" {
+		if _, err := regexp.Compile(hc.Expect.BodyRegex); err != nil {
+			return fmt.Errorf("backend[%d].health_check.expect.body_regex: %w", i, err)
+		}
+	}
+	if hc.Expect.JSONPath == "" && (len(hc.Expect.JSONValues) > 0 || len(hc.Expect.DegradedValues) > 0) {
+		return fmt.Errorf("backend[%d].health_check.expect: json_values and degraded_values require json_path", i)
+	}
+	return nil
+}
+
+// validateTarget checks a single backend target
+func validateTarget(target TargetConfig) error {
+	if target.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	if _, err := url.Parse(target.URL); err != nil {
+		return fmt.Errorf("invalid url %s: %w", target.URL, err)
+	}
+	if target.Weight < 0 {
+		return fmt.Errorf("weight cannot be negative")
+	}
+	if target.MaxConnections < 0 {
+		return fmt.Errorf("max_connections cannot be negative")
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestRetryCountDefault(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want int
+	}{
+		{name: "unset", yaml: "backends:\n  - name: web\n", want: 3},
+		{name: "disabled", yaml: "backends:\n  - name: web\n    retry_count: 0\n", want: 0},
+		{name: "set", yaml: "backends:\n  - name: web\n    retry_count: 5\n", want: 5},
+	}
+
+	for _, tt := range tests {
+		var cfg Config
+		if err := yaml.Unmarshal([]byte(tt.yaml), &cfg); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := setDefaults(&cfg); err != nil {
+			t.Fatalf("%s: setDefaults: %v", tt.name, err)
+		}
+		if got := cfg.Backends[0].Retries(); got != tt.want {
+			t.Errorf("%s: retries = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// loadConfig loads a configuration with the given backends section
+func loadConfig(t *testing.T, backends string) (*Config, error) {
+	t.Helper()
+
+	dir := t.TempDir()
+	for _, name := range []string{"cert.pem", "key.pem"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := fmt.Sprintf("server:\n  cert_file: %s\n  key_file: %s\n%s", filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), backends)
+
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return Load(path)
+}
+
+func TestTargetSyntax(t *testing.T) {
+	cfg, err := loadConfig(t, `
+backends:
+  - name: web
+    weight: 2
+    targets:
+      - http://a:80
+      - url: http://b:80
+        weight: 5
+        labels:
+          version: canary
+        max_connections: 10
+        drain: true
+`)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	want := []TargetConfig{
+		{URL: "http://a:80"},
+		{URL: "http://b:80", Weight: 5, Labels: map[string]string{"version": "canary"}, MaxConnections: 10, Drain: true},
+	}
+	if got := cfg.Backends[0].Targets; !reflect.DeepEqual(got, want) {
+		t.Errorf("targets = %+v, want %+v", got, want)
+	}
+}
+
+func TestTargetValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{name: "missing url", target: "weight: 1", want: "url is required"},
+		{name: "negative weight", target: "url: http://a:80\n        weight: -1", want: "weight cannot be negative"},
+		{name: "negative max_connections", target: "url: http://a:80\n        max_connections: -1", want: "max_connections cannot be negative"},
+	}
+
+	for _, tt := range tests {
+		_, err := loadConfig(t, "backends:\n  - name: web\n    targets:\n      - "+tt.target+"\n")
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestHealthCheckHistorySize(t *testing.T) {
+	tests := []struct {
+		setting string
+		want    int
+		err     string
+	}{
+		{setting: "", want: 10},
+		{setting: "history_size: 5", want: 5},
+		{setting: "history_size: -1", want: -1},
+		{setting: "history_size: -2", err: "history_size must be positive, or -1"},
+	}
+
+	for _, tt := range tests {
+		cfg, err := loadConfig(t, "backends:\n  - name: web\n    targets: [\"http://a:80\"]\n    health_check:\n      enabled: true\n      path: /health\n      "+tt.setting+"\n")
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: error %v, want %q", tt.setting, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", tt.setting, err)
+		}
+		if got := cfg.Backends[0].HealthCheck.HistorySize; got != tt.want {
+			t.Errorf("%q: history_size = %d, want %d", tt.setting, got, tt.want)
+		}
+	}
+}
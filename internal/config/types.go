@@ -10,15 +10,30 @@ type Config struct {
 	Backends  []BackendConfig `yaml:"backends"`
 	Routing   RoutingConfig   `yaml:"routing"`
 	Telemetry TelemetryConfig `yaml:"telemetry"`
+	Discovery DiscoveryConfig `yaml:"discovery,omitempty"`
+	Events    EventsConfig    `yaml:"events,omitempty"`
+	Admin     AdminConfig     `yaml:"admin,omitempty"`
 }
 
 // ServerConfig contains QUIC server configuration
 type ServerConfig struct {
-	Address         string     `yaml:"address"`
-	CertFile        string     `yaml:"cert_file"`
-	KeyFile         string     `yaml:"key_file"`
-	QUIC            QUICConfig `yaml:"quic"`
-	FallbackAddress string     `yaml:"fallback_address,omitempty"`
+	Address         string         `yaml:"address"`
+	CertFile        string         `yaml:"cert_file"`
+	KeyFile         string         `yaml:"key_file"`
+	QUIC            QUICConfig     `yaml:"quic"`
+	FallbackAddress string         `yaml:"fallback_address,omitempty"`
+	Locality        LocalityConfig `yaml:"locality,omitempty"` // Where this proxy instance runs
+}
+
+// AdminConfig contains settings of the control API
+type AdminConfig struct {
+	Token string `yaml:"token,omitempty"` // Bearer token required to change backend state, refused while unset
+}
+
+// LocalityConfig describes where a proxy instance or target runs
+type LocalityConfig struct {
+	Zone   string `yaml:"zone,omitempty"`
+	Region string `yaml:"region,omitempty"`
 }
 
 // QUICConfig contains QUIC-specific settings
@@ -33,15 +48,137 @@ type QUICConfig struct {
 
 // BackendConfig represents a backend service configuration
 type BackendConfig struct {
-	Name          string            `yaml:"name"`
-	Targets       []string          `yaml:"targets"`
-	Protocol      string            `yaml:"protocol,omitempty"` // "http", "https", "h3"
-	TLSSkipVerify bool              `yaml:"tls_skip_verify,omitempty"`
-	HealthCheck   HealthCheckConfig `yaml:"health_check"`
-	LoadBalancer  string            `yaml:"load_balancer"` // "round_robin", "least_connections", "weighted"
-	Weight        int               `yaml:"weight,omitempty"`
-	Timeout       time.Duration     `yaml:"timeout,omitempty"`
-	RetryCount    int               `yaml:"retry_count,omitempty"`
+	Name              string                 `yaml:"name"`
+	Targets           []TargetConfig         `yaml:"targets"`
+	Tiers             []TierConfig           `yaml:"tiers,omitempty"`              // Lower priority targets, in order
+	FailoverBackend   string                 `yaml:"failover_backend,omitempty"`   // Group used when no tier is healthy enough
+	FailoverThreshold float64                `yaml:"failover_threshold,omitempty"` // Healthy percentage below which a tier spills over
+	Protocol          string                 `yaml:"protocol,omitempty"`           // "http", "https", "h3"
+	TLSSkipVerify     bool                   `yaml:"tls_skip_verify,omitempty"`
+	TLSCAFile         string                 `yaml:"tls_ca_file,omitempty"` // CA bundle verifying the targets' certificates
+	HealthCheck       HealthCheckConfig      `yaml:"health_check"`
+	LoadBalancer      string                 `yaml:"load_balancer"` // "round_robin", "least_connections", "weighted", "consistent_hash", "p2c_ewma"
+	HashKey           HashKeyConfig          `yaml:"hash_key,omitempty"`
+	EWMADecay         time.Duration          `yaml:"ewma_decay,omitempty"` // Latency EWMA time constant for p2c_ewma
+	Weight            int                    `yaml:"weight,omitempty"`
+	Timeout           time.Duration          `yaml:"timeout,omitempty"`
+	RetryCount        *int                   `yaml:"retry_count,omitempty"` // Retries of failed idempotent requests, 3 when unset, 0 disables retries
+	RetryPolicy       RetryPolicyConfig      `yaml:"retry_policy,omitempty"`
+	StickySession     StickySessionConfig    `yaml:"sticky_session,omitempty"`
+	OutlierDetection  OutlierDetectionConfig `yaml:"outlier_detection,omitempty"`
+	CircuitBreaker    CircuitBreakerConfig   `yaml:"circuit_breaker,omitempty"`
+	SlowStart         SlowStartConfig        `yaml:"slow_start,omitempty"`
+	LocalityRouting   LocalityRoutingConfig  `yaml:"locality_routing,omitempty"`
+	DNS               DNSDiscoveryConfig     `yaml:"dns,omitempty"`
+}
+
+// Retries returns the number of times a failed idempotent request may be
+// retried, 0 when retry_count is unset and defaults were not applied
+func (b BackendConfig) Retries() int {
+	if b.RetryCount == nil {
+		return 0
+	}
+	return *b.RetryCount
+}
+
+// DNSDiscoveryConfig contains settings for discovering the targets of a
+// group from DNS. Every record becomes its own target; SRV records only when
+// they have the lowest priority value of the answer.
+type DNSDiscoveryConfig struct {
+	Enabled         bool          `yaml:"enabled"`
+	Name            string        `yaml:"name"`                       // Record name to resolve
+	Type            string        `yaml:"type,omitempty"`             // "SRV", "A" (A and AAAA)
+	Port            int           `yaml:"port,omitempty"`             // Target port for A records
+	Scheme          string        `yaml:"scheme,omitempty"`           // Target URL scheme
+	Resolver        string        `yaml:"resolver,omitempty"`         // DNS server host:port, defaults to /etc/resolv.conf
+	RefreshInterval time.Duration `yaml:"refresh_interval,omitempty"` // Longest time between resolutions, whatever the TTL
+}
+
+// TargetConfig is a single backend target. It can be written either as a
+// plain URL string or as a mapping carrying per-target settings.
+type TargetConfig struct {
+	URL            string            `yaml:"url"`
+	Weight         int               `yaml:"weight,omitempty"` // Defaults to the backend weight
+	Zone           string            `yaml:"zone,omitempty"`
+	Region         string            `yaml:"region,omitempty"`
+	Labels         map[string]string `yaml:"labels,omitempty"`
+	MaxConnections int               `yaml:"max_connections,omitempty"` // 0 for no limit
+	Drain          bool              `yaml:"drain,omitempty"`           // Take no new requests
+}
+
+// LocalityRoutingConfig contains settings for preferring targets in the
+// proxy's own zone, then region, over remote ones
+type LocalityRoutingConfig struct {
+	Enabled           bool    `yaml:"enabled"`
+	MinHealthyPercent float64 `yaml:"min_healthy_percent,omitempty"` // Local healthy share below which traffic spills over
+	MaxConnections    int     `yaml:"max_connections,omitempty"`     // In-flight requests at which a local target is overloaded, 0 for no limit
+}
+
+// TierConfig is a set of targets that only receives traffic once the tiers
+// before it are no longer healthy enough
+type TierConfig struct {
+	Name    string         `yaml:"name"`
+	Targets []TargetConfig `yaml:"targets"`
+}
+
+// SlowStartConfig contains settings for ramping up traffic to targets that
+// have just recovered or been added
+type SlowStartConfig struct {
+	Enabled          bool          `yaml:"enabled"`
+	Window           time.Duration `yaml:"window,omitempty"`             // Time to reach the full weight
+	Curve            string        `yaml:"curve,omitempty"`              // "linear", "exponential"
+	MinWeightPercent float64       `yaml:"min_weight_percent,omitempty"` // Share of the weight at the start of the window
+}
+
+// CircuitBreakerConfig contains per-target circuit breaker settings
+type CircuitBreakerConfig struct {
+	Enabled               bool          `yaml:"enabled"`
+	ErrorThreshold        float64       `yaml:"error_threshold,omitempty"`         // Error percentage that opens the circuit
+	MinRequests           int           `yaml:"min_requests,omitempty"`            // Requests needed in a window before tripping
+	Window                time.Duration `yaml:"window,omitempty"`                  // Error rate measurement window
+	OpenDuration          time.Duration `yaml:"open_duration,omitempty"`           // Time before probing an open circuit
+	HalfOpenRequests      int           `yaml:"half_open_requests,omitempty"`      // Successful probes needed to close the circuit
+	MaxConcurrentRequests int           `yaml:"max_concurrent_requests,omitempty"` // 0 for no limit
+}
+
+// OutlierDetectionConfig contains passive health checking settings. Backends
+// failing live traffic are ejected for a duration that doubles with every
+// ejection, up to max_ejection_time.
+type OutlierDetectionConfig struct {
+	Enabled                  bool          `yaml:"enabled"`
+	Consecutive5xx           int           `yaml:"consecutive_5xx,omitempty"`
+	ConsecutiveGatewayErrors int           `yaml:"consecutive_gateway_errors,omitempty"` // 502, 503, 504 and connection errors
+	LatencyThreshold         time.Duration `yaml:"latency_threshold,omitempty"`          // 0 disables latency based ejection
+	ConsecutiveSlow          int           `yaml:"consecutive_slow,omitempty"`
+	BaseEjectionTime         time.Duration `yaml:"base_ejection_time,omitempty"`
+	MaxEjectionTime          time.Duration `yaml:"max_ejection_time,omitempty"`
+	MaxEjectionPercent       int           `yaml:"max_ejection_percent,omitempty"`
+}
+
+// RetryPolicyConfig controls how failed requests are retried
+type RetryPolicyConfig struct {
+	RetryOn             []int         `yaml:"retry_on,omitempty"`        // Response status codes that trigger a retry
+	PerTryTimeout       time.Duration `yaml:"per_try_timeout,omitempty"` // Deadline of a single attempt, 0 for none
+	BackoffBase         time.Duration `yaml:"backoff_base,omitempty"`
+	BackoffMax          time.Duration `yaml:"backoff_max,omitempty"`
+	BudgetPercent       float64       `yaml:"budget_percent,omitempty"`         // Retries allowed as a percentage of requests
+	MinRetriesPerSecond int           `yaml:"min_retries_per_second,omitempty"` // Retries always allowed regardless of the budget
+}
+
+// StickySessionConfig contains session affinity settings
+type StickySessionConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	CookieName string        `yaml:"cookie_name,omitempty"`
+	Header     string        `yaml:"header,omitempty"`   // Request/response header carrying the affinity for non-browser clients
+	TTL        time.Duration `yaml:"ttl,omitempty"`      // Cookie lifetime, 0 for a session cookie
+	Secret     string        `yaml:"secret,omitempty"`   // HMAC key used to sign the affinity value
+	Fallback   string        `yaml:"fallback,omitempty"` // "rebalance" or "fail" when the pinned backend is unavailable
+}
+
+// HashKeyConfig selects the request attribute used by consistent hashing
+type HashKeyConfig struct {
+	Source string `yaml:"source"`         // "client_ip", "header", "cookie", "path"
+	Name   string `yaml:"name,omitempty"` // Header or cookie name
 }
 
 // RoutingConfig contains routing rules configuration
@@ -52,24 +189,104 @@ type RoutingConfig struct {
 
 // RouteRule defines a routing rule
 type RouteRule struct {
-	Path        string            `yaml:"path"`                   // Path pattern (supports wildcards)
-	PathPrefix  string            `yaml:"path_prefix,omitempty"`  // Alternative to path for prefix matching
-	Host        string            `yaml:"host,omitempty"`         // Host header matching
-	Methods     []string          `yaml:"methods,omitempty"`      // HTTP methods (GET, POST, etc.)
-	Headers     map[string]string `yaml:"headers,omitempty"`      // Header matching
-	Backend     string            `yaml:"backend"`                // Target backend name
-	Priority    int               `yaml:"priority,omitempty"`     // Higher priority rules match first
-	StripPrefix bool              `yaml:"strip_prefix,omitempty"` // Remove prefix before forwarding
+	Path           string            `yaml:"path"`                      // Path pattern: *, ** and {name} parameters, a * within a segment is literal
+	PathPrefix     string            `yaml:"path_prefix,omitempty"`     // Alternative to path for prefix matching
+	PathRegex      string            `yaml:"path_regex,omitempty"`      // Regular expression matching the whole path, named groups are parameters
+	Host           string            `yaml:"host,omitempty"`            // Host header matching
+	Methods        []string          `yaml:"methods,omitempty"`         // HTTP methods (GET, POST, etc.)
+	Headers        map[string]string `yaml:"headers,omitempty"`         // Header matching
+	Backend        string            `yaml:"backend"`                   // Target backend name
+	Priority       int               `yaml:"priority,omitempty"`        // Higher priority rules match first
+	StripPrefix    bool              `yaml:"strip_prefix,omitempty"`    // Remove prefix before forwarding
+	Rewrite        string            `yaml:"rewrite,omitempty"`         // Path forwarded instead, may reference {name} parameters
+	RequestHeaders map[string]string `yaml:"request_headers,omitempty"` // Headers set on the forwarded request, may reference {name} parameters
+	Hedge          HedgeConfig       `yaml:"hedge,omitempty"`           // Request hedging for GET requests
+}
+
+// HedgeConfig contains request hedging settings. A hedge is a second copy of
+// a slow request sent to another target; the first successful response wins.
+type HedgeConfig struct {
+	Enabled             bool          `yaml:"enabled"`
+	Delay               time.Duration `yaml:"delay,omitempty"`                  // Wait before hedging, or until enough samples for percentile
+	Percentile          float64       `yaml:"percentile,omitempty"`             // Hedge after this percentile of observed latency
+	MaxExtraLoadPercent float64       `yaml:"max_extra_load_percent,omitempty"` // Hedges allowed as a percentage of requests
 }
 
 // HealthCheckConfig contains health check settings
 type HealthCheckConfig struct {
 	Enabled            bool          `yaml:"enabled"`
+	Type               string        `yaml:"type,omitempty"` // "http", "https", "h3", "grpc", "tcp", "tls"; defaults to the backend protocol
 	Path               string        `yaml:"path"`
+	GRPCService        string        `yaml:"grpc_service,omitempty"` // Service checked by the grpc probe, empty for the whole server
 	Interval           time.Duration `yaml:"interval"`
 	Timeout            time.Duration `yaml:"timeout"`
 	HealthyThreshold   int           `yaml:"healthy_threshold,omitempty"`
 	UnhealthyThreshold int           `yaml:"unhealthy_threshold,omitempty"`
+	Jitter             time.Duration `yaml:"jitter,omitempty"`       // Random spread of the interval, defaults to a tenth of it
+	HistorySize        int           `yaml:"history_size,omitempty"` // Recent probe results kept per target, defaults to 10, -1 to keep none
+
+	// Request and response assertions of the http, https and h3 probes
+	Method                string             `yaml:"method,omitempty"` // Defaults to GET
+	Host                  string             `yaml:"host,omitempty"`   // Host header, defaults to the target
+	Headers               map[string]string  `yaml:"headers,omitempty"`
+	Expect                HealthExpectConfig `yaml:"expect,omitempty"`
+	DegradedWeightPercent float64            `yaml:"degraded_weight_percent,omitempty"` // Share of its weight a degraded target keeps
+}
+
+// HealthExpectConfig contains the assertions a health check response must
+// pass. Responses matching the degraded assertions keep the target in
+// rotation with a lower weight.
+type HealthExpectConfig struct {
+	Status         []string `yaml:"status,omitempty"`          // Codes or ranges such as "200", "200-299", "2xx"; defaults to 2xx
+	BodyContains   string   `yaml:"body_contains,omitempty"`   // Substring the body must contain
+	BodyRegex      string   `yaml:"body_regex,omitempty"`      // Pattern the body must match
+	JSONPath       string   `yaml:"json_path,omitempty"`       // Dot separated path into a JSON body, such as "status"
+	JSONValues     []string `yaml:"json_values,omitempty"`     // Healthy values at json_path, any value when empty
+	DegradedStatus []string `yaml:"degraded_status,omitempty"` // Status codes or ranges reported as degraded
+	DegradedValues []string `yaml:"degraded_values,omitempty"` // Values at json_path reported as degraded
+}
+
+// DiscoveryConfig contains dynamic service discovery settings. Discovered
+// targets are added to the statically configured targets of their group.
+type DiscoveryConfig struct {
+	FileSD     []FileSDConfig       `yaml:"file_sd,omitempty"`
+	Kubernetes []KubernetesSDConfig `yaml:"kubernetes,omitempty"`
+}
+
+// FileSDConfig contains settings for discovering targets from files in the
+// Prometheus file_sd format
+type FileSDConfig struct {
+	Files           []string      `yaml:"files"`                      // Paths, may contain glob patterns
+	Backend         string        `yaml:"backend,omitempty"`          // Group of entries that name none
+	RefreshInterval time.Duration `yaml:"refresh_interval,omitempty"` // How often the files are read
+}
+
+// KubernetesSDConfig contains settings for discovering the targets of a
+// backend group from the EndpointSlices of a Kubernetes Service
+type KubernetesSDConfig struct {
+	Backend   string `yaml:"backend"`              // Group the endpoints are added to
+	Namespace string `yaml:"namespace,omitempty"`  // Defaults to the namespace the proxy runs in
+	Service   string `yaml:"service"`              // Name of the Service
+	Port      string `yaml:"port,omitempty"`       // Port name, required if the Service has several ports
+	Scheme    string `yaml:"scheme,omitempty"`     // URL scheme of the targets, defaults to http
+	APIServer string `yaml:"api_server,omitempty"` // Defaults to the in-cluster API server
+	TokenFile string `yaml:"token_file,omitempty"` // Service account token
+	CAFile    string `yaml:"ca_file,omitempty"`    // CA bundle of the API server
+}
+
+// EventsConfig contains settings for pushing backend lifecycle events
+type EventsConfig struct {
+	Webhooks []WebhookConfig `yaml:"webhooks,omitempty"`
+}
+
+// WebhookConfig contains settings for posting backend events to a URL
+type WebhookConfig struct {
+	URL          string            `yaml:"url"`
+	Events       []string          `yaml:"events,omitempty"`        // Event types to send, all if empty
+	Headers      map[string]string `yaml:"headers,omitempty"`       // Added to every request
+	Timeout      time.Duration     `yaml:"timeout,omitempty"`       // Per delivery attempt
+	MaxRetries   int               `yaml:"max_retries,omitempty"`   // Retries after a failed delivery
+	RetryBackoff time.Duration     `yaml:"retry_backoff,omitempty"` // Doubled after every retry
 }
 
 // TelemetryConfig contains telemetry configuration
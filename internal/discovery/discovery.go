@@ -0,0 +1,166 @@
+package discovery
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Targets holds the targets discovered for each backend group, keyed by the
+// group name
+type Targets map[string][]config.TargetConfig
+
+// Provider watches an external source of backend targets
+type Provider interface {
+	// Name identifies the provider in logs and when applying its targets
+	Name() string
+
+	// Run watches the source until ctx is done, calling update with the full
+	// set of targets known to the provider every time it changes
+	Run(ctx context.Context, update func(Targets))
+}
+
+// ApplyFunc receives the latest targets of a provider
+type ApplyFunc func(provider string, targets Targets)
+
+// Manager runs the configured discovery providers
+type Manager struct {
+	providers []Provider
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewManager creates the providers configured in cfg
+func NewManager(cfg *config.Config) (*Manager, error) {
+	m := &Manager{}
+
+	for i, fileCfg := range cfg.Discovery.FileSD {
+		m.providers = append(m.providers, NewFileProvider(i, fileCfg))
+	}
+
+	for i, k8sCfg := range cfg.Discovery.Kubernetes {
+		m.providers = append(m.providers, NewKubernetesProvider(i, k8sCfg))
+	}
+
+	for _, backend := range cfg.Backends {
+		if backend.DNS.Enabled {
+			m.providers = append(m.providers, NewDNSProvider(backend.Name, backend.DNS))
+		}
+	}
+
+	return m, nil
+}
+
+// SameProviders reports whether two configurations set up the same
+// discovery providers
+func SameProviders(a, b *config.Config) bool {
+	if !reflect.DeepEqual(a.Discovery, b.Discovery) {
+		return false
+	}
+
+	dns := func(cfg *config.Config) map[string]config.DNSDiscoveryConfig {
+		providers := make(map[string]config.DNSDiscoveryConfig)
+		for _, backend := range cfg.Backends {
+			if backend.DNS.Enabled {
+				providers[backend.Name] = backend.DNS
+			}
+		}
+		return providers
+	}
+	return reflect.DeepEqual(dns(a), dns(b))
+}
+
+// Has reports whether the manager runs the named provider
+func (m *Manager) Has(provider string) bool {
+	for _, p := range m.providers {
+		if p.Name() == provider {
+			return true
+		}
+	}
+	return false
+}
+
+// Start runs every provider in the background. apply is called whenever the
+// targets of a provider change.
+func (m *Manager) Start(apply ApplyFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.cancel != nil || len(m.providers) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+
+	for _, provider := range m.providers {
+		m.wg.Add(1)
+		go func(p Provider) {
+			defer m.wg.Done()
+
+			logrus.WithField("provider", p.Name()).Info("Starting service discovery")
+
+			var last Targets
+			p.Run(ctx, func(targets Targets) {
+				// Providers may report the same targets again on every poll
+				if last != nil && reflect.DeepEqual(last, targets) {
+					return
+				}
+				last = targets
+				apply(p.Name(), targets)
+			})
+
+			logrus.WithField("provider", p.Name()).Info("Stopped service discovery")
+		}(provider)
+	}
+}
+
+// Stop stops every provider and waits for them to return
+func (m *Manager) Stop() {
+	m.mu.Lock()
+	cancel := m.cancel
+	m.cancel = nil
+	m.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		m.wg.Wait()
+	}
+}
+
+// Merge returns a copy of the backend configs with the targets discovered by
+// every provider appended to the statically configured ones
+func Merge(backends []config.BackendConfig, discovered map[string]Targets) []config.BackendConfig {
+	merged := make([]config.BackendConfig, len(backends))
+	copy(merged, backends)
+
+	for i := range merged {
+		group := &merged[i]
+		targets := append([]config.TargetConfig(nil), group.Targets...)
+		for _, provider := range discovered {
+			for _, target := range provider[group.Name] {
+				if !containsTarget(targets, target.URL) {
+					targets = append(targets, target)
+				}
+			}
+		}
+		group.Targets = targets
+	}
+
+	return merged
+}
+
+// containsTarget reports whether targets include one with the given URL
+func containsTarget(targets []config.TargetConfig, url string) bool {
+	for _, target := range targets {
+		if target.URL == url {
+			return true
+		}
+	}
+	return false
+}
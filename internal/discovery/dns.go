@@ -0,0 +1,316 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// minDNSRefresh is the shortest time between two resolutions, however
+	// short the TTL of the records
+	minDNSRefresh = time.Second
+
+	// dnsQueryTimeout bounds a single DNS exchange
+	dnsQueryTimeout = 5 * time.Second
+
+	// dnsUDPSize is the UDP payload size advertised through EDNS(0)
+	dnsUDPSize = 4096
+)
+
+// DNSProvider discovers the targets of a backend group from SRV or A/AAAA
+// records. Records are resolved again once the shortest TTL has expired.
+// Only the SRV records of the lowest priority value are used, as those are
+// the servers clients must try first; the others are backups.
+type DNSProvider struct {
+	backend string
+	cfg     config.DNSDiscoveryConfig
+}
+
+// NewDNSProvider creates a provider for the DNS settings of a backend group
+func NewDNSProvider(backend string, cfg config.DNSDiscoveryConfig) *DNSProvider {
+	return &DNSProvider{
+		backend: backend,
+		cfg:     cfg,
+	}
+}
+
+// Name implements Provider
+func (p *DNSProvider) Name() string {
+	return "dns/" + p.backend
+}
+
+// Run implements Provider
+func (p *DNSProvider) Run(ctx context.Context, update func(Targets)) {
+	wait := p.cfg.RefreshInterval
+	for {
+		targets, ttl, err := p.resolve(ctx)
+		if err != nil {
+			// Keep the last resolved targets until resolution recovers,
+			// trying again as often as the records would be refreshed
+			logrus.WithFields(logrus.Fields{
+				"provider": p.Name(),
+				"name":     p.cfg.Name,
+				"error":    err.Error(),
+			}).Error("DNS resolution failed")
+		} else {
+			update(Targets{p.backend: targets})
+			wait = ttl
+		}
+		if wait < minDNSRefresh {
+			wait = minDNSRefresh
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// resolve looks up the configured records, returning the targets they point
+// at and the shortest TTL among them
+func (p *DNSProvider) resolve(ctx context.Context) ([]config.TargetConfig, time.Duration, error) {
+	server := p.cfg.Resolver
+	if server == "" {
+		var err error
+		if server, err = systemResolver(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var (
+		targets []config.TargetConfig
+		ttl     = p.cfg.RefreshInterval
+	)
+	observe := func(h dnsmessage.ResourceHeader) {
+		if recordTTL := time.Duration(h.TTL) * time.Second; recordTTL < ttl {
+			ttl = recordTTL
+		}
+	}
+
+	switch p.cfg.Type {
+	case "SRV":
+		records, err := query(ctx, server, p.cfg.Name, dnsmessage.TypeSRV)
+		if err != nil {
+			return nil, 0, err
+		}
+		priority := -1
+		for _, record := range records {
+			srv, ok := record.Body.(*dnsmessage.SRVResource)
+			if !ok || srv.Target.String() == "." {
+				continue
+			}
+			if priority < 0 || int(srv.Priority) < priority {
+				priority = int(srv.Priority)
+			}
+		}
+		for _, record := range records {
+			srv, ok := record.Body.(*dnsmessage.SRVResource)
+			if !ok || int(srv.Priority) != priority {
+				continue
+			}
+			host := strings.TrimSuffix(srv.Target.String(), ".")
+			if host == "" {
+				continue // "." means the service is not available
+			}
+			observe(record.Header)
+			targets = append(targets, config.TargetConfig{
+				URL:    p.cfg.Scheme + "://" + net.JoinHostPort(host, strconv.Itoa(int(srv.Port))),
+				Weight: srvWeight(srv.Weight),
+			})
+		}
+
+	default:
+		for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+			records, err := query(ctx, server, p.cfg.Name, qtype)
+			if err != nil && qtype == dnsmessage.TypeAAAA {
+				// Many names have no IPv6 addresses and some servers fail
+				// the question; the IPv4 addresses are still good
+				logrus.WithFields(logrus.Fields{
+					"provider": p.Name(),
+					"name":     p.cfg.Name,
+					"error":    err.Error(),
+				}).Warn("DNS AAAA lookup failed, using the A records only")
+				continue
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+			for _, record := range records {
+				var ip net.IP
+				switch body := record.Body.(type) {
+				case *dnsmessage.AResource:
+					ip = body.A[:]
+				case *dnsmessage.AAAAResource:
+					ip = body.AAAA[:]
+				default:
+					continue
+				}
+				observe(record.Header)
+				targets = append(targets, config.TargetConfig{
+					URL: p.cfg.Scheme + "://" + net.JoinHostPort(ip.String(), strconv.Itoa(p.cfg.Port)),
+				})
+			}
+		}
+	}
+
+	// Keep the order stable so unchanged answers are recognised
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].URL < targets[j].URL
+	})
+
+	return targets, ttl, nil
+}
+
+// srvWeight returns the target weight of an SRV record. A weight of 0 would
+// give the target the group's default weight, so it becomes the lowest weight
+// instead.
+func srvWeight(weight uint16) int {
+	if weight == 0 {
+		return 1
+	}
+	return int(weight)
+}
+
+// query sends a single question to a DNS server and returns the answers of
+// the requested type. Truncated UDP responses are retried over TCP.
+func query(ctx context.Context, server, name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns name %s: %w", name, err)
+	}
+
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(dnsUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+
+	id := uint16(rand.Uint32())
+	request, err := (&dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions:   []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+		Additionals: []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}},
+	}).Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build dns query: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+	defer cancel()
+
+	response, err := exchange(ctx, "udp", server, request)
+	if err != nil {
+		return nil, err
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		return nil, fmt.Errorf("invalid dns response from %s: %w", server, err)
+	}
+	if msg.Truncated {
+		if response, err = exchange(ctx, "tcp", server, request); err != nil {
+			return nil, err
+		}
+		if err := msg.Unpack(response); err != nil {
+			return nil, fmt.Errorf("invalid dns response from %s: %w", server, err)
+		}
+	}
+
+	if msg.ID != id {
+		return nil, fmt.Errorf("dns response id mismatch from %s", server)
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("dns query for %s %s failed: %s", name, qtype, msg.RCode)
+	}
+
+	answers := make([]dnsmessage.Resource, 0, len(msg.Answers))
+	for _, answer := range msg.Answers {
+		if answer.Header.Type == qtype {
+			answers = append(answers, answer)
+		}
+	}
+	return answers, nil
+}
+
+// exchange sends a packed DNS message to a server over UDP or TCP and
+// returns the packed response
+func exchange(ctx context.Context, network, server string, request []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach dns server %s: %w", server, err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(request); err != nil {
+			return nil, fmt.Errorf("dns query to %s failed: %w", server, err)
+		}
+		response := make([]byte, dnsUDPSize)
+		n, err := conn.Read(response)
+		if err != nil {
+			return nil, fmt.Errorf("dns query to %s failed: %w", server, err)
+		}
+		return response[:n], nil
+	}
+
+	// DNS over TCP prefixes every message with its length
+	framed := make([]byte, 2+len(request))
+	binary.BigEndian.PutUint16(framed, uint16(len(request)))
+	copy(framed[2:], request)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, fmt.Errorf("dns query to %s failed: %w", server, err)
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, fmt.Errorf("dns query to %s failed: %w", server, err)
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, fmt.Errorf("dns query to %s failed: %w", server, err)
+	}
+	return response, nil
+}
+
+// systemResolver returns the first name server listed in /etc/resolv.conf
+func systemResolver() (string, error) {
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", fmt.Errorf("no dns resolver configured: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", fmt.Errorf("no nameserver found in /etc/resolv.conf")
+}
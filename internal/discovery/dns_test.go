@@ -0,0 +1,264 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testDNSServer is a stand-in DNS server answering every question from a
+// fixed set of records
+type testDNSServer struct {
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	rcode   dnsmessage.RCode
+	failing dnsmessage.Type // Type of the questions answered with a server failure
+	records []dnsmessage.Resource
+}
+
+// newTestDNSServer starts a DNS server on a local UDP port
+func newTestDNSServer(t *testing.T) *testDNSServer {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := &testDNSServer{conn: conn}
+	t.Cleanup(func() { conn.Close() })
+
+	go s.serve()
+	return s
+}
+
+// Addr returns the host:port the server listens on
+func (s *testDNSServer) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+// set replaces the answer of the server
+func (s *testDNSServer) set(rcode dnsmessage.RCode, records ...dnsmessage.Resource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rcode = rcode
+	s.records = records
+}
+
+// fail makes the server fail the questions of a record type
+func (s *testDNSServer) fail(qtype dnsmessage.Type) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failing = qtype
+}
+
+func (s *testDNSServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		var request dnsmessage.Message
+		if err := request.Unpack(buf[:n]); err != nil || len(request.Questions) != 1 {
+			continue
+		}
+		question := request.Questions[0]
+
+		s.mu.Lock()
+		response := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: request.ID, Response: true, RCode: s.rcode},
+			Questions: request.Questions,
+		}
+		if question.Type == s.failing {
+			response.RCode = dnsmessage.RCodeServerFailure
+		}
+		for _, record := range s.records {
+			if record.Header.Type == question.Type && response.RCode == dnsmessage.RCodeSuccess {
+				record.Header.Name = question.Name
+				response.Answers = append(response.Answers, record)
+			}
+		}
+		s.mu.Unlock()
+
+		packed, err := response.Pack()
+		if err != nil {
+			continue
+		}
+		s.conn.WriteTo(packed, addr)
+	}
+}
+
+func aRecord(ip string, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.AResource{A: netip.MustParseAddr(ip).As4()},
+	}
+}
+
+func aaaaRecord(ip string, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.AAAAResource{AAAA: netip.MustParseAddr(ip).As16()},
+	}
+}
+
+func srvRecord(target string, port, priority, weight uint16, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body: &dnsmessage.SRVResource{
+			Target:   dnsmessage.MustNewName(target),
+			Port:     port,
+			Priority: priority,
+			Weight:   weight,
+		},
+	}
+}
+
+func TestDNSProviderResolve(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.DNSDiscoveryConfig
+		failing dnsmessage.Type
+		records []dnsmessage.Resource
+		want    []config.TargetConfig
+		wantTTL time.Duration
+	}{
+		{
+			name:    "A and AAAA",
+			cfg:     config.DNSDiscoveryConfig{Type: "A", Port: 8080},
+			records: []dnsmessage.Resource{aRecord("10.0.0.2", 30), aRecord("10.0.0.1", 60), aaaaRecord("fd00::1", 20)},
+			want: []config.TargetConfig{
+				{URL: "http://10.0.0.1:8080"},
+				{URL: "http://10.0.0.2:8080"},
+				{URL: "http://[fd00::1]:8080"},
+			},
+			wantTTL: 20 * time.Second,
+		},
+		{
+			name:    "AAAA lookup failing",
+			cfg:     config.DNSDiscoveryConfig{Type: "A", Port: 8080},
+			failing: dnsmessage.TypeAAAA,
+			records: []dnsmessage.Resource{aRecord("10.0.0.1", 30), aaaaRecord("fd00::1", 20)},
+			want:    []config.TargetConfig{{URL: "http://10.0.0.1:8080"}},
+			wantTTL: 30 * time.Second,
+		},
+		{
+			name: "SRV",
+			cfg:  config.DNSDiscoveryConfig{Type: "SRV"},
+			records: []dnsmessage.Resource{
+				srvRecord("b.example.com.", 9000, 10, 0, 30),
+				srvRecord("a.example.com.", 9000, 10, 5, 30),
+				srvRecord(".", 0, 0, 0, 5),
+			},
+			want: []config.TargetConfig{
+				{URL: "http://a.example.com:9000", Weight: 5},
+				{URL: "http://b.example.com:9000", Weight: 1},
+			},
+			wantTTL: 30 * time.Second,
+		},
+		{
+			name: "SRV priorities",
+			cfg:  config.DNSDiscoveryConfig{Type: "SRV"},
+			records: []dnsmessage.Resource{
+				srvRecord("backup.example.com.", 9000, 20, 5, 10),
+				srvRecord("b.example.com.", 9000, 10, 1, 30),
+				srvRecord("a.example.com.", 9000, 10, 3, 30),
+			},
+			want: []config.TargetConfig{
+				{URL: "http://a.example.com:9000", Weight: 3},
+				{URL: "http://b.example.com:9000", Weight: 1},
+			},
+			wantTTL: 30 * time.Second,
+		},
+		{
+			name:    "TTL above the refresh interval",
+			cfg:     config.DNSDiscoveryConfig{Type: "A", Port: 80},
+			records: []dnsmessage.Resource{aRecord("10.0.0.1", 3600)},
+			want:    []config.TargetConfig{{URL: "http://10.0.0.1:80"}},
+			wantTTL: time.Minute,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestDNSServer(t)
+			server.set(dnsmessage.RCodeSuccess, tt.records...)
+			server.fail(tt.failing)
+
+			tt.cfg.Name = "api.example.com"
+			tt.cfg.Scheme = "http"
+			tt.cfg.Resolver = server.Addr()
+			tt.cfg.RefreshInterval = time.Minute
+
+			targets, ttl, err := NewDNSProvider("api", tt.cfg).resolve(context.Background())
+			if err != nil {
+				t.Fatalf("resolve: %v", err)
+			}
+			if !reflect.DeepEqual(targets, tt.want) {
+				t.Errorf("targets = %+v, want %+v", targets, tt.want)
+			}
+			if ttl != tt.wantTTL {
+				t.Errorf("ttl = %v, want %v", ttl, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestDNSProviderRefresh(t *testing.T) {
+	server := newTestDNSServer(t)
+	server.set(dnsmessage.RCodeSuccess, aRecord("10.0.0.1", 1))
+
+	p := NewDNSProvider("api", config.DNSDiscoveryConfig{
+		Name:            "api.example.com",
+		Type:            "A",
+		Port:            80,
+		Scheme:          "http",
+		Resolver:        server.Addr(),
+		RefreshInterval: time.Hour,
+	})
+
+	updates := make(chan Targets, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx, func(targets Targets) { updates <- targets })
+
+	next := func() Targets {
+		t.Helper()
+		select {
+		case targets := <-updates:
+			return targets
+		case <-time.After(3 * time.Second):
+			t.Fatalf("no update within the record TTL")
+			return nil
+		}
+	}
+
+	if got := next(); got["api"][0].URL != "http://10.0.0.1:80" {
+		t.Fatalf("targets = %+v", got)
+	}
+
+	// A missing name keeps the last resolved targets
+	server.set(dnsmessage.RCodeNameError)
+	select {
+	case targets := <-updates:
+		t.Fatalf("targets changed to %+v on NXDOMAIN", targets)
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	// The records are resolved again once their TTL expires
+	server.set(dnsmessage.RCodeSuccess, aRecord("10.0.0.2", 1))
+	if got := next(); len(got["api"]) != 1 || got["api"][0].URL != "http://10.0.0.2:80" {
+		t.Fatalf("targets = %+v, want the new record", got)
+	}
+}
@@ -0,0 +1,144 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// fileTargetGroup is an entry of a target file. The format follows the
+// Prometheus file_sd format with an extra backend field naming the group the
+// targets belong to:
+//
+//   - backend: api-service
+//     targets: ["http://10.0.0.1:8080", {url: "http://10.0.0.2:8080", weight: 2}]
+//     labels: {version: v2}
+type fileTargetGroup struct {
+	Backend string                `yaml:"backend"`
+	Targets []config.TargetConfig `yaml:"targets"`
+	Labels  map[string]string     `yaml:"labels"`
+}
+
+// FileProvider discovers targets from JSON or YAML files that are polled for
+// changes
+type FileProvider struct {
+	name string
+	cfg  config.FileSDConfig
+}
+
+// NewFileProvider creates a provider for the i-th file_sd config
+func NewFileProvider(i int, cfg config.FileSDConfig) *FileProvider {
+	return &FileProvider{
+		name: fmt.Sprintf("file_sd/%d", i),
+		cfg:  cfg,
+	}
+}
+
+// Name implements Provider
+func (p *FileProvider) Name() string {
+	return p.name
+}
+
+// Run implements Provider
+func (p *FileProvider) Run(ctx context.Context, update func(Targets)) {
+	ticker := time.NewTicker(p.cfg.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		targets, err := p.load()
+		if err != nil {
+			// Keep the last good targets until the files are fixed
+			logrus.WithFields(logrus.Fields{
+				"provider": p.name,
+				"error":    err.Error(),
+			}).Error("Failed to read target files")
+		} else {
+			update(targets)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// load reads every file matching the configured patterns
+func (p *FileProvider) load() (Targets, error) {
+	var paths []string
+	for _, pattern := range p.cfg.Files {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file pattern %s: %w", pattern, err)
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+
+	targets := make(Targets)
+	for _, path := range paths {
+		if err := p.loadFile(path, targets); err != nil {
+			return nil, err
+		}
+	}
+
+	return targets, nil
+}
+
+// loadFile adds the targets of a single file to targets
+func (p *FileProvider) loadFile(path string, targets Targets) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	// YAML is a superset of JSON, so both formats are read the same way
+	var groups []fileTargetGroup
+	if err := yaml.Unmarshal(data, &groups); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	for i, group := range groups {
+		backend := group.Backend
+		if backend == "" {
+			backend = p.cfg.Backend
+		}
+		if backend == "" {
+			return fmt.Errorf("%s: entry %d has no backend", path, i)
+		}
+
+		for _, target := range group.Targets {
+			if target.URL == "" {
+				return fmt.Errorf("%s: entry %d has a target without url", path, i)
+			}
+			target.Labels = mergeLabels(group.Labels, target.Labels)
+			targets[backend] = append(targets[backend], target)
+		}
+	}
+
+	return nil
+}
+
+// mergeLabels returns the group labels overridden by the target labels
+func mergeLabels(group, target map[string]string) map[string]string {
+	if len(group) == 0 {
+		return target
+	}
+
+	labels := make(map[string]string, len(group)+len(target))
+	for k, v := range group {
+		labels[k] = v
+	}
+	for k, v := range target {
+		labels[k] = v
+	}
+	return labels
+}
@@ -0,0 +1,141 @@
+package discovery
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+)
+
+// writeFile replaces a target file in dir the way deployment tooling does,
+// so it is never read half written
+func writeFile(t *testing.T, dir, name, data string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path+".tmp", []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFileProviderFormats(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.json", `[{"backend": "api", "targets": ["http://10.0.0.1:80", {"url": "http://10.0.0.2:80", "weight": 2}], "labels": {"version": "v1"}}]`)
+	writeFile(t, dir, "b.yaml", `
+- targets:
+    - url: http://10.0.0.3:80
+      labels: {version: v2, zone: a}
+  labels: {version: v1}
+`)
+
+	p := NewFileProvider(0, config.FileSDConfig{Files: []string{filepath.Join(dir, "*")}, Backend: "web"})
+	targets, err := p.load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	want := Targets{
+		"api": {
+			{URL: "http://10.0.0.1:80", Labels: map[string]string{"version": "v1"}},
+			{URL: "http://10.0.0.2:80", Weight: 2, Labels: map[string]string{"version": "v1"}},
+		},
+		"web": {
+			{URL: "http://10.0.0.3:80", Labels: map[string]string{"version": "v2", "zone": "a"}},
+		},
+	}
+	if !reflect.DeepEqual(targets, want) {
+		t.Errorf("targets = %+v, want %+v", targets, want)
+	}
+}
+
+func TestFileProviderInvalidFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{name: "syntax", data: "[{", want: "failed to parse"},
+		{name: "no backend", data: `[{"targets": ["http://a:80"]}]`, want: "has no backend"},
+		{name: "no url", data: `[{"backend": "api", "targets": [{"weight": 1}]}]`, want: "target without url"},
+	}
+
+	for _, tt := range tests {
+		path := writeFile(t, t.TempDir(), "targets.json", tt.data)
+		p := NewFileProvider(0, config.FileSDConfig{Files: []string{path}})
+		if _, err := p.load(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestFileProviderWatchesChanges(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "targets.json", `[{"backend": "api", "targets": ["http://a:80"]}]`)
+	p := NewFileProvider(0, config.FileSDConfig{Files: []string{path}, RefreshInterval: 10 * time.Millisecond})
+
+	updates := make(chan Targets, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx, func(targets Targets) { updates <- targets })
+
+	next := func(want string) {
+		t.Helper()
+		deadline := time.After(2 * time.Second)
+		for {
+			select {
+			case targets := <-updates:
+				if len(targets["api"]) == 1 && targets["api"][0].URL == want {
+					return
+				}
+			case <-deadline:
+				t.Fatalf("targets never changed to %s", want)
+			}
+		}
+	}
+	next("http://a:80")
+
+	writeFile(t, filepath.Dir(path), "targets.json", `[{"backend": "api", "targets": ["http://b:80"]}]`)
+	next("http://b:80")
+
+	// A broken file keeps the last good targets
+	writeFile(t, filepath.Dir(path), "targets.json", `[{`)
+	time.Sleep(50 * time.Millisecond)
+	for len(updates) > 0 {
+		if targets := <-updates; len(targets["api"]) != 1 || targets["api"][0].URL != "http://b:80" {
+			t.Fatalf("targets changed to %+v after a parse error", targets)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	backends := []config.BackendConfig{
+		{Name: "api", Targets: []config.TargetConfig{{URL: "http://static:80"}}},
+		{Name: "web"},
+	}
+	discovered := map[string]Targets{
+		"file_sd/0": {"api": {{URL: "http://static:80", Weight: 5}, {URL: "http://a:80"}}},
+		"file_sd/1": {"web": {{URL: "http://b:80"}}, "unknown": {{URL: "http://c:80"}}},
+	}
+
+	merged := Merge(backends, discovered)
+	want := [][]config.TargetConfig{
+		{{URL: "http://static:80"}, {URL: "http://a:80"}},
+		{{URL: "http://b:80"}},
+	}
+	for i, backend := range merged {
+		if !reflect.DeepEqual(backend.Targets, want[i]) {
+			t.Errorf("%s targets = %+v, want %+v", backend.Name, backend.Targets, want[i])
+		}
+	}
+	if len(backends[0].Targets) != 1 || backends[1].Targets != nil {
+		t.Errorf("Merge modified the static configuration")
+	}
+}
@@ -0,0 +1,234 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+	"github.com/sirupsen/logrus"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// namespaceFile holds the namespace of the pod the proxy runs in
+const namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// KubernetesProvider discovers the targets of a backend group from the
+// EndpointSlices of a Kubernetes Service. An informer lists the slices once
+// and then watches them for changes through the API server.
+type KubernetesProvider struct {
+	name   string
+	cfg    config.KubernetesSDConfig
+	client kubernetes.Interface // nil until connected to the API server
+}
+
+// NewKubernetesProvider creates a provider for the i-th kubernetes config
+func NewKubernetesProvider(i int, cfg config.KubernetesSDConfig) *KubernetesProvider {
+	return &KubernetesProvider{
+		name: fmt.Sprintf("kubernetes/%d", i),
+		cfg:  cfg,
+	}
+}
+
+// Name implements Provider
+func (p *KubernetesProvider) Name() string {
+	return p.name
+}
+
+// Run implements Provider
+func (p *KubernetesProvider) Run(ctx context.Context, update func(Targets)) {
+	if p.client == nil {
+		client, err := p.connect()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"provider": p.name,
+				"service":  p.cfg.Service,
+				"error":    err.Error(),
+			}).Error("Failed to create Kubernetes client")
+			return
+		}
+		p.client = client
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(p.client, 0,
+		informers.WithNamespace(p.namespace()),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = discoveryv1.LabelServiceName + "=" + p.cfg.Service
+		}),
+	)
+	slices := factory.Discovery().V1().EndpointSlices()
+
+	// Changes are coalesced; the targets are always computed from the
+	// informer's current view of the slices
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	slices.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { notify() },
+		UpdateFunc: func(interface{}, interface{}) { notify() },
+		DeleteFunc: func(interface{}) { notify() },
+	})
+
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+
+	// The informer retries failed lists and watches itself; the last known
+	// targets stay in place until the API server is reachable again
+	if !cache.WaitForCacheSync(ctx.Done(), slices.Informer().HasSynced) {
+		return
+	}
+
+	for {
+		list, err := slices.Lister().List(labels.Everything())
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"provider": p.name,
+				"service":  p.cfg.Service,
+				"error":    err.Error(),
+			}).Error("Failed to list EndpointSlices")
+		} else {
+			update(Targets{p.cfg.Backend: p.targets(list)})
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// targets converts the endpoints of the slices into targets. Ready endpoints
+// receive traffic, terminating endpoints that still serve are drained and
+// every other endpoint is left out.
+func (p *KubernetesProvider) targets(slices []*discoveryv1.EndpointSlice) []config.TargetConfig {
+	byURL := make(map[string]config.TargetConfig)
+
+	for _, slice := range slices {
+		port, ok := p.port(slice)
+		if !ok {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			conditions := endpoint.Conditions
+			ready := conditions.Ready == nil || *conditions.Ready
+			serving := ready
+			if conditions.Serving != nil {
+				serving = *conditions.Serving
+			}
+			terminating := conditions.Terminating != nil && *conditions.Terminating
+
+			var drain bool
+			switch {
+			case ready && !terminating:
+			case terminating && serving:
+				drain = true
+			default:
+				continue
+			}
+
+			var zone string
+			if endpoint.Zone != nil {
+				zone = *endpoint.Zone
+			}
+
+			var labels map[string]string
+			if endpoint.NodeName != nil {
+				labels = map[string]string{"node": *endpoint.NodeName}
+			}
+
+			for _, address := range endpoint.Addresses {
+				target := config.TargetConfig{
+					URL:    p.cfg.Scheme + "://" + net.JoinHostPort(address, strconv.Itoa(int(port))),
+					Zone:   zone,
+					Labels: labels,
+					Drain:  drain,
+				}
+
+				// An endpoint moving between slices may briefly be listed
+				// twice; prefer the copy that takes traffic
+				if existing, ok := byURL[target.URL]; ok && !existing.Drain {
+					continue
+				}
+				byURL[target.URL] = target
+			}
+		}
+	}
+
+	targets := make([]config.TargetConfig, 0, len(byURL))
+	for _, target := range byURL {
+		targets = append(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].URL < targets[j].URL
+	})
+	return targets
+}
+
+// port returns the number of the configured port of a slice, or of its only
+// port when no name is configured
+func (p *KubernetesProvider) port(slice *discoveryv1.EndpointSlice) (int32, bool) {
+	for _, port := range slice.Ports {
+		if port.Port == nil {
+			continue
+		}
+		name := ""
+		if port.Name != nil {
+			name = *port.Name
+		}
+		if p.cfg.Port == "" || name == p.cfg.Port {
+			return *port.Port, true
+		}
+	}
+	return 0, false
+}
+
+// namespace returns the namespace of the Service
+func (p *KubernetesProvider) namespace() string {
+	if p.cfg.Namespace != "" {
+		return p.cfg.Namespace
+	}
+	if data, err := os.ReadFile(namespaceFile); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	return "default"
+}
+
+// connect creates a client for the configured API server, or the API server
+// of the cluster the proxy runs in
+func (p *KubernetesProvider) connect() (kubernetes.Interface, error) {
+	server := p.cfg.APIServer
+	if server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("no api_server configured and not running in a cluster")
+		}
+		server = "https://" + net.JoinHostPort(host, port)
+	}
+
+	// The token file is read again as it is rotated
+	restConfig := &rest.Config{Host: server}
+	if _, err := os.Stat(p.cfg.TokenFile); err == nil {
+		restConfig.BearerTokenFile = p.cfg.TokenFile
+	}
+	if _, err := os.Stat(p.cfg.CAFile); err == nil {
+		restConfig.TLSClientConfig.CAFile = p.cfg.CAFile
+	}
+
+	return kubernetes.NewForConfig(restConfig)
+}
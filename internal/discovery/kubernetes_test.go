@@ -0,0 +1,171 @@
+package discovery
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// testSlice returns an EndpointSlice of the api Service in the prod namespace
+func testSlice(name string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "prod",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "api"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   endpoints,
+		Ports: []discoveryv1.EndpointPort{
+			{Name: ptr("metrics"), Port: ptr(int32(9090))},
+			{Name: ptr("http"), Port: ptr(int32(8080))},
+		},
+	}
+}
+
+// testEndpoint returns an endpoint with the given conditions
+func testEndpoint(address string, ready, serving, terminating bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Addresses: []string{address},
+		Conditions: discoveryv1.EndpointConditions{
+			Ready:       &ready,
+			Serving:     &serving,
+			Terminating: &terminating,
+		},
+	}
+}
+
+func testKubernetesProvider() *KubernetesProvider {
+	return NewKubernetesProvider(0, config.KubernetesSDConfig{
+		Backend:   "api",
+		Namespace: "prod",
+		Service:   "api",
+		Port:      "http",
+		Scheme:    "http",
+	})
+}
+
+func TestKubernetesTargets(t *testing.T) {
+	zoned := testEndpoint("10.0.0.5", true, true, false)
+	zoned.Zone = ptr("us-east-1a")
+	zoned.NodeName = ptr("node-1")
+	zoned.Hints = &discoveryv1.EndpointHints{ForZones: []discoveryv1.ForZone{{Name: "us-east-1b"}}}
+
+	tests := []struct {
+		name   string
+		slices []*discoveryv1.EndpointSlice
+		want   []config.TargetConfig
+	}{
+		{
+			name: "conditions",
+			slices: []*discoveryv1.EndpointSlice{testSlice("api-1",
+				testEndpoint("10.0.0.1", true, true, false),
+				testEndpoint("10.0.0.2", false, false, false),
+				testEndpoint("10.0.0.3", false, true, true),
+				testEndpoint("10.0.0.4", false, false, true),
+			)},
+			want: []config.TargetConfig{
+				{URL: "http://10.0.0.1:8080"},
+				{URL: "http://10.0.0.3:8080", Drain: true},
+			},
+		},
+		{
+			name:   "zone and node",
+			slices: []*discoveryv1.EndpointSlice{testSlice("api-1", zoned)},
+			want: []config.TargetConfig{
+				{URL: "http://10.0.0.5:8080", Zone: "us-east-1a", Labels: map[string]string{"node": "node-1"}},
+			},
+		},
+		{
+			name: "endpoint listed in two slices",
+			slices: []*discoveryv1.EndpointSlice{
+				testSlice("api-1", testEndpoint("10.0.0.1", false, true, true)),
+				testSlice("api-2", testEndpoint("10.0.0.1", true, true, false)),
+			},
+			want: []config.TargetConfig{{URL: "http://10.0.0.1:8080"}},
+		},
+		{
+			name: "slice without the port",
+			slices: []*discoveryv1.EndpointSlice{{
+				Endpoints: []discoveryv1.Endpoint{testEndpoint("10.0.0.1", true, true, false)},
+				Ports:     []discoveryv1.EndpointPort{{Name: ptr("grpc"), Port: ptr(int32(9000))}},
+			}},
+			want: []config.TargetConfig{},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := testKubernetesProvider().targets(tt.slices); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: targets = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestKubernetesProviderWatchesSlices(t *testing.T) {
+	client := fake.NewClientset(testSlice("api-1", testEndpoint("10.0.0.1", true, true, false)))
+	p := testKubernetesProvider()
+	p.client = client
+
+	updates := make(chan Targets, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx, func(targets Targets) { updates <- targets })
+
+	// expect waits for the targets to become want
+	expect := func(want ...config.TargetConfig) {
+		t.Helper()
+		if want == nil {
+			want = []config.TargetConfig{}
+		}
+		deadline := time.After(5 * time.Second)
+		for {
+			select {
+			case targets := <-updates:
+				if reflect.DeepEqual(targets["api"], want) {
+					return
+				}
+			case <-deadline:
+				t.Fatalf("targets never became %+v", want)
+			}
+		}
+	}
+	slices := client.DiscoveryV1().EndpointSlices("prod")
+
+	expect(config.TargetConfig{URL: "http://10.0.0.1:8080"})
+
+	// Added slice
+	if _, err := slices.Create(ctx, testSlice("api-2", testEndpoint("10.0.0.2", true, true, false)), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	expect(config.TargetConfig{URL: "http://10.0.0.1:8080"}, config.TargetConfig{URL: "http://10.0.0.2:8080"})
+
+	// Updated slice with a terminating endpoint that still serves
+	if _, err := slices.Update(ctx, testSlice("api-1", testEndpoint("10.0.0.1", false, true, true)), metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	expect(config.TargetConfig{URL: "http://10.0.0.1:8080", Drain: true}, config.TargetConfig{URL: "http://10.0.0.2:8080"})
+
+	// Updated slice whose endpoint stopped serving
+	if _, err := slices.Update(ctx, testSlice("api-1", testEndpoint("10.0.0.1", false, false, true)), metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	expect(config.TargetConfig{URL: "http://10.0.0.2:8080"})
+
+	// Deleted slices
+	for _, name := range []string{"api-1", "api-2"} {
+		if err := slices.Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+	}
+	expect()
+}
@@ -1,34 +1,25 @@
 package middleware
 
 import (
-    "net/http"
-    "strings"
+	"crypto/subtle"
+	"net/http"
+	"strings"
 )
 
-// AuthMiddleware is a middleware that checks for authentication tokens in the request headers.
-func AuthMiddleware(next http.Handler) http.Handler {
-    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        // Check for the Authorization header
-        authHeader := r.Header.Get("Authorization")
-        if authHeader == "" {
-            http.Error(w, "Unauthorized", http.StatusUnauthorized)
-            return
-        }
+// AuthMiddleware only lets through requests carrying the given bearer token
+// in their Authorization header. Every request is refused when the token is
+// empty.
+func AuthMiddleware(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Check for the Authorization header
+		provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
 
-        // Validate the token (this is a placeholder for actual validation logic)
-        token := strings.TrimPrefix(authHeader, "Bearer ")
-        if !isValidToken(token) {
-            http.Error(w, "Unauthorized", http.StatusUnauthorized)
-            return
-        }
-
-        // If the token is valid, proceed to the next handler
-        next.ServeHTTP(w, r)
-    })
+		// If the token is valid, proceed to the next handler
+		next.ServeHTTP(w, r)
+	})
 }
-
-// isValidToken is a placeholder function for token validation logic.
-func isValidToken(token string) bool {
-    // Implement actual token validation logic here
-    return token == "valid-token" // Example: replace with real validation
-}
\ No newline at end of file
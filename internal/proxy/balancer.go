@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+)
+
+// Balancer selects a backend out of the healthy backends of a group
+type Balancer interface {
+	// Next returns the backend that should serve the request, or nil if none can
+	Next(r *http.Request, backends []*Backend) *Backend
+}
+
+// groupBalancer is implemented by balancers that keep state over all
+// backends of a group rather than only the candidates of each request
+type groupBalancer interface {
+	// setBackends is called whenever the backends of the group change
+	setBackends(backends []*Backend)
+}
+
+// newBalancer creates the balancing strategy configured for a backend group
+func newBalancer(cfg config.BackendConfig) Balancer {
+	switch cfg.LoadBalancer {
+	case "least_connections":
+		return &leastConnectionsBalancer{}
+	case "weighted":
+		return &weightedBalancer{}
+	case "consistent_hash":
+		return &consistentHashBalancer{key: cfg.HashKey}
+	case "p2c_ewma":
+		return &p2cEWMABalancer{}
+	default:
+		return &roundRobinBalancer{}
+	}
+}
+
+// sameBalancing reports whether two configs of a group select backends the
+// same way, in which case an existing balancer can be kept
+func sameBalancing(a, b config.BackendConfig) bool {
+	return a.LoadBalancer == b.LoadBalancer && a.HashKey == b.HashKey && a.EWMADecay == b.EWMADecay
+}
+
+// roundRobinBalancer cycles through the backends in order
+type roundRobinBalancer struct {
+	next uint32
+}
+
+// Next implements Balancer
+func (rr *roundRobinBalancer) Next(r *http.Request, backends []*Backend) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	// Backends in slow start pass on part of their turns to the next one
+	next := atomic.AddUint32(&rr.next, 1) - 1
+	for i := 0; i < len(backends); i++ {
+		backend := backends[(int(next)+i)%len(backends)]
+		if admit(backend) {
+			return backend
+		}
+	}
+	return backends[int(next)%len(backends)]
+}
+
+// leastConnectionsBalancer picks the backend with the fewest active
+// connections. Connections to backends in slow start count for more.
+type leastConnectionsBalancer struct{}
+
+// Next implements Balancer
+func (lc *leastConnectionsBalancer) Next(r *http.Request, backends []*Backend) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	var selected *Backend
+	minLoad := -1.0
+
+	for _, backend := range backends {
+		load := float64(backend.GetConnections()+1) / backend.weightFactor()
+		if minLoad < 0 || load < minLoad {
+			minLoad = load
+			selected = backend
+		}
+	}
+
+	return selected
+}
+
+// weightedBalancer picks a backend at random, proportionally to its weight
+type weightedBalancer struct {
+	fallback roundRobinBalancer
+}
+
+// Next implements Balancer
+func (wb *weightedBalancer) Next(r *http.Request, backends []*Backend) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	// Calculate total weight
+	totalWeight := 0.0
+	for _, backend := range backends {
+		totalWeight += backend.EffectiveWeight()
+	}
+
+	if totalWeight == 0 {
+		return wb.fallback.Next(r, backends) // Fallback to round-robin
+	}
+
+	// Generate random number
+	random := rand.Float64() * totalWeight
+
+	// Select backend based on weight
+	currentWeight := 0.0
+	for _, backend := range backends {
+		currentWeight += backend.EffectiveWeight()
+		if random < currentWeight {
+			return backend
+		}
+	}
+
+	return backends[0] // Fallback
+}
+
+// defaultEWMADecay is the time constant of the latency EWMA when a backend
+// has none configured
+const defaultEWMADecay = 10 * time.Second
+
+// p2cEWMABalancer samples two backends at random and picks the one with the
+// lower load score, where the score is the backend's peak EWMA latency
+// multiplied by its in-flight requests. Slow or busy backends lose most
+// comparisons while still being probed occasionally.
+type p2cEWMABalancer struct{}
+
+// Next implements Balancer
+func (p *p2cEWMABalancer) Next(r *http.Request, backends []*Backend) *Backend {
+	switch len(backends) {
+	case 0:
+		return nil
+	case 1:
+		return backends[0]
+	}
+
+	i := rand.Intn(len(backends))
+	j := rand.Intn(len(backends) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := backends[i], backends[j]
+	latencyA, latencyB := float64(a.LatencyEWMA()), float64(b.LatencyEWMA())
+
+	// Backends without latency samples yet, new or just recovered, are
+	// scored as if they were as fast as the others instead of winning
+	// every comparison until their first response
+	if latencyA == 0 || latencyB == 0 {
+		seed := meanLatency(backends)
+		if latencyA == 0 {
+			latencyA = seed
+		}
+		if latencyB == 0 {
+			latencyB = seed
+		}
+	}
+
+	if p2cScore(b, latencyB) < p2cScore(a, latencyA) {
+		return b
+	}
+	return a
+}
+
+// p2cScore returns the load score of a backend with the given latency. When
+// no backend has latency samples, backends score by in-flight count alone.
+// Backends in slow start score higher in proportion to their reduced weight.
+func p2cScore(b *Backend, latency float64) float64 {
+	inFlight := float64(b.GetConnections())
+	if latency == 0 {
+		return (inFlight + 1) / b.weightFactor()
+	}
+	return latency * (inFlight + 1) / b.weightFactor()
+}
+
+// meanLatency returns the mean latency EWMA of the backends that have latency
+// samples, 0 if none has
+func meanLatency(backends []*Backend) float64 {
+	total, sampled := 0.0, 0
+	for _, backend := range backends {
+		if latency := backend.LatencyEWMA(); latency > 0 {
+			total += float64(latency)
+			sampled++
+		}
+	}
+	if sampled == 0 {
+		return 0
+	}
+	return total / float64(sampled)
+}
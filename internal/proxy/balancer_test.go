@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+)
+
+// nextTarget returns the target picked for a request to a group
+func nextTarget(t *testing.T, lb *LoadBalancer, group string) string {
+	t.Helper()
+
+	lease, err := lb.GetBackendForConfig(group, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("GetBackendForConfig: %v", err)
+	}
+	lease.Release()
+	return lease.Backend.URL
+}
+
+func TestGroupAlgorithms(t *testing.T) {
+	lb := newTestLoadBalancer(t,
+		testGroup("rr", "round_robin", "http://a:80", "http://b:80"),
+		testGroup("lc", "least_connections", "http://c:80", "http://d:80"),
+	)
+
+	// A request in flight on the first target of each group only steers
+	// the least connections group away from it
+	held := []*Lease{
+		lease(backendFor(t, lb, "http://a:80"), false),
+		lease(backendFor(t, lb, "http://c:80"), false),
+	}
+	defer func() {
+		for _, l := range held {
+			l.Release()
+		}
+	}()
+
+	var rr, lc []string
+	for i := 0; i < 4; i++ {
+		rr = append(rr, nextTarget(t, lb, "rr"))
+		lc = append(lc, nextTarget(t, lb, "lc"))
+	}
+	if want := []string{"http://a:80", "http://b:80", "http://a:80", "http://b:80"}; !reflect.DeepEqual(rr, want) {
+		t.Errorf("round robin group picked %v, want %v", rr, want)
+	}
+	if want := []string{"http://d:80", "http://d:80", "http://d:80", "http://d:80"}; !reflect.DeepEqual(lc, want) {
+		t.Errorf("least connections group picked %v, want %v", lc, want)
+	}
+}
+
+func TestBalancerAcrossUpdates(t *testing.T) {
+	hashed := func(key config.HashKeyConfig) config.BackendConfig {
+		cfg := testGroup("api", "consistent_hash", "http://a:80", "http://b:80")
+		cfg.HashKey = key
+		return cfg
+	}
+
+	tests := []struct {
+		name   string
+		before config.BackendConfig
+		after  config.BackendConfig
+		kept   bool
+	}{
+		{
+			name:   "targets changed",
+			before: testGroup("api", "round_robin", "http://a:80", "http://b:80"),
+			after:  testGroup("api", "round_robin", "http://a:80", "http://b:80", "http://c:80"),
+			kept:   true,
+		},
+		{
+			name:   "algorithm changed",
+			before: testGroup("api", "round_robin", "http://a:80", "http://b:80"),
+			after:  testGroup("api", "least_connections", "http://a:80", "http://b:80"),
+		},
+		{
+			name:   "hash key changed",
+			before: hashed(config.HashKeyConfig{Source: "header", Name: "X-User"}),
+			after:  hashed(config.HashKeyConfig{Source: "cookie", Name: "session"}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newTestLoadBalancer(t, tt.before)
+			nextTarget(t, lb, "api")
+			balancer := lb.groups["api"].balancer
+
+			if err := lb.UpdateBackends([]config.BackendConfig{tt.after}); err != nil {
+				t.Fatalf("UpdateBackends: %v", err)
+			}
+			updated := lb.groups["api"].balancer
+			if kept := updated == balancer; kept != tt.kept {
+				t.Fatalf("balancer kept = %v, want %v", kept, tt.kept)
+			}
+			if want := reflect.TypeOf(newBalancer(tt.after)); reflect.TypeOf(updated) != want {
+				t.Errorf("balancer %T, want %v", updated, want)
+			}
+
+			// The round robin carries on where it stopped
+			if tt.kept {
+				if got := nextTarget(t, lb, "api"); got != "http://b:80" {
+					t.Errorf("picked %s after the update, want http://b:80", got)
+				}
+			}
+		})
+	}
+}
+
+func TestP2CEWMAColdStart(t *testing.T) {
+	lb := newTestLoadBalancer(t, testGroup("api", "p2c_ewma", "http://a:80", "http://b:80", "http://c:80", "http://new:80"))
+	for _, url := range []string{"http://a:80", "http://b:80", "http://c:80"} {
+		backendFor(t, lb, url).ObserveLatency(10 * time.Millisecond)
+	}
+	cold := backendFor(t, lb, "http://new:80")
+
+	// A burst of requests that are all still in flight
+	const requests = 400
+	for i := 0; i < requests; i++ {
+		if _, err := lb.GetBackendForConfig("api", httptest.NewRequest("GET", "/", nil)); err != nil {
+			t.Fatalf("GetBackendForConfig: %v", err)
+		}
+	}
+
+	// The backend without samples competes with the others' mean latency
+	// instead of taking the whole burst
+	fair := requests / 4
+	if got := int(cold.GetConnections()); got > fair*3/2 || got < fair/2 {
+		t.Errorf("cold backend took %d of %d requests, want about %d", got, requests, fair)
+	}
+}
+
+func TestP2CEWMAPrefersFasterBackend(t *testing.T) {
+	lb := newTestLoadBalancer(t, testGroup("api", "p2c_ewma", "http://fast:80", "http://slow:80"))
+	fast := backendFor(t, lb, "http://fast:80")
+	slow := backendFor(t, lb, "http://slow:80")
+	fast.ObserveLatency(5 * time.Millisecond)
+	slow.ObserveLatency(50 * time.Millisecond)
+
+	picks := make(map[*Backend]int)
+	for i := 0; i < 100; i++ {
+		lease, err := lb.GetBackendForConfig("api", httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatalf("GetBackendForConfig: %v", err)
+		}
+		picks[lease.Backend]++
+		lease.Release()
+	}
+
+	if picks[slow] != 0 {
+		t.Errorf("idle slow backend picked %d times over an idle fast one", picks[slow])
+	}
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+	"github.com/os-dev/quic-reverse-proxy/internal/telemetry"
+	"github.com/sirupsen/logrus"
+)
+
+// circuitState is the state of a circuit breaker
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+// String returns the name of the state
+func (s circuitState) String() string {
+	switch s {
+	case circuitHalfOpen:
+		return "half-open"
+	case circuitOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitOpenError is returned when every available backend of a group is
+// rejecting requests because of its circuit breaker
+type CircuitOpenError struct {
+	Group      string
+	RetryAfter time.Duration
+}
+
+// Error implements error
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open for backend group %s", e.Group)
+}
+
+// ErrConcurrencyLimit is returned when every available backend of a group is
+// at its max_concurrent_requests limit
+var ErrConcurrencyLimit = errors.New("backend concurrency limit reached")
+
+// circuitBreaker stops sending requests to a backend whose error rate is too
+// high. After open_duration a limited number of probe requests are let
+// through; the circuit closes again once they all succeed.
+type circuitBreaker struct {
+	cfg     config.CircuitBreakerConfig
+	name    string
+	metrics *telemetry.Metrics
+
+	mu          sync.Mutex
+	state       circuitState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int // Half-open requests in flight
+	successes   int // Successful half-open requests
+}
+
+// newCircuitBreaker creates a closed circuit breaker for a backend
+func newCircuitBreaker(cfg config.CircuitBreakerConfig, name string, metrics *telemetry.Metrics) *circuitBreaker {
+	return &circuitBreaker{
+		cfg:         cfg,
+		name:        name,
+		metrics:     metrics,
+		windowStart: time.Now(),
+	}
+}
+
+// errCircuitOpen is returned by the breaker while it rejects requests
+var errCircuitOpen = errors.New("circuit open")
+
+// check reports whether the backend can take a request without reserving
+// anything. When it cannot, the error is errCircuitOpen or
+// ErrConcurrencyLimit and the duration says how long the caller should wait
+// before trying again. connections is the backend's current in-flight count.
+func (cb *circuitBreaker) check(connections int32) (time.Duration, error) {
+	return cb.admit(connections, false)
+}
+
+// tryAcquire is check for a request that will be sent to the backend if it
+// succeeds. In half-open state it takes one of the probe slots, so no more
+// than half_open_requests probes are let through concurrently.
+func (cb *circuitBreaker) tryAcquire(connections int32) (time.Duration, error) {
+	return cb.admit(connections, true)
+}
+
+// admit implements check and tryAcquire
+func (cb *circuitBreaker) admit(connections int32, acquire bool) (time.Duration, error) {
+	if cb == nil {
+		return 0, nil
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.cfg.MaxConcurrentRequests > 0 && int(connections) >= cb.cfg.MaxConcurrentRequests {
+		return time.Second, ErrConcurrencyLimit
+	}
+
+	switch cb.state {
+	case circuitOpen:
+		remaining := cb.cfg.OpenDuration - time.Since(cb.openedAt)
+		if remaining > 0 {
+			return remaining, errCircuitOpen
+		}
+		cb.transition(circuitHalfOpen)
+		fallthrough
+	case circuitHalfOpen:
+		if cb.probes >= cb.cfg.HalfOpenRequests {
+			return time.Second, errCircuitOpen
+		}
+		if acquire {
+			cb.probes++
+		}
+	}
+	return 0, nil
+}
+
+// record feeds the outcome of a request into the breaker
+func (cb *circuitBreaker) record(failed bool) {
+	if cb == nil {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitHalfOpen:
+		if cb.probes > 0 {
+			cb.probes--
+		}
+		if failed {
+			cb.transition(circuitOpen)
+			return
+		}
+		cb.successes++
+		if cb.successes >= cb.cfg.HalfOpenRequests {
+			cb.transition(circuitClosed)
+		}
+
+	case circuitClosed:
+		now := time.Now()
+		if now.Sub(cb.windowStart) >= cb.cfg.Window {
+			cb.windowStart = now
+			cb.requests = 0
+			cb.failures = 0
+		}
+
+		cb.requests++
+		if failed {
+			cb.failures++
+		}
+
+		errorRate := float64(cb.failures) * 100 / float64(cb.requests)
+		if cb.requests >= cb.cfg.MinRequests && errorRate >= cb.cfg.ErrorThreshold {
+			cb.transition(circuitOpen)
+		}
+	}
+}
+
+// abandon gives back a half-open probe slot for a request whose outcome says
+// nothing about the backend, such as one cancelled by the client
+func (cb *circuitBreaker) abandon() {
+	if cb == nil {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == circuitHalfOpen && cb.probes > 0 {
+		cb.probes--
+	}
+}
+
+// transition moves the breaker to a new state. Must be called with mu held.
+func (cb *circuitBreaker) transition(state circuitState) {
+	if cb.state == state {
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"backend": cb.name,
+		"from":    cb.state.String(),
+		"to":      state.String(),
+	}).Warn("Circuit breaker state changed")
+
+	cb.state = state
+	cb.probes = 0
+	cb.successes = 0
+	cb.requests = 0
+	cb.failures = 0
+	cb.windowStart = time.Now()
+	if state == circuitOpen {
+		cb.openedAt = time.Now()
+	}
+
+	if cb.metrics != nil {
+		cb.metrics.UpdateCircuitState(cb.name, int(state))
+	}
+}
+
+// State returns the current state of the breaker
+func (cb *circuitBreaker) State() string {
+	if cb == nil {
+		return circuitClosed.String()
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state.String()
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+)
+
+func breakerConfig() config.CircuitBreakerConfig {
+	return config.CircuitBreakerConfig{
+		Enabled:          true,
+		ErrorThreshold:   50,
+		MinRequests:      4,
+		Window:           time.Minute,
+		OpenDuration:     20 * time.Millisecond,
+		HalfOpenRequests: 2,
+	}
+}
+
+func TestCircuitBreakerLifecycle(t *testing.T) {
+	cb := newCircuitBreaker(breakerConfig(), "a", nil)
+
+	// Trips once the error rate reaches the threshold over enough requests
+	cb.record(false)
+	cb.record(true)
+	cb.record(false)
+	if cb.State() != "closed" {
+		t.Fatalf("state %s before min_requests, want closed", cb.State())
+	}
+	cb.record(true)
+	if cb.State() != "open" {
+		t.Fatalf("state %s at 50%% errors, want open", cb.State())
+	}
+	if _, err := cb.check(0); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("open breaker let a request through: %v", err)
+	}
+
+	// After open_duration a failing probe opens it again
+	time.Sleep(25 * time.Millisecond)
+	if _, err := cb.tryAcquire(0); err != nil {
+		t.Fatalf("half-open breaker rejected a probe: %v", err)
+	}
+	cb.record(true)
+	if cb.State() != "open" {
+		t.Fatalf("state %s after a failed probe, want open", cb.State())
+	}
+
+	// Successful probes close it
+	time.Sleep(25 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if _, err := cb.tryAcquire(0); err != nil {
+			t.Fatalf("half-open breaker rejected probe %d: %v", i, err)
+		}
+	}
+	cb.record(false)
+	cb.record(false)
+	if cb.State() != "closed" {
+		t.Errorf("state %s after successful probes, want closed", cb.State())
+	}
+}
+
+func TestCircuitBreakerHalfOpenProbeLimit(t *testing.T) {
+	cfg := testGroup("api", "round_robin", "http://a:80")
+	cfg.CircuitBreaker = breakerConfig()
+	lb := newTestLoadBalancer(t, cfg)
+	a := backendFor(t, lb, "http://a:80")
+
+	a.breaker.mu.Lock()
+	a.breaker.transition(circuitOpen)
+	a.breaker.mu.Unlock()
+	time.Sleep(25 * time.Millisecond)
+
+	// Concurrent requests race for the probe slots
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		admitted int
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := lb.GetBackendForConfig("api", httptest.NewRequest("GET", "/", nil)); err != nil {
+				var circuitErr *CircuitOpenError
+				if !errors.As(err, &circuitErr) {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			mu.Lock()
+			admitted++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if admitted != 2 {
+		t.Errorf("%d probes admitted in half-open state, want 2", admitted)
+	}
+}
+
+func TestCircuitBreakerConcurrencyLimit(t *testing.T) {
+	cfg := testGroup("api", "round_robin", "http://a:80")
+	cfg.CircuitBreaker = breakerConfig()
+	cfg.CircuitBreaker.MaxConcurrentRequests = 2
+	lb := newTestLoadBalancer(t, cfg)
+
+	for i := 0; i < 2; i++ {
+		if _, err := lb.GetBackendForConfig("api", httptest.NewRequest("GET", "/", nil)); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+
+	_, err := lb.GetBackendForConfig("api", httptest.NewRequest("GET", "/", nil))
+	if !errors.Is(err, ErrConcurrencyLimit) {
+		t.Fatalf("error %v, want %v", err, ErrConcurrencyLimit)
+	}
+	var circuitErr *CircuitOpenError
+	if errors.As(err, &circuitErr) {
+		t.Errorf("concurrency limit reported as an open circuit")
+	}
+}
+
+func TestCircuitBreakerProbeSlotOnBodyError(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	cfg := testGroup("api", "round_robin", upstream.URL)
+	cfg.CircuitBreaker = breakerConfig()
+	cfg.CircuitBreaker.HalfOpenRequests = 1
+	lb := newTestLoadBalancer(t, cfg)
+	a := backendFor(t, lb, upstream.URL)
+	transport := &upstreamTransport{handler: &Handler{loadBalancer: lb}, config: &cfg}
+
+	a.breaker.mu.Lock()
+	a.breaker.transition(circuitOpen)
+	a.breaker.mu.Unlock()
+	time.Sleep(25 * time.Millisecond)
+
+	// The only probe slot is taken by a request whose body cannot be
+	// replayed, so it is never sent
+	req := httptest.NewRequest("POST", "/", nil)
+	req.GetBody = func() (io.ReadCloser, error) { return nil, errors.New("body already consumed") }
+	if _, err := transport.RoundTrip(req); err == nil {
+		t.Fatalf("request sent without its body")
+	}
+	if a.GetConnections() != 0 {
+		t.Errorf("%d connections left after the failed request", a.GetConnections())
+	}
+
+	// The slot is free for the next probe, which closes the breaker
+	resp, err := transport.RoundTrip(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("half-open breaker rejected the next probe: %v", err)
+	}
+	resp.Body.Close()
+	if a.breaker.State() != "closed" {
+		t.Errorf("state %s after a successful probe, want closed", a.breaker.State())
+	}
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+)
+
+// ringReplicas is the number of virtual nodes placed on the ring per unit of
+// backend weight. More replicas give a smoother key distribution at the cost
+// of a larger ring.
+const ringReplicas = 160
+
+// hashRing is a consistent hash ring over a set of backends. Backends are
+// placed on the ring by URL, so the same target keeps its positions across
+// reloads and health changes and only keys owned by an added or removed
+// target move.
+type hashRing struct {
+	points []uint64
+	owners []*Backend
+}
+
+// newHashRing builds a ring for the given backends
+func newHashRing(backends []*Backend) *hashRing {
+	type point struct {
+		hash  uint64
+		owner *Backend
+	}
+
+	points := make([]point, 0, len(backends)*ringReplicas)
+	for _, backend := range backends {
+		replicas := ringReplicas
+		if backend.Weight > 1 {
+			replicas *= backend.Weight
+		}
+		for i := 0; i < replicas; i++ {
+			points = append(points, point{
+				hash:  hashKey(backend.URL + "#" + strconv.Itoa(i)),
+				owner: backend,
+			})
+		}
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+
+	ring := &hashRing{
+		points: make([]uint64, len(points)),
+		owners: make([]*Backend, len(points)),
+	}
+	for i, p := range points {
+		ring.points[i] = p.hash
+		ring.owners[i] = p.owner
+	}
+
+	return ring
+}
+
+// lookup returns the candidate owning the given hash. Owners that are not
+// candidates, because they are unhealthy, at capacity or in another tier,
+// are passed over clockwise so that only their keys move. A backend in slow
+// start sheds part of its keys to the next candidate along the ring.
+func (r *hashRing) lookup(hash uint64, candidates []*Backend) *Backend {
+	if len(r.points) == 0 {
+		return nil
+	}
+
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= hash
+	})
+
+	var first *Backend
+	var declined []*Backend
+	for n := 0; n < len(r.points); n++ {
+		owner := r.owners[(i+n)%len(r.points)]
+		if containsBackend(declined, owner) || !containsBackend(candidates, owner) {
+			continue
+		}
+		if admit(owner) {
+			return owner
+		}
+		if first == nil {
+			first = owner
+		}
+		declined = append(declined, owner)
+	}
+
+	return first
+}
+
+// hashKey hashes a string onto the ring. FNV-1a alone clusters similar
+// inputs, so its output is passed through a 64-bit finalizer.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// consistentHashBalancer maps a request attribute onto a hash ring so that
+// requests with the same key keep landing on the same backend. The ring
+// holds all backends of the group and is only rebuilt when they change, not
+// when a backend stops being a candidate for a while.
+type consistentHashBalancer struct {
+	key config.HashKeyConfig
+
+	mu      sync.RWMutex
+	ring    *hashRing
+	members []*Backend
+}
+
+// Next implements Balancer
+func (ch *consistentHashBalancer) Next(r *http.Request, backends []*Backend) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	hash := hashKey(ch.requestKey(r))
+
+	ch.mu.RLock()
+	ring := ch.ring
+	ch.mu.RUnlock()
+
+	if ring != nil {
+		if backend := ring.lookup(hash, backends); backend != nil {
+			return backend
+		}
+	}
+
+	// Candidates missing from the ring, before the group's backends were set
+	return backends[hash%uint64(len(backends))]
+}
+
+// setBackends implements groupBalancer, rebuilding the ring when the
+// backends of the group changed
+func (ch *consistentHashBalancer) setBackends(backends []*Backend) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.ring != nil && sameMembers(ch.members, backends) {
+		return
+	}
+	ch.ring = newHashRing(backends)
+	ch.members = append([]*Backend(nil), backends...)
+}
+
+// requestKey extracts the configured hash key from the request, falling back
+// to the client IP when the attribute is missing
+func (ch *consistentHashBalancer) requestKey(r *http.Request) string {
+	switch ch.key.Source {
+	case "header":
+		if value := r.Header.Get(ch.key.Name); value != "" {
+			return value
+		}
+	case "cookie":
+		if cookie, err := r.Cookie(ch.key.Name); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	case "path":
+		return r.URL.Path
+	}
+
+	return clientIP(r)
+}
+
+// sameMembers reports whether two backend slices hold the same backends,
+// in any order
+func sameMembers(a, b []*Backend) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, backend := range a {
+		if !containsBackend(b, backend) {
+			return false
+		}
+	}
+	return true
+}
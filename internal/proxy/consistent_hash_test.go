@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+)
+
+func hashBackendConfig(targets int) config.BackendConfig {
+	cfg := config.BackendConfig{
+		Name:         "cache",
+		Protocol:     "http",
+		LoadBalancer: "consistent_hash",
+		HashKey:      config.HashKeyConfig{Source: "header", Name: "X-Cache-Key"},
+		Weight:       1,
+	}
+	for i := 0; i < targets; i++ {
+		cfg.Targets = append(cfg.Targets, config.TargetConfig{URL: fmt.Sprintf("http://cache%d:8080", i)})
+	}
+	return cfg
+}
+
+// assignKeys maps every key to the URL of the backend selected for it
+func assignKeys(t *testing.T, lb *LoadBalancer, keys int) map[string]string {
+	t.Helper()
+
+	assignment := make(map[string]string, keys)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("object-%d", i)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Cache-Key", key)
+
+		lease, err := lb.GetBackendForConfig("cache", req)
+		if err != nil {
+			t.Fatalf("no backend selected for key %s: %v", key, err)
+		}
+		assignment[key] = lease.Backend.URL
+		lease.Release()
+	}
+	return assignment
+}
+
+func TestConsistentHashRedistribution(t *testing.T) {
+	const (
+		keys    = 20000
+		targets = 10
+	)
+
+	tests := []struct {
+		name   string
+		before int
+		after  int
+	}{
+		{name: "add target", before: targets, after: targets + 1},
+		{name: "remove target", before: targets + 1, after: targets},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb, err := NewLoadBalancer([]config.BackendConfig{hashBackendConfig(tt.before)}, nil)
+			if err != nil {
+				t.Fatalf("NewLoadBalancer: %v", err)
+			}
+			before := assignKeys(t, lb, keys)
+
+			if err := lb.UpdateBackends([]config.BackendConfig{hashBackendConfig(tt.after)}); err != nil {
+				t.Fatalf("UpdateBackends: %v", err)
+			}
+			after := assignKeys(t, lb, keys)
+
+			// The only target that differs between the two sets is the last one
+			changed := fmt.Sprintf("http://cache%d:8080", targets)
+
+			moved := 0
+			for key, url := range before {
+				if after[key] == url {
+					continue
+				}
+				moved++
+
+				// Keys may only move onto an added target or off a removed one
+				if url != changed && after[key] != changed {
+					t.Errorf("key %s moved between untouched targets: %s -> %s", key, url, after[key])
+				}
+			}
+
+			// Ideally 1/(n+1) of the keys move; allow for ring imbalance
+			ideal := float64(keys) / float64(targets+1)
+			if float64(moved) > ideal*1.5 {
+				t.Errorf("moved %d of %d keys, want at most %.0f", moved, keys, ideal*1.5)
+			}
+			if moved == 0 {
+				t.Errorf("no keys moved after changing the target set")
+			}
+		})
+	}
+}
+
+func TestConsistentHashCandidateChanges(t *testing.T) {
+	const keys = 20000
+
+	lb, err := NewLoadBalancer([]config.BackendConfig{hashBackendConfig(10)}, nil)
+	if err != nil {
+		t.Fatalf("NewLoadBalancer: %v", err)
+	}
+	balancer := lb.groups["cache"].balancer.(*consistentHashBalancer)
+	ring := balancer.ring
+
+	before := assignKeys(t, lb, keys)
+
+	// A backend leaving the candidates only gives up its own keys
+	out := lb.groups["cache"].backends[3]
+	out.SetHealthy(false)
+	during := assignKeys(t, lb, keys)
+	for key, url := range before {
+		if url == out.URL {
+			if during[key] == out.URL {
+				t.Errorf("key %s still assigned to unhealthy backend", key)
+			}
+			continue
+		}
+		if during[key] != url {
+			t.Errorf("key %s moved between healthy backends: %s -> %s", key, url, during[key])
+		}
+	}
+
+	// Once it is back, every key returns to where it was
+	out.SetHealthy(true)
+	after := assignKeys(t, lb, keys)
+	for key, url := range before {
+		if after[key] != url {
+			t.Errorf("key %s did not return: %s -> %s", key, url, after[key])
+		}
+	}
+
+	if balancer.ring != ring {
+		t.Errorf("ring was rebuilt although the group's backends did not change")
+	}
+}
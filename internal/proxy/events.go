@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/telemetry"
+	"github.com/sirupsen/logrus"
+)
+
+// EventType identifies a change in the lifecycle of a backend
+type EventType string
+
+const (
+	EventBackendHealthy   EventType = "backend_healthy"
+	EventBackendUnhealthy EventType = "backend_unhealthy"
+	EventBackendEjected   EventType = "backend_ejected"
+	EventBackendUnejected EventType = "backend_unejected"
+	EventBackendDraining  EventType = "backend_draining"
+	EventBackendUndrained EventType = "backend_undrained"
+	EventBackendDrained   EventType = "backend_drained" // A draining backend has no requests in flight left
+	EventBackendAdded     EventType = "backend_added"
+	EventBackendRemoved   EventType = "backend_removed"
+)
+
+// Event describes a change in the lifecycle of a backend
+type Event struct {
+	ID      uint64    `json:"id"`
+	Type    EventType `json:"type"`
+	Time    time.Time `json:"time"`
+	Backend string    `json:"backend"`
+	Group   string    `json:"group"`
+	URL     string    `json:"url"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// eventHistorySize is the number of recent events kept for subscribers
+// catching up after a reconnect
+const eventHistorySize = 256
+
+// EventBus publishes backend events to its subscribers. Publishing never
+// blocks; the subscription of a subscriber that falls behind is ended by
+// closing its channel, and it may subscribe again from the last event it
+// received to catch up from the recent events.
+type EventBus struct {
+	mu          sync.Mutex
+	nextID      uint64
+	subscribers map[chan Event]string // Kind of subscriber, for the metrics
+	recent      []Event               // Latest events, oldest first
+	metrics     *telemetry.Metrics
+}
+
+// NewEventBus creates an event bus without subscribers
+func NewEventBus(metrics *telemetry.Metrics) *EventBus {
+	return &EventBus{
+		subscribers: make(map[chan Event]string),
+		metrics:     metrics,
+	}
+}
+
+// Publish assigns the event an ID and time and sends it to all subscribers.
+// It does nothing on a nil bus.
+func (bus *EventBus) Publish(event Event) {
+	if bus == nil {
+		return
+	}
+
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	bus.nextID++
+	event.ID = bus.nextID
+	event.Time = time.Now()
+
+	if len(bus.recent) == eventHistorySize {
+		bus.recent = append(bus.recent[:0], bus.recent[1:]...)
+	}
+	bus.recent = append(bus.recent, event)
+
+	for ch, kind := range bus.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(bus.subscribers, ch)
+			close(ch)
+
+			if bus.metrics != nil {
+				bus.metrics.RecordEventDropped(kind)
+			}
+			logrus.WithFields(logrus.Fields{
+				"subscriber": kind,
+				"event":      event.Type,
+				"backend":    event.Backend,
+			}).Warn("Event subscriber too slow, ending its subscription")
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the events published from now on,
+// preceded by the recent events with an ID above after. The channel is
+// closed when the subscriber falls more than buffer events behind. kind
+// names the subscriber in the metrics. The returned function ends the
+// subscription.
+func (bus *EventBus) Subscribe(kind string, after uint64, buffer int) (<-chan Event, func()) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	var backlog []Event
+	for _, event := range bus.recent {
+		if event.ID > after {
+			backlog = append(backlog, event)
+		}
+	}
+
+	ch := make(chan Event, buffer+len(backlog))
+	for _, event := range backlog {
+		ch <- event
+	}
+	bus.subscribers[ch] = kind
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			bus.mu.Lock()
+			delete(bus.subscribers, ch)
+			bus.mu.Unlock()
+		})
+	}
+}
+
+// LastID returns the ID of the latest event, 0 if none was published
+func (bus *EventBus) LastID() uint64 {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	return bus.nextID
+}
+
+// publish sends an event about the backend
+func (b *Backend) publish(eventType EventType, reason string) {
+	b.events.Publish(Event{
+		Type:    eventType,
+		Backend: b.Name,
+		Group:   b.Group,
+		URL:     b.URL,
+		Reason:  reason,
+	})
+}
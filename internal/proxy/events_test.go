@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/telemetry"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// receive returns the IDs of the events buffered for a subscriber, and
+// whether its subscription is still open
+func receive(events <-chan Event) ([]uint64, bool) {
+	var ids []uint64
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return ids, false
+			}
+			ids = append(ids, event.ID)
+		default:
+			return ids, true
+		}
+	}
+}
+
+func TestEventBusBacklog(t *testing.T) {
+	bus := NewEventBus(nil)
+	for i := 0; i < 3; i++ {
+		bus.Publish(Event{Type: EventBackendAdded})
+	}
+
+	events, unsubscribe := bus.Subscribe("test", 1, 4)
+	defer unsubscribe()
+	bus.Publish(Event{Type: EventBackendRemoved})
+
+	if ids, open := receive(events); len(ids) != 3 || ids[0] != 2 || ids[2] != 4 || !open {
+		t.Errorf("received %v (open %v), want events 2 to 4", ids, open)
+	}
+	if bus.LastID() != 4 {
+		t.Errorf("LastID = %d, want 4", bus.LastID())
+	}
+}
+
+func TestEventBusSlowSubscriber(t *testing.T) {
+	metrics := &telemetry.Metrics{EventsDropped: prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "backend_events_dropped_total"}, []string{"subscriber"},
+	)}
+	bus := NewEventBus(metrics)
+
+	slow, unsubscribe := bus.Subscribe("test", 0, 2)
+	defer unsubscribe()
+	fast, unsubscribeFast := bus.Subscribe("other", 0, 8)
+	defer unsubscribeFast()
+
+	for i := 0; i < 5; i++ {
+		bus.Publish(Event{Type: EventBackendAdded})
+	}
+
+	// The subscription of the subscriber falling behind ends, without
+	// holding up the others
+	ids, open := receive(slow)
+	if len(ids) != 2 || open {
+		t.Errorf("slow subscriber received %v (open %v), want 2 events and the end of its subscription", ids, open)
+	}
+	if ids, open := receive(fast); len(ids) != 5 || !open {
+		t.Errorf("other subscriber received %v (open %v), want all 5 events", ids, open)
+	}
+	if dropped := testutil.ToFloat64(metrics.EventsDropped.WithLabelValues("test")); dropped != 1 {
+		t.Errorf("dropped events = %v, want 1", dropped)
+	}
+
+	// Subscribing again from the last event received catches up
+	events, unsubscribe := bus.Subscribe("test", ids[len(ids)-1], 2)
+	defer unsubscribe()
+	if ids, open := receive(events); len(ids) != 3 || ids[0] != 3 || !open {
+		t.Errorf("received %v (open %v) after subscribing again, want events 3 to 5", ids, open)
+	}
+}
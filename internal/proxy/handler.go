@@ -1,33 +1,69 @@
 package proxy
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/os-dev/quic-reverse-proxy/internal/quic"
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
 	"github.com/os-dev/quic-reverse-proxy/internal/telemetry"
 	"github.com/sirupsen/logrus"
 )
 
 // Handler handles HTTP requests and forwards them to backend services
 type Handler struct {
-	router       *Router
+	router       atomic.Pointer[Router] // Replaced on reload, see SetRouter
 	loadBalancer *LoadBalancer
 	metrics      *telemetry.Metrics
+
+	budgetsMu    sync.Mutex
+	retryBudgets map[string]*retryBudget // Per backend config
+
+	hedgersMu sync.Mutex
+	hedgers   map[string]*hedger // Per route rule, by routeKey
 }
 
 // NewHandler creates a new proxy handler
 func NewHandler(router *Router, loadBalancer *LoadBalancer, metrics *telemetry.Metrics) *Handler {
-	return &Handler{
-		router:       router,
+	h := &Handler{
 		loadBalancer: loadBalancer,
 		metrics:      metrics,
+		retryBudgets: make(map[string]*retryBudget),
+		hedgers:      make(map[string]*hedger),
+	}
+	h.router.Store(router)
+	return h
+}
+
+// SetRouter replaces the routes of the handler on reload. Rules and backend
+// groups that are kept unchanged keep their hedging state and retry budget;
+// the state of the others is dropped.
+func (h *Handler) SetRouter(router *Router) {
+	h.router.Store(router)
+
+	h.budgetsMu.Lock()
+	for name, budget := range h.retryBudgets {
+		if backend, ok := router.GetBackend(name); !ok || !budget.matches(backend.RetryPolicy) {
+			delete(h.retryBudgets, name)
+		}
+	}
+	h.budgetsMu.Unlock()
+
+	h.hedgersMu.Lock()
+	defer h.hedgersMu.Unlock()
+	for key := range h.hedgers {
+		if !router.hasRoute(key) {
+			delete(h.hedgers, key)
+		}
 	}
 }
 
@@ -52,39 +88,47 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Route the request to find the appropriate backend config
-	backendConfig, err := h.router.Route(r)
+	match, err := h.router.Load().Match(r)
 	if err != nil {
 		h.handleError(w, r, fmt.Sprintf("routing error: %v", err), http.StatusNotFound)
 		return
 	}
+	backendConfig := match.Backend
+	if len(match.Params) > 0 {
+		r = withRouteParams(r, match.Params)
+	}
 
-	// Check if we should strip the path prefix
-	shouldStrip, prefix := h.router.ShouldStripPrefix(r)
-	if shouldStrip && prefix != "" {
-		// Strip the prefix from the path
-		r.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+	// Strip the path prefix of the matched rule
+	if match.StripPrefix != "" {
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, match.StripPrefix)
 		if r.URL.Path == "" {
 			r.URL.Path = "/"
 		}
 	}
 
-	// Get a healthy backend from the load balancer for this backend config
-	backend := h.loadBalancer.GetBackendForConfig(backendConfig.Name)
-	if backend == nil {
-		h.handleError(w, r, "no healthy backends available", http.StatusServiceUnavailable)
-		return
+	// Apply the rewrite and headers of the route
+	if match.Rule != nil {
+		applyRoute(r, match)
 	}
 
-	// Track active connections
-	backend.IncrementConnections()
-	defer backend.DecrementConnections()
-
-	// Create reverse proxy for the selected backend
-	proxy := h.createReverseProxy(backend)
-
 	// Add custom headers
 	h.addProxyHeaders(r)
 
+	// Bound the whole exchange, retries included. Upgraded connections are
+	// long-lived and only limited by the per-try timeout while connecting.
+	if backendConfig.Timeout > 0 && !isUpgrade(r) {
+		ctx, cancel := context.WithTimeout(r.Context(), backendConfig.Timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	// Create reverse proxy for the backend group. Backends are leased per
+	// attempt by the upstream transport and released once the response body
+	// has been relayed, so streaming responses are counted for their whole
+	// lifetime.
+	upstream := h.newUpstream(match, r)
+	proxy := h.createReverseProxy(backendConfig, upstream, r)
+
 	// Wrap the response writer to capture metrics
 	wrapper := &responseWrapper{
 		ResponseWriter: w,
@@ -97,45 +141,81 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Record metrics
 	duration := time.Since(start)
-	h.recordMetrics(r, wrapper, backend, duration)
+	h.recordMetrics(r, wrapper, upstream.backendName(), duration)
 
 	// Log the request
-	h.logRequest(r, wrapper.statusCode, duration, backend.Name)
+	h.logRequest(r, wrapper.statusCode, duration, upstream.backendName())
 }
 
-// createReverseProxy creates a reverse proxy for the given backend
-func (h *Handler) createReverseProxy(backend *Backend) *httputil.ReverseProxy {
-	target, _ := url.Parse(backend.URL) // Error already handled in load balancer
+// newUpstream creates the transport that sends a request to a backend group,
+// deciding how many times the request may be retried and whether it is hedged
+func (h *Handler) newUpstream(match *RouteMatch, r *http.Request) *upstreamTransport {
+	backendConfig := match.Backend
+	budget := h.retryBudget(backendConfig)
+	budget.recordRequest()
 
-	proxy := httputil.NewSingleHostReverseProxy(target)
+	var hedge *hedger
+	if match.Rule != nil && match.Rule.Hedge.Enabled && r.Method == http.MethodGet {
+		hedge = h.hedger(match)
+	}
 
-	// Set up the transport based on the backend protocol
-	if backend.Protocol == "h3" {
-		proxy.Transport = quic.NewRoundTripper(backend.TLSSkipVerify)
+	retries := 0
+	if (backendConfig.Retries() > 0 || hedge != nil) && isIdempotent(r) && !isUpgrade(r) && makeReplayable(r) {
+		retries = backendConfig.Retries()
 	} else {
-		transport := http.DefaultTransport.(*http.Transport).Clone()
-		if backend.TLSSkipVerify {
-			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-		}
-		proxy.Transport = transport
+		// Requests that cannot be replayed cannot be hedged either
+		hedge = nil
+	}
+	if hedge != nil {
+		hedge.recordRequest()
 	}
 
-	// Customize the director to modify requests
-	originalDirector := proxy.Director
+	return &upstreamTransport{
+		handler: h,
+		config:  backendConfig,
+		budget:  budget,
+		retries: retries,
+		hedge:   hedge,
+	}
+}
+
+// retryBudget returns the retry budget of a backend config
+func (h *Handler) retryBudget(backendConfig *config.BackendConfig) *retryBudget {
+	h.budgetsMu.Lock()
+	defer h.budgetsMu.Unlock()
+
+	budget, ok := h.retryBudgets[backendConfig.Name]
+	if !ok {
+		budget = newRetryBudget(backendConfig.RetryPolicy)
+		h.retryBudgets[backendConfig.Name] = budget
+	}
+	return budget
+}
+
+// hedger returns the hedger of the rule a request matched
+func (h *Handler) hedger(match *RouteMatch) *hedger {
+	h.hedgersMu.Lock()
+	defer h.hedgersMu.Unlock()
+
+	hedge, ok := h.hedgers[match.key]
+	if !ok {
+		hedge = newHedger(match.Rule.Hedge)
+		h.hedgers[match.key] = hedge
+	}
+	return hedge
+}
+
+// createReverseProxy creates a reverse proxy that forwards through the given
+// upstream transport
+func (h *Handler) createReverseProxy(backendConfig *config.BackendConfig, upstream *upstreamTransport, clientReq *http.Request) *httputil.ReverseProxy {
+	proxy := &httputil.ReverseProxy{Transport: upstream}
+
+	// The upstream transport points each attempt at its backend; the
+	// director only prepares headers shared by all attempts
 	proxy.Director = func(req *http.Request) {
-		originalDirector(req)
-
-		// Modify the request as needed
-		req.Host = target.Host
-		req.URL.Host = target.Host
-		
-		// Map backend protocol to the correct scheme for the request
-		if backend.Protocol == "h3" || backend.Protocol == "https" {
-			req.URL.Scheme = "https"
-		} else if backend.Protocol == "http" {
-			req.URL.Scheme = "http"
-		} else {
-			req.URL.Scheme = target.Scheme
+		if _, ok := req.Header["User-Agent"]; !ok {
+			// Explicitly disable User-Agent so it's not set to default value
+			req.Header.Set("User-Agent", "")
 		}
 
 		// Add/modify headers
@@ -145,38 +225,39 @@ func (h *Handler) createReverseProxy(backend *Backend) *httputil.ReverseProxy {
 
 	// Customize error handler
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		logrus.WithFields(logrus.Fields{
-			"backend": backend.Name,
-			"error":   err.Error(),
-			"url":     r.URL.String(),
-		}).Error("Backend request failed")
-
-		// Mark backend as unhealthy if it's a connection error
-		if strings.Contains(err.Error(), "connection refused") ||
-			strings.Contains(err.Error(), "no such host") ||
-			strings.Contains(err.Error(), "timeout") {
-			backend.SetHealthy(false)
-		}
-
-		// Record backend error
-		if h.metrics != nil {
-			h.metrics.RecordBackendRequest(backend.Name, "error", 0)
+		var circuitErr *CircuitOpenError
+		switch {
+		case errors.As(err, &circuitErr):
+			// Fail fast and tell the client when the group may accept requests again
+			retryAfter := int(math.Ceil(circuitErr.RetryAfter.Seconds()))
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			h.writeError(w, r, err.Error(), http.StatusServiceUnavailable)
+		case errors.Is(err, ErrConcurrencyLimit):
+			w.Header().Set("Retry-After", "1")
+			h.writeError(w, r, err.Error(), http.StatusServiceUnavailable)
+		case errors.Is(err, ErrNoHealthyBackends), errors.Is(err, ErrStickyBackendUnavailable):
+			h.writeError(w, r, err.Error(), http.StatusServiceUnavailable)
+		case isTimeout(err):
+			h.writeError(w, r, "Backend request timed out", http.StatusGatewayTimeout)
+		default:
+			h.writeError(w, r, "Backend service unavailable", http.StatusBadGateway)
 		}
-
-		// Return error response
-		w.WriteHeader(http.StatusBadGateway)
-		w.Write([]byte("Backend service unavailable"))
 	}
 
 	// Modify response
 	proxy.ModifyResponse = func(resp *http.Response) error {
+		backend := upstream.backend
+
 		// Add custom response headers
 		resp.Header.Set("X-Proxy-By", "quic-reverse-proxy")
 		resp.Header.Set("X-Backend", backend.Name)
 
-		// Record successful backend request
-		if h.metrics != nil {
-			h.metrics.RecordBackendRequest(backend.Name, "success", 0)
+		// Pin new sessions to the backend that served them
+		if sticky := backendConfig.StickySession; sticky.Enabled && !upstream.sticky {
+			setAffinity(sticky, resp, backend, clientReq.TLS != nil)
 		}
 
 		return nil
@@ -185,6 +266,18 @@ func (h *Handler) createReverseProxy(backend *Backend) *httputil.ReverseProxy {
 	return proxy
 }
 
+// applyRoute rewrites the path of a request and sets the headers configured
+// on its route, filling in the parameters captured from the path
+func applyRoute(r *http.Request, match *RouteMatch) {
+	if match.Rule.Rewrite != "" {
+		r.URL.Path = expandTemplate(match.Rule.Rewrite, match.Params)
+		r.URL.RawPath = ""
+	}
+	for name, value := range match.Rule.RequestHeaders {
+		r.Header.Set(name, expandTemplate(value, match.Params))
+	}
+}
+
 // addProxyHeaders adds proxy-related headers to the request
 func (h *Handler) addProxyHeaders(r *http.Request) {
 	// Add X-Forwarded-For header
@@ -207,6 +300,11 @@ func (h *Handler) addProxyHeaders(r *http.Request) {
 
 // getClientIP extracts the client IP address from the request
 func (h *Handler) getClientIP(r *http.Request) string {
+	return clientIP(r)
+}
+
+// clientIP extracts the client IP address from the request
+func clientIP(r *http.Request) string {
 	// Check X-Forwarded-For header
 	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
 		parts := strings.Split(xff, ",")
@@ -230,16 +328,7 @@ func (h *Handler) getClientIP(r *http.Request) string {
 
 // handleError handles proxy errors
 func (h *Handler) handleError(w http.ResponseWriter, r *http.Request, message string, statusCode int) {
-	logrus.WithFields(logrus.Fields{
-		"method":      r.Method,
-		"url":         r.URL.String(),
-		"remote_addr": r.RemoteAddr,
-		"error":       message,
-		"status":      statusCode,
-	}).Error("Proxy error")
-
-	w.WriteHeader(statusCode)
-	w.Write([]byte(message))
+	h.writeError(w, r, message, statusCode)
 
 	// Record error metrics
 	if h.metrics != nil {
@@ -254,8 +343,22 @@ func (h *Handler) handleError(w http.ResponseWriter, r *http.Request, message st
 	}
 }
 
+// writeError logs a proxy error and writes it to the client
+func (h *Handler) writeError(w http.ResponseWriter, r *http.Request, message string, statusCode int) {
+	logrus.WithFields(logrus.Fields{
+		"method":      r.Method,
+		"url":         r.URL.String(),
+		"remote_addr": r.RemoteAddr,
+		"error":       message,
+		"status":      statusCode,
+	}).Error("Proxy error")
+
+	w.WriteHeader(statusCode)
+	w.Write([]byte(message))
+}
+
 // recordMetrics records request metrics
-func (h *Handler) recordMetrics(r *http.Request, w *responseWrapper, backend *Backend, duration time.Duration) {
+func (h *Handler) recordMetrics(r *http.Request, w *responseWrapper, backendName string, duration time.Duration) {
 	if h.metrics == nil {
 		return
 	}
@@ -274,7 +377,7 @@ func (h *Handler) recordMetrics(r *http.Request, w *responseWrapper, backend *Ba
 	// Record HTTP metrics
 	h.metrics.RecordHTTPRequest(
 		r.Method,
-		backend.Name,
+		backendName,
 		w.statusCode,
 		duration,
 		requestSize,
@@ -284,7 +387,7 @@ func (h *Handler) recordMetrics(r *http.Request, w *responseWrapper, backend *Ba
 
 // logRequest logs the completed request
 func (h *Handler) logRequest(r *http.Request, statusCode int, duration time.Duration, backendName string) {
-	logrus.WithFields(logrus.Fields{
+	fields := logrus.Fields{
 		"method":      r.Method,
 		"path":        r.URL.Path,
 		"status":      statusCode,
@@ -293,7 +396,11 @@ func (h *Handler) logRequest(r *http.Request, statusCode int, duration time.Dura
 		"remote_addr": r.RemoteAddr,
 		"user_agent":  r.UserAgent(),
 		"referer":     r.Referer(),
-	}).Info("Request completed")
+	}
+	if params := RouteParams(r); len(params) > 0 {
+		fields["route_params"] = params
+	}
+	logrus.WithFields(fields).Info("Request completed")
 }
 
 // responseWrapper wraps http.ResponseWriter to capture response details
@@ -319,12 +426,17 @@ func (h *Handler) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 	// Get backend status from load balancer
 	backends := h.loadBalancer.GetBackendStatus()
 
-	// Count healthy backends
+	// Count healthy backends. Removed backends finishing their requests
+	// are listed, but no longer part of the proxy's health.
 	healthyCount := 0
-	totalCount := len(backends)
+	totalCount := 0
 
 	for _, backendInfo := range backends {
 		if backendMap, ok := backendInfo.(map[string]interface{}); ok {
+			if removed, _ := backendMap["removed"].(bool); removed {
+				continue
+			}
+			totalCount++
 			if healthy, ok := backendMap["healthy"].(bool); ok && healthy {
 				healthyCount++
 			}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+)
+
+func TestHealthCheckIgnoresRemovedBackends(t *testing.T) {
+	lb := newTestLoadBalancer(t, testGroup("web", "round_robin", "http://a:80", "http://b:80"))
+	h := &Handler{loadBalancer: lb}
+
+	// b is removed while it still has a request in flight
+	held := lease(backendFor(t, lb, "http://b:80"), false)
+	defer held.Release()
+	if err := lb.UpdateBackends([]config.BackendConfig{testGroup("web", "round_robin", "http://a:80")}); err != nil {
+		t.Fatalf("UpdateBackends: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		healthy bool
+		code    int
+		status  string
+	}{
+		{name: "remaining backend healthy", healthy: true, code: http.StatusOK, status: "healthy"},
+		{name: "remaining backend unhealthy", healthy: false, code: http.StatusServiceUnavailable, status: "unhealthy"},
+	}
+
+	for _, tt := range tests {
+		backendFor(t, lb, "http://a:80").SetHealthy(tt.healthy)
+
+		rec := httptest.NewRecorder()
+		h.handleHealthCheck(rec, httptest.NewRequest("GET", "/health", nil))
+
+		var body map[string]interface{}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: invalid response: %v", tt.name, err)
+		}
+		if rec.Code != tt.code || body["status"] != tt.status || body["total_backends"] != float64(1) {
+			t.Errorf("%s: %d %v of %v backends, want %d %s of 1", tt.name, rec.Code, body["status"], body["total_backends"], tt.code, tt.status)
+		}
+		if backends := body["backends"].(map[string]interface{}); len(backends) != 2 {
+			t.Errorf("%s: %d backends listed, want the removed one too", tt.name, len(backends))
+		}
+	}
+}
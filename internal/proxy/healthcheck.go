@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+	"github.com/os-dev/quic-reverse-proxy/pkg/health"
+	"github.com/sirupsen/logrus"
+)
+
+// probe runs the health checks of a target. Backends of different groups
+// pointing at the same target with the same health check settings share a
+// probe, so the target is checked only once per interval. Backends joining a
+// running probe switch to its checker under their mu. The checker is closed
+// when the probe stops.
+type probe struct {
+	key      string
+	checker  *health.Checker
+	backends []*Backend // Backends fed by the probe, guarded by the load balancer's mu
+	stop     chan struct{}
+}
+
+// probeKey identifies the health checks of a target. Backends with the same
+// key would send identical probes.
+func probeKey(cfg config.BackendConfig, target string) string {
+	key, _ := json.Marshal(struct {
+		Target        string
+		Protocol      string
+		TLSSkipVerify bool
+		TLSCAFile     string
+		HealthCheck   config.HealthCheckConfig
+	}{target, cfg.Protocol, cfg.TLSSkipVerify, cfg.TLSCAFile, cfg.HealthCheck})
+	return string(key)
+}
+
+// startHealthCheck starts the health checks of a backend if it has them
+// enabled and they are not running yet. The backend joins the probe already
+// running for an identical definition, if any, and otherwise starts a probe
+// with a new checker. Must be called with mu held.
+func (lb *LoadBalancer) startHealthCheck(backend *Backend) {
+	if backend.newChecker == nil || backend.probe != nil {
+		return
+	}
+
+	p, ok := lb.probes[backend.probeKey]
+	if ok {
+		// Take on what the running probe knows about the target
+		backend.SetHealthy(p.checker.IsHealthy())
+		backend.setDegraded(p.checker.IsDegraded())
+	} else {
+		p = &probe{key: backend.probeKey, checker: backend.newChecker(), stop: make(chan struct{})}
+		lb.probes[p.key] = p
+		go lb.runProbe(p)
+	}
+
+	backend.mu.Lock()
+	backend.checker = p.checker
+	backend.mu.Unlock()
+
+	p.backends = append(p.backends, backend)
+	backend.probe = p
+}
+
+// stopHealthCheck detaches a backend from its probe, stopping the probe once
+// no backend uses it anymore. Must be called with mu held.
+func (lb *LoadBalancer) stopHealthCheck(backend *Backend) {
+	p := backend.probe
+	if p == nil {
+		return
+	}
+	backend.probe = nil
+
+	for i, b := range p.backends {
+		if b == backend {
+			p.backends = append(p.backends[:i], p.backends[i+1:]...)
+			break
+		}
+	}
+	if len(p.backends) == 0 {
+		close(p.stop)
+		delete(lb.probes, p.key)
+	}
+}
+
+// runProbe checks the target at the checker's jittered interval, applying
+// the result to every backend of the probe, until the probe is stopped
+func (lb *LoadBalancer) runProbe(p *probe) {
+	logrus.WithField("url", p.checker.URL()).Info("Starting health checks")
+
+	// Start at a random point of the interval so probes do not fire in
+	// lockstep
+	timer := time.NewTimer(p.checker.InitialDelay())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			// Probes keep running while the health is overridden, so the
+			// backends are up to date once the override ends
+			healthy := p.checker.Check()
+			degraded := p.checker.IsDegraded()
+
+			lb.mu.RLock()
+			backends := append([]*Backend(nil), p.backends...)
+			lb.mu.RUnlock()
+
+			for _, backend := range backends {
+				wasHealthy := backend.IsHealthy()
+				backend.SetHealthy(healthy)
+				backend.setDegraded(degraded)
+				lb.healthChanged(backend, wasHealthy, "health_check")
+			}
+
+			timer.Reset(p.checker.NextDelay())
+
+		case <-p.stop:
+			logrus.WithField("url", p.checker.URL()).Info("Stopping health checks")
+			p.checker.Close()
+			return
+		}
+	}
+}
+
+// HealthCheckStats returns the state and recent results of the backend's
+// health checks, or nil if they never ran
+func (b *Backend) HealthCheckStats() map[string]interface{} {
+	b.mu.RLock()
+	checker := b.checker
+	b.mu.RUnlock()
+
+	if checker == nil {
+		return nil
+	}
+	return checker.GetStats()
+}
@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+	"github.com/os-dev/quic-reverse-proxy/pkg/health"
+)
+
+// checkedGroup returns a group whose targets are health checked every few
+// milliseconds
+func checkedGroup(name string, urls ...string) config.BackendConfig {
+	cfg := testGroup(name, "round_robin", urls...)
+	cfg.HealthCheck = config.HealthCheckConfig{
+		Enabled:            true,
+		Path:               "/health",
+		Interval:           10 * time.Millisecond,
+		Timeout:            time.Second,
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+	}
+	return cfg
+}
+
+// checkerOf returns the checker currently feeding a backend
+func checkerOf(b *Backend) *health.Checker {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.checker
+}
+
+// waitHealthy waits for the health checks to report the backend healthy or
+// unhealthy
+func waitHealthy(t *testing.T, b *Backend, healthy bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for b.IsHealthy() != healthy {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never became healthy = %v", b.Name, healthy)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthCheckRestart(t *testing.T) {
+	var failing atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+
+	lb := newTestLoadBalancer(t, checkedGroup("a", upstream.URL), checkedGroup("b", upstream.URL))
+	backends := lb.FindBackends(upstream.URL)
+	a, b := backends[0], backends[1]
+
+	lb.StartHealthChecks()
+	defer lb.StopHealthChecks()
+
+	// Both groups share a single probe of the target
+	shared := checkerOf(a)
+	if shared == nil || checkerOf(b) != shared || len(lb.probes) != 1 {
+		t.Fatalf("backends of identical health checks do not share a probe")
+	}
+
+	// Stopping closes the checker of the probe; starting again probes the
+	// target with a new one
+	lb.StopHealthChecks()
+	if len(lb.probes) != 0 {
+		t.Fatalf("%d probes running after stopping the health checks", len(lb.probes))
+	}
+	failing.Store(true)
+	lb.StartHealthChecks()
+
+	restarted := checkerOf(a)
+	if restarted == shared || checkerOf(b) != restarted {
+		t.Errorf("health checks restarted with the checker of the stopped probe")
+	}
+	waitHealthy(t, a, false)
+	waitHealthy(t, b, false)
+
+	failing.Store(false)
+	waitHealthy(t, a, true)
+	waitHealthy(t, b, true)
+}
+
+func TestHealthCheckRestartAfterReload(t *testing.T) {
+	var failing atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+
+	a, b := checkedGroup("a", upstream.URL), checkedGroup("b", upstream.URL)
+	lb := newTestLoadBalancer(t, a, b)
+	lb.StartHealthChecks()
+	defer lb.StopHealthChecks()
+	shared := checkerOf(lb.FindBackends(upstream.URL)[0])
+
+	// The probe outlives the group that started it
+	if err := lb.UpdateBackends([]config.BackendConfig{b}); err != nil {
+		t.Fatalf("UpdateBackends: %v", err)
+	}
+	if checkerOf(backendFor(t, lb, upstream.URL)) != shared {
+		t.Errorf("remaining backend lost the running probe")
+	}
+
+	// Once the target is gone its probe stops, and a target added back
+	// is probed with a new checker
+	if err := lb.UpdateBackends([]config.BackendConfig{testGroup("b", "round_robin", "http://unused:80")}); err != nil {
+		t.Fatalf("UpdateBackends: %v", err)
+	}
+	failing.Store(true)
+	if err := lb.UpdateBackends([]config.BackendConfig{a, b}); err != nil {
+		t.Fatalf("UpdateBackends: %v", err)
+	}
+
+	for _, backend := range lb.FindBackends(upstream.URL) {
+		if checker := checkerOf(backend); checker == nil || checker == shared {
+			t.Errorf("%s probed with the checker of the stopped probe", backend.Name)
+		}
+		waitHealthy(t, backend, false)
+	}
+}
+
+func TestHealthCheckJitter(t *testing.T) {
+	tests := []struct {
+		jitter   time.Duration
+		min, max time.Duration
+	}{
+		{jitter: 0, min: 100 * time.Millisecond, max: 100 * time.Millisecond},
+		{jitter: 40 * time.Millisecond, min: 80 * time.Millisecond, max: 120 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		c := health.NewChecker("http://a:80", "/health", health.Config{Interval: 100 * time.Millisecond, Jitter: tt.jitter})
+
+		lowest, highest := time.Duration(1<<62), time.Duration(0)
+		for i := 0; i < 1000; i++ {
+			delay := c.NextDelay()
+			if delay < tt.min || delay > tt.max {
+				t.Fatalf("jitter %v: delay %v outside [%v, %v]", tt.jitter, delay, tt.min, tt.max)
+			}
+			lowest, highest = min(lowest, delay), max(highest, delay)
+		}
+
+		// The delays spread over the whole range
+		if spread := tt.max - tt.min; highest-lowest < spread*9/10 {
+			t.Errorf("jitter %v: delays between %v and %v, want them spread over %v", tt.jitter, lowest, highest, spread)
+		}
+		c.Close()
+	}
+}
+
+func TestHealthCheckProbeSharing(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name   string
+		change func(*config.BackendConfig)
+		shared bool
+	}{
+		{name: "identical checks", change: func(*config.BackendConfig) {}, shared: true},
+		{name: "different group settings", change: func(cfg *config.BackendConfig) { cfg.Weight = 3 }, shared: true},
+		{name: "different path", change: func(cfg *config.BackendConfig) { cfg.HealthCheck.Path = "/ready" }},
+		{name: "different interval", change: func(cfg *config.BackendConfig) { cfg.HealthCheck.Interval = time.Hour }},
+		{name: "different protocol", change: func(cfg *config.BackendConfig) { cfg.HealthCheck.Type = "tcp" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := checkedGroup("a", upstream.URL), checkedGroup("b", upstream.URL)
+			tt.change(&b)
+			lb := newTestLoadBalancer(t, a, b)
+			lb.StartHealthChecks()
+			defer lb.StopHealthChecks()
+
+			backends := lb.FindBackends(upstream.URL)
+			first, second := checkerOf(backends[0]), checkerOf(backends[1])
+			if first == nil || second == nil {
+				t.Fatalf("health checks not running")
+			}
+			probes := 2
+			if tt.shared {
+				probes = 1
+			}
+			if shared := first == second; shared != tt.shared || len(lb.probes) != probes {
+				t.Errorf("shared = %v with %d probes, want shared = %v", shared, len(lb.probes), tt.shared)
+			}
+		})
+	}
+}
+
+func TestHealthCheckHistory(t *testing.T) {
+	var failing atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+
+	cfg := checkedGroup("a", upstream.URL)
+	cfg.HealthCheck.HistorySize = 3
+	lb := newTestLoadBalancer(t, cfg)
+	backend := backendFor(t, lb, upstream.URL)
+	if backend.HealthCheckStats() != nil {
+		t.Errorf("stats reported before any health check ran")
+	}
+
+	lb.StartHealthChecks()
+	defer lb.StopHealthChecks()
+	failing.Store(true)
+	waitHealthy(t, backend, false)
+
+	// Once full, the history keeps the latest probes, oldest first
+	deadline := time.Now().Add(2 * time.Second)
+	var history []map[string]interface{}
+	for {
+		history = backend.HealthCheckStats()["history"].([]map[string]interface{})
+		if len(history) == 3 && history[0]["result"] == "unhealthy" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("history %v, want 3 failed probes", history)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	var previous time.Time
+	for i, probe := range history {
+		at, err := time.Parse(time.RFC3339Nano, probe["time"].(string))
+		if err != nil || at.Before(previous) {
+			t.Errorf("probe %d at %v, after %v", i, probe["time"], previous)
+		}
+		previous = at
+		if probe["status"] != "503" {
+			t.Errorf("probe %d status %v, want 503", i, probe["status"])
+		}
+	}
+}
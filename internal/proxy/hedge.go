@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// hedgeBudgetWindow is the period over which the extra load cap of
+	// hedging is computed
+	hedgeBudgetWindow = 10 * time.Second
+
+	// hedgeLatencySamples is the number of recent response times kept to
+	// compute the hedging delay from a latency percentile
+	hedgeLatencySamples = 1000
+
+	// minHedgeLatencySamples is the number of response times needed before
+	// the percentile replaces the configured delay
+	minHedgeLatencySamples = 20
+)
+
+// hedger decides when the requests of a route are hedged. It tracks the
+// response times of the route to derive the hedging delay and caps the
+// number of hedges to a percentage of the requests.
+type hedger struct {
+	cfg config.HedgeConfig
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	hedges      int
+	samples     []time.Duration // Ring buffer of recent response times
+	nextSample  int
+	stale       bool
+	delay       time.Duration // Cached percentile delay
+}
+
+// newHedger creates a hedger for the given route settings
+func newHedger(cfg config.HedgeConfig) *hedger {
+	return &hedger{
+		cfg:         cfg,
+		windowStart: time.Now(),
+		delay:       cfg.Delay,
+	}
+}
+
+// roll starts a new budget window once the current one has elapsed. Must be
+// called with mu held.
+func (h *hedger) roll(now time.Time) {
+	if now.Sub(h.windowStart) >= hedgeBudgetWindow {
+		h.windowStart = now
+		h.requests = 0
+		h.hedges = 0
+	}
+}
+
+// recordRequest counts a request that may be hedged
+func (h *hedger) recordRequest() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.roll(time.Now())
+	h.requests++
+}
+
+// tryHedge reserves a hedge, returning false if it would exceed the extra
+// load cap
+func (h *hedger) tryHedge() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.roll(time.Now())
+	if float64(h.hedges+1) > float64(h.requests)*h.cfg.MaxExtraLoadPercent/100 {
+		return false
+	}
+	h.hedges++
+	return true
+}
+
+// observe records the response time of a successful request
+func (h *hedger) observe(latency time.Duration) {
+	if h.cfg.Percentile <= 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.samples) < hedgeLatencySamples {
+		h.samples = append(h.samples, latency)
+	} else {
+		h.samples[h.nextSample] = latency
+		h.nextSample = (h.nextSample + 1) % hedgeLatencySamples
+	}
+	h.stale = true
+}
+
+// hedgeDelay returns how long to wait for a response before hedging
+func (h *hedger) hedgeDelay() time.Duration {
+	if h.cfg.Percentile <= 0 {
+		return h.cfg.Delay
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.stale && len(h.samples) >= minHedgeLatencySamples {
+		sorted := append([]time.Duration(nil), h.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		h.delay = sorted[int(float64(len(sorted)-1)*h.cfg.Percentile/100)]
+		h.stale = false
+	}
+	return h.delay
+}
+
+// hedgeResult is the outcome of one copy of a hedged request
+type hedgeResult struct {
+	index   int
+	lease   *Lease
+	resp    *http.Response
+	err     error
+	latency time.Duration
+}
+
+// succeeded reports whether the copy produced a response worth returning
+func (res hedgeResult) succeeded() bool {
+	return res.err == nil && res.resp.StatusCode < 500
+}
+
+// hedged sends the request to the leased backend and, if no response has
+// arrived after the hedging delay or the first copy failed, a second copy to
+// another backend of the group that is not in tried. The first successful
+// response is returned along with the lease it was served under and the
+// other copy is cancelled. tried is returned with the hedge's backend added.
+func (t *upstreamTransport) hedged(req *http.Request, primary *Lease, tried []*Backend) (*Lease, *http.Response, []*Backend, error) {
+	var (
+		results = make(chan hedgeResult, 2)
+		cancels []context.CancelFunc
+		pending int
+	)
+
+	send := func(lease *Lease) {
+		ctx, cancel := context.WithCancel(req.Context())
+		index := len(cancels)
+		cancels = append(cancels, cancel)
+		pending++
+
+		go func() {
+			start := time.Now()
+			resp, err := t.attempt(req.WithContext(ctx), lease)
+			results <- hedgeResult{index: index, lease: lease, resp: resp, err: err, latency: time.Since(start)}
+		}()
+	}
+
+	hedge := func() {
+		if lease := t.hedgeLease(req, tried); lease != nil {
+			tried = append(tried, lease.Backend)
+			send(lease)
+			if t.handler.metrics != nil {
+				t.handler.metrics.RecordHedge(t.config.Name, "sent")
+			}
+		}
+	}
+
+	send(primary)
+
+	timer := time.NewTimer(t.hedge.hedgeDelay())
+	defer timer.Stop()
+
+	var result *hedgeResult
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			hedge()
+
+		case res := <-results:
+			pending--
+			if res.succeeded() {
+				t.hedge.observe(res.latency)
+			}
+
+			switch {
+			case result == nil:
+				result = &res
+			case !result.succeeded() && res.succeeded():
+				// A failed copy only stands if the other one fails too
+				if result.resp != nil {
+					discardResponse(result.resp)
+				}
+				result = &res
+			case res.resp != nil:
+				discardResponse(res.resp)
+			}
+
+			if !result.succeeded() {
+				// Hedge right away when the first copy fails before the
+				// hedging delay
+				if len(cancels) == 1 && timer.Stop() {
+					hedge()
+				}
+				continue
+			}
+
+			if len(cancels) > 1 && t.handler.metrics != nil {
+				outcome := "lost"
+				if result.index > 0 {
+					outcome = "won"
+				}
+				t.handler.metrics.RecordHedge(t.config.Name, outcome)
+			}
+
+			// Release the copy still in flight once it returns
+			if pending > 0 {
+				go drainHedges(results, pending)
+				pending = 0
+			}
+		}
+	}
+
+	// Cancel every other copy
+	for i, cancel := range cancels {
+		if i != result.index {
+			cancel()
+		}
+	}
+
+	if result.resp == nil {
+		cancels[result.index]()
+		return result.lease, nil, tried, result.err
+	}
+
+	// The winning copy's context lives until its body has been relayed
+	wrapLeaseBody(result.resp, cancels[result.index])
+	return result.lease, result.resp, tried, nil
+}
+
+// hedgeLease leases a backend for a hedge, or returns nil if the request may
+// not be hedged
+func (t *upstreamTransport) hedgeLease(req *http.Request, exclude []*Backend) *Lease {
+	if req.Context().Err() != nil || !t.hedge.tryHedge() {
+		return nil
+	}
+
+	lease, err := t.handler.loadBalancer.GetBackendForConfig(t.config.Name, req, exclude...)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"backend_group": t.config.Name,
+			"error":         err.Error(),
+		}).Debug("No backend available to hedge on")
+		return nil
+	}
+	return lease
+}
+
+// drainHedges discards the responses of cancelled hedge copies
+func drainHedges(results <-chan hedgeResult, n int) {
+	for i := 0; i < n; i++ {
+		if res := <-results; res.resp != nil {
+			discardResponse(res.resp)
+		}
+	}
+}
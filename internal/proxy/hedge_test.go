@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+)
+
+// hedgeHandler returns a handler hedging GET /read over the given upstreams
+func hedgeHandler(t *testing.T, hedge config.HedgeConfig, group config.BackendConfig) *Handler {
+	t.Helper()
+
+	hedge.Enabled = true
+	cfg := &config.Config{
+		Backends: []config.BackendConfig{group},
+		Routing:  config.RoutingConfig{Rules: []config.RouteRule{{Path: "/read", Backend: group.Name, Hedge: hedge}}},
+	}
+	router, err := NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+	return NewHandler(router, newTestLoadBalancer(t, group), nil)
+}
+
+// scriptedUpstreams starts n upstreams sharing a handler that is told which
+// request it serves, counting from 1
+func scriptedUpstreams(t *testing.T, n int, serve func(hit int32, w http.ResponseWriter, r *http.Request)) []string {
+	var hits int32
+	urls := make([]string, n)
+	for i := range urls {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serve(atomic.AddInt32(&hits, 1), w, r)
+		}))
+		t.Cleanup(server.Close)
+		urls[i] = server.URL
+	}
+	return urls
+}
+
+// waitClosed fails the test if ch is not closed in time
+func waitClosed(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+
+	select {
+	case <-ch:
+	case <-time.After(2 * time.Second):
+		t.Errorf("%s was not cancelled", what)
+	}
+}
+
+func TestHedgeWins(t *testing.T) {
+	cancelled := make(chan struct{})
+	urls := scriptedUpstreams(t, 2, func(hit int32, w http.ResponseWriter, r *http.Request) {
+		if hit == 1 {
+			<-r.Context().Done()
+			close(cancelled)
+			return
+		}
+		w.Write([]byte("hedge"))
+	})
+	handler := hedgeHandler(t, config.HedgeConfig{Delay: 20 * time.Millisecond, MaxExtraLoadPercent: 100}, testGroup("web", "round_robin", urls...))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/read", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "hedge" {
+		t.Fatalf("response %d %q, want the hedge's", rec.Code, rec.Body.String())
+	}
+	waitClosed(t, cancelled, "slow primary")
+}
+
+func TestHedgePrimaryWins(t *testing.T) {
+	cancelled := make(chan struct{})
+	urls := scriptedUpstreams(t, 2, func(hit int32, w http.ResponseWriter, r *http.Request) {
+		if hit == 2 {
+			<-r.Context().Done()
+			close(cancelled)
+			return
+		}
+		time.Sleep(60 * time.Millisecond)
+		w.Write([]byte("primary"))
+	})
+	handler := hedgeHandler(t, config.HedgeConfig{Delay: 10 * time.Millisecond, MaxExtraLoadPercent: 100}, testGroup("web", "round_robin", urls...))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/read", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "primary" {
+		t.Fatalf("response %d %q, want the primary's", rec.Code, rec.Body.String())
+	}
+	waitClosed(t, cancelled, "losing hedge")
+}
+
+func TestHedgeNotSentForFastResponses(t *testing.T) {
+	var hits int32
+	urls := scriptedUpstreams(t, 2, func(hit int32, w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt32(&hits, hit)
+		w.Write([]byte("ok"))
+	})
+	handler := hedgeHandler(t, config.HedgeConfig{Delay: time.Second, MaxExtraLoadPercent: 100}, testGroup("web", "round_robin", urls...))
+
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/read", nil))
+	}
+	if got := atomic.LoadInt32(&hits); got != 3 {
+		t.Errorf("upstreams received %d requests for 3 fast ones", got)
+	}
+}
+
+func TestHedgeAfterEarlyFailure(t *testing.T) {
+	urls := scriptedUpstreams(t, 2, func(hit int32, w http.ResponseWriter, r *http.Request) {
+		if hit == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("hedge"))
+	})
+	group := testGroup("web", "round_robin", urls...)
+	group.RetryCount = new(int)
+	handler := hedgeHandler(t, config.HedgeConfig{Delay: time.Minute, MaxExtraLoadPercent: 100}, group)
+
+	// The hedge goes out as soon as the primary fails
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/read", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "hedge" {
+		t.Errorf("response %d %q, want the hedge's", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHedgeBackendsNotRetried(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		served = make(map[string]int)
+	)
+	urls := scriptedUpstreams(t, 3, func(hit int32, w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		served[r.Host]++
+		mu.Unlock()
+		if hit <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	retries := 1
+	group := testGroup("web", "round_robin", urls...)
+	group.RetryCount = &retries
+	group.RetryPolicy = config.RetryPolicyConfig{RetryOn: []int{http.StatusServiceUnavailable}, BudgetPercent: 100, MinRetriesPerSecond: 10}
+	handler := hedgeHandler(t, config.HedgeConfig{Delay: time.Minute, MaxExtraLoadPercent: 100}, group)
+
+	// The primary and its hedge fail, so the retry goes to the third target
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/read", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusOK)
+	}
+	for host, n := range served {
+		if n != 1 {
+			t.Errorf("%s received %d copies of the request, want 1", host, n)
+		}
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	h := newHedger(config.HedgeConfig{Enabled: true, Delay: time.Millisecond, MaxExtraLoadPercent: 25})
+	for i := 0; i < 8; i++ {
+		h.recordRequest()
+	}
+
+	hedges := 0
+	for i := 0; i < 5; i++ {
+		if h.tryHedge() {
+			hedges++
+		}
+	}
+	if hedges != 2 {
+		t.Errorf("%d hedges allowed for 8 requests at 25%% extra load, want 2", hedges)
+	}
+}
+
+func TestHedgeDelayPercentile(t *testing.T) {
+	h := newHedger(config.HedgeConfig{Enabled: true, Delay: time.Second, Percentile: 90})
+
+	// The configured delay applies until enough samples were observed
+	for i := 1; i < minHedgeLatencySamples; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	if got := h.hedgeDelay(); got != time.Second {
+		t.Errorf("delay %v with few samples, want %v", got, time.Second)
+	}
+
+	for i := minHedgeLatencySamples; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	if got := h.hedgeDelay(); got != 90*time.Millisecond {
+		t.Errorf("delay %v, want the 90th percentile 90ms", got)
+	}
+}
+
+func TestHedgersAcrossReload(t *testing.T) {
+	group := testGroup("web", "round_robin", "http://a:80")
+	hedge := config.HedgeConfig{Enabled: true, Delay: time.Second, MaxExtraLoadPercent: 10}
+	rules := func(hedge config.HedgeConfig) *Router {
+		router, err := NewRouter(&config.Config{
+			Backends: []config.BackendConfig{group},
+			Routing: config.RoutingConfig{Rules: []config.RouteRule{
+				{Path: "/read", Backend: "web", Hedge: hedge},
+				{Path: "/other", Backend: "web", Hedge: hedge},
+			}},
+		})
+		if err != nil {
+			t.Fatalf("NewRouter: %v", err)
+		}
+		return router
+	}
+	hedgerOf := func(h *Handler) *hedger {
+		match, err := h.router.Load().Match(httptest.NewRequest("GET", "/read", nil))
+		if err != nil {
+			t.Fatalf("Match: %v", err)
+		}
+		return h.hedger(match)
+	}
+
+	h := NewHandler(rules(hedge), newTestLoadBalancer(t, group), nil)
+	first := hedgerOf(h)
+
+	// Reloading the same rules keeps the latency samples of the route
+	h.SetRouter(rules(hedge))
+	if hedgerOf(h) != first {
+		t.Errorf("hedger of an unchanged rule replaced by a reload")
+	}
+
+	// Changed hedging settings take effect, and the hedgers of the rules
+	// that are gone are dropped
+	for i := 1; i <= 5; i++ {
+		changed := hedge
+		changed.Delay = time.Duration(i) * time.Millisecond
+		h.SetRouter(rules(changed))
+
+		if replaced := hedgerOf(h); replaced == first || replaced.cfg.Delay != changed.Delay {
+			t.Fatalf("reload %d: hedger kept the previous settings", i)
+		}
+	}
+	if len(h.hedgers) != 1 {
+		t.Errorf("%d hedgers after the reloads, want only the one of the current rule", len(h.hedgers))
+	}
+}
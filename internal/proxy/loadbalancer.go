@@ -1,10 +1,15 @@
 package proxy
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"math/rand"
+	"math"
 	"net/http"
 	"net/url"
+	"reflect"
+	"regexp"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,23 +22,61 @@ import (
 
 // Backend represents a backend server
 type Backend struct {
-	Name          string
-	URL           string
-	Protocol      string
-	TLSSkipVerify bool
-	Weight        int
-	healthy     int32 // atomic bool
-	checker     *health.Checker
-	mu          sync.RWMutex
-	connections int32 // current connection count for least-connections LB
-}
-
-// IsHealthy returns true if the backend is healthy
+	Name           string
+	Group          string // Name of the backend group
+	URL            string
+	Protocol       string
+	TLSSkipVerify  bool
+	tlsConfig      *tls.Config // nil when the defaults apply
+	Weight         int
+	Tier           string // Priority tier the target belongs to
+	Zone           string
+	Region         string
+	Labels         map[string]string
+	MaxConnections int   // 0 for no limit
+	healthy        int32 // atomic bool, as reported by the health checks
+	override       int32 // atomic healthOverride, set through the admin API
+	overrideUntil  int64 // atomic, unix nanoseconds, 0 when the override does not expire
+	draining       int32 // atomic bool, set from the target config
+	adminDrain     int32 // atomic bool, set through the admin API
+	mu             sync.RWMutex
+	connections    int32 // requests currently in flight, see Lease
+	transport      http.RoundTripper
+	transportOnce  sync.Once
+	outlier        outlierState
+	breaker        *circuitBreaker // nil when disabled
+
+	events   *EventBus           // Receives the backend's lifecycle events
+	target   config.TargetConfig // Settings the backend was built from
+	probeKey string              // Identifies the health checks of the target, see probeKey
+	probe    *probe              // Running health checks, guarded by the load balancer's mu
+
+	checker    *health.Checker        // Checker of the probe feeding the backend, guarded by mu
+	newChecker func() *health.Checker // nil when health checks are disabled
+
+	slowStart      config.SlowStartConfig
+	slowStartSince int64 // atomic, unix nanoseconds, 0 when not ramping up
+
+	degraded       int32   // atomic bool, the health checks report the target degraded
+	degradedWeight float64 // Fraction of its weight a degraded backend keeps
+
+	// Peak EWMA of response latency, guarded by mu
+	latencyEWMA  float64 // nanoseconds
+	lastObserved time.Time
+	ewmaDecay    time.Duration
+}
+
+// IsHealthy returns true if the backend is healthy. A manual health override
+// takes precedence over the health checks.
 func (b *Backend) IsHealthy() bool {
+	if override := b.healthOverride(); override != overrideNone {
+		return override == overrideHealthy
+	}
 	return atomic.LoadInt32(&b.healthy) == 1
 }
 
-// SetHealthy sets the health status of the backend
+// SetHealthy sets the health status of the backend as reported by its health
+// checks
 func (b *Backend) SetHealthy(healthy bool) {
 	value := int32(0)
 	if healthy {
@@ -42,6 +85,73 @@ func (b *Backend) SetHealthy(healthy bool) {
 	atomic.StoreInt32(&b.healthy, value)
 }
 
+// IsDraining returns true if the backend is being drained
+func (b *Backend) IsDraining() bool {
+	return atomic.LoadInt32(&b.draining) == 1 || atomic.LoadInt32(&b.adminDrain) == 1
+}
+
+// SetDraining sets whether the backend is drained. A drained backend keeps
+// serving the requests it has in flight but is not assigned new ones.
+func (b *Backend) SetDraining(draining bool) {
+	value := int32(0)
+	if draining {
+		value = 1
+	}
+	atomic.StoreInt32(&b.draining, value)
+}
+
+// inherit carries the health, admin state and latency of the backend previously serving
+// the same target over to a backend that replaces it
+func (b *Backend) inherit(previous *Backend) {
+	atomic.StoreInt32(&b.healthy, atomic.LoadInt32(&previous.healthy))
+	atomic.StoreInt32(&b.degraded, atomic.LoadInt32(&previous.degraded))
+	atomic.StoreInt32(&b.adminDrain, atomic.LoadInt32(&previous.adminDrain))
+	atomic.StoreInt64(&b.overrideUntil, atomic.LoadInt64(&previous.overrideUntil))
+	atomic.StoreInt32(&b.override, atomic.LoadInt32(&previous.override))
+
+	previous.mu.RLock()
+	latency, observed := previous.latencyEWMA, previous.lastObserved
+	previous.mu.RUnlock()
+
+	b.mu.Lock()
+	b.latencyEWMA, b.lastObserved = latency, observed
+	b.mu.Unlock()
+}
+
+// setAdminDrain sets whether the backend was drained through the admin API
+// and reports whether that changed. It is kept separately from the target
+// config so reloads do not undo it.
+func (b *Backend) setAdminDrain(draining bool) bool {
+	value := int32(0)
+	if draining {
+		value = 1
+	}
+	return atomic.SwapInt32(&b.adminDrain, value) != value
+}
+
+// IsAvailable returns true if the backend may be assigned new requests
+func (b *Backend) IsAvailable() bool {
+	return b.IsHealthy() && !b.IsDraining() && !b.IsEjected()
+}
+
+// hasCapacity returns true if the backend is below its connection limit
+func (b *Backend) hasCapacity() bool {
+	return b.MaxConnections <= 0 || int(b.GetConnections()) < b.MaxConnections
+}
+
+// ReportResult feeds the outcome of a request into the backend's passive
+// health tracking. err is set for transport failures, statusCode otherwise.
+func (b *Backend) ReportResult(statusCode int, err error, latency time.Duration) {
+	// Requests abandoned by the client say nothing about the backend
+	if errors.Is(err, context.Canceled) {
+		b.breaker.abandon()
+		return
+	}
+
+	b.breaker.record(err != nil || statusCode >= 500)
+	b.outlier.report(b, statusCode, err, latency)
+}
+
 // IncrementConnections increments the connection count
 func (b *Backend) IncrementConnections() {
 	atomic.AddInt32(&b.connections, 1)
@@ -57,16 +167,59 @@ func (b *Backend) GetConnections() int32 {
 	return atomic.LoadInt32(&b.connections)
 }
 
+// ObserveLatency feeds a response time into the backend's peak EWMA. Higher
+// samples replace the average immediately so latency spikes are punished at
+// once, lower samples are blended in with a weight that decays over time.
+func (b *Backend) ObserveLatency(latency time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	sample := float64(latency)
+
+	if b.lastObserved.IsZero() || sample > b.latencyEWMA {
+		b.latencyEWMA = sample
+	} else {
+		decay := b.ewmaDecay
+		if decay <= 0 {
+			decay = defaultEWMADecay
+		}
+		w := math.Exp(-float64(now.Sub(b.lastObserved)) / float64(decay))
+		b.latencyEWMA = b.latencyEWMA*w + sample*(1-w)
+	}
+	b.lastObserved = now
+}
+
+// LatencyEWMA returns the current peak EWMA of the backend's response time
+func (b *Backend) LatencyEWMA() time.Duration {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return time.Duration(b.latencyEWMA)
+}
+
+// backendGroup holds the backends of a single backend config together with
+// the balancing strategy used to pick between them
+type backendGroup struct {
+	name     string
+	config   config.BackendConfig
+	backends []*Backend
+	tiers    [][]*Backend // Backends by priority, highest first
+	balancer Balancer
+	outlier  *outlierDetector // nil when disabled
+	drain    []bool           // Drain flags of the targets of backends, applied by activate
+}
+
 // LoadBalancer manages backend selection and health checking
 type LoadBalancer struct {
-	backends        []*Backend
-	backendsByName  map[string][]*Backend // Group backends by config name
-	algorithm       string
-	roundRobinIndex map[string]int32 // Per-backend-config round-robin index
-	mu              sync.RWMutex
-	healthCheckers  map[string]*health.Checker
-	stopHealthCheck chan struct{}
-	metrics         *telemetry.Metrics
+	backends []*Backend
+	groups   map[string]*backendGroup // Backends grouped by config name
+	mu       sync.RWMutex
+	retired  []*Backend        // Removed backends still finishing requests
+	checking bool              // Health checks are running
+	probes   map[string]*probe // Running health checks by probe key
+	metrics  *telemetry.Metrics
+	events   *EventBus
+	locality config.LocalityConfig // Where this proxy runs
 }
 
 // NewLoadBalancer creates a new load balancer
@@ -76,344 +229,793 @@ func NewLoadBalancer(configs []config.BackendConfig, metrics *telemetry.Metrics)
 	}
 
 	lb := &LoadBalancer{
-		backends:        make([]*Backend, 0, len(configs)),
-		backendsByName:  make(map[string][]*Backend),
-		roundRobinIndex: make(map[string]int32),
-		healthCheckers:  make(map[string]*health.Checker),
-		stopHealthCheck: make(chan struct{}),
-		metrics:         metrics,
+		groups:  make(map[string]*backendGroup),
+		probes:  make(map[string]*probe),
+		metrics: metrics,
+		events:  NewEventBus(metrics),
 	}
 
-	// Create backends
 	for _, cfg := range configs {
-		configBackends := make([]*Backend, 0, len(cfg.Targets))
+		group, err := lb.buildGroup(cfg, nil)
+		if err != nil {
+			return nil, err
+		}
+		group.activate()
+		lb.groups[cfg.Name] = group
+		lb.backends = append(lb.backends, group.backends...)
+	}
 
-		for _, target := range cfg.Targets {
-			// Validate URL
-			if _, err := url.Parse(target); err != nil {
-				return nil, fmt.Errorf("invalid backend URL %s: %w", target, err)
-			}
+	for _, group := range lb.groups {
+		logrus.WithFields(logrus.Fields{
+			"group":     group.name,
+			"backends":  len(group.backends),
+			"algorithm": group.config.LoadBalancer,
+		}).Info("Backend group initialized")
+	}
+
+	logrus.WithField("backends", len(lb.backends)).Info("Load balancer initialized")
+
+	return lb, nil
+}
 
-			backend := &Backend{
-				Name:          fmt.Sprintf("%s-%s", cfg.Name, target),
-				URL:           target,
-				Protocol:      cfg.Protocol,
-				TLSSkipVerify: cfg.TLSSkipVerify,
-				Weight:        cfg.Weight,
+// buildGroup creates the backends and balancer of a group. Backends of the
+// previous version of the group are carried over, with their connection
+// counts, health and passive health state, for targets that are kept.
+func (lb *LoadBalancer) buildGroup(cfg config.BackendConfig, previous *backendGroup) (*backendGroup, error) {
+	group := &backendGroup{
+		name:     cfg.Name,
+		config:   cfg,
+		backends: make([]*Backend, 0, len(cfg.Targets)),
+	}
+
+	if previous != nil && sameBalancing(previous.config, cfg) {
+		group.balancer = previous.balancer
+	} else {
+		group.balancer = newBalancer(cfg)
+	}
+
+	reuse := previous != nil && sameBackendSettings(previous.config, cfg)
+
+	// The primary targets come first, followed by the lower priority tiers
+	tiers := append([]config.TierConfig{{Name: "primary", Targets: cfg.Targets}}, cfg.Tiers...)
+	for _, tier := range tiers {
+		members := make([]*Backend, 0, len(tier.Targets))
+		for _, target := range tier.Targets {
+			var backend *Backend
+			if reuse {
+				backend = previous.reusable(tier.Name, target)
 			}
+			if backend == nil {
+				var err error
+				if backend, err = lb.newBackend(cfg, tier.Name, target); err != nil {
+					return nil, err
+				}
 
-			// Initially mark as healthy
-			backend.SetHealthy(true)
-
-			// Create health checker if enabled
-			if cfg.HealthCheck.Enabled {
-				checker := health.NewChecker(target, cfg.HealthCheck.Path, health.Config{
-					Interval:           cfg.HealthCheck.Interval,
-					Timeout:            cfg.HealthCheck.Timeout,
-					HealthyThreshold:   cfg.HealthCheck.HealthyThreshold,
-					UnhealthyThreshold: cfg.HealthCheck.UnhealthyThreshold,
-				})
-				backend.checker = checker
-				lb.healthCheckers[backend.Name] = checker
+				if previous != nil {
+					if old := targetBackend(previous.backends, target.URL); old != nil {
+						// Settings changed; keep what is known about the target
+						backend.inherit(old)
+					} else {
+						// Targets added to a running group get their traffic
+						// ramped up
+						backend.beginSlowStart()
+					}
+				}
 			}
+			group.backends = append(group.backends, backend)
+			group.drain = append(group.drain, target.Drain)
+			members = append(members, backend)
+		}
+		group.tiers = append(group.tiers, members)
+	}
 
-			lb.backends = append(lb.backends, backend)
-			configBackends = append(configBackends, backend)
+	if cfg.OutlierDetection.Enabled {
+		if reuse && previous.outlier != nil {
+			// Handed the new backends by activate
+			group.outlier = previous.outlier
+		} else {
+			group.outlier = newOutlierDetector(cfg.OutlierDetection, group.backends, lb.metrics)
 		}
+	}
+
+	return group, nil
+}
+
+// newBackend creates the backend of a target
+func (lb *LoadBalancer) newBackend(cfg config.BackendConfig, tier string, target config.TargetConfig) (*Backend, error) {
+	// Validate URL
+	if _, err := url.Parse(target.URL); err != nil {
+		return nil, fmt.Errorf("invalid backend URL %s: %w", target.URL, err)
+	}
+
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("backend %s: %w", cfg.Name, err)
+	}
+
+	backend := &Backend{
+		Name:           fmt.Sprintf("%s-%s", cfg.Name, target.URL),
+		Group:          cfg.Name,
+		URL:            target.URL,
+		Protocol:       cfg.Protocol,
+		TLSSkipVerify:  cfg.TLSSkipVerify,
+		tlsConfig:      tlsConfig,
+		Weight:         target.Weight,
+		Tier:           tier,
+		Zone:           target.Zone,
+		Region:         target.Region,
+		Labels:         target.Labels,
+		MaxConnections: target.MaxConnections,
+		target:         target,
+		probeKey:       probeKey(cfg, target.URL),
+		events:         lb.events,
+		ewmaDecay:      cfg.EWMADecay,
+		slowStart:      cfg.SlowStart,
+		degradedWeight: cfg.HealthCheck.DegradedWeightPercent / 100,
+	}
+
+	if backend.Weight == 0 {
+		backend.Weight = cfg.Weight
+	}
+
+	// Initially mark as healthy
+	backend.SetHealthy(true)
 
-		// Group backends by config name
-		lb.backendsByName[cfg.Name] = configBackends
-		lb.roundRobinIndex[cfg.Name] = 0
+	if cfg.CircuitBreaker.Enabled {
+		backend.breaker = newCircuitBreaker(cfg.CircuitBreaker, backend.Name, lb.metrics)
+	}
 
-		// Use the load balancer algorithm from the first backend config
-		// (in a real implementation, you might want this at the global level)
-		if lb.algorithm == "" {
-			lb.algorithm = cfg.LoadBalancer
+	// Create health checker if enabled
+	if cfg.HealthCheck.Enabled {
+		expect, err := healthExpect(cfg.HealthCheck.Expect)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %w", cfg.Name, err)
+		}
+
+		// Stopped probes close their checker, so each probe gets a new one
+		checkerConfig := health.Config{
+			Type:               cfg.HealthCheck.Type,
+			TLSConfig:          tlsConfig,
+			GRPCService:        cfg.HealthCheck.GRPCService,
+			GRPCTLS:            cfg.Protocol == "https",
+			Method:             cfg.HealthCheck.Method,
+			Host:               cfg.HealthCheck.Host,
+			Headers:            cfg.HealthCheck.Headers,
+			Expect:             expect,
+			Interval:           cfg.HealthCheck.Interval,
+			Timeout:            cfg.HealthCheck.Timeout,
+			HealthyThreshold:   cfg.HealthCheck.HealthyThreshold,
+			UnhealthyThreshold: cfg.HealthCheck.UnhealthyThreshold,
+			Jitter:             cfg.HealthCheck.Jitter,
+			HistorySize:        cfg.HealthCheck.HistorySize,
+		}
+		backend.newChecker = func() *health.Checker {
+			return health.NewChecker(target.URL, cfg.HealthCheck.Path, checkerConfig)
 		}
 	}
 
-	logrus.WithFields(logrus.Fields{
-		"backends":  len(lb.backends),
-		"algorithm": lb.algorithm,
-	}).Info("Load balancer initialized")
+	return backend, nil
+}
 
-	return lb, nil
+// healthExpect compiles the response assertions of a health check
+func healthExpect(cfg config.HealthExpectConfig) (health.Expect, error) {
+	expect := health.Expect{
+		BodyContains:   cfg.BodyContains,
+		JSONPath:       cfg.JSONPath,
+		JSONValues:     cfg.JSONValues,
+		DegradedValues: cfg.DegradedValues,
+	}
+
+	var err error
+	if expect.Status, err = health.ParseStatusRanges(cfg.Status); err != nil {
+		return expect, err
+	}
+	if expect.DegradedStatus, err = health.ParseStatusRanges(cfg.DegradedStatus); err != nil {
+		return expect, err
+	}
+	if cfg.BodyRegex != "" {
+		if expect.BodyRegex, err = regexp.Compile(cfg.BodyRegex); err != nil {
+			return expect, fmt.Errorf("invalid health check body regex: %w", err)
+		}
+	}
+	return expect, nil
 }
 
-// GetBackendForConfig selects a backend for a specific backend config name
-func (lb *LoadBalancer) GetBackendForConfig(configName string) *Backend {
-	lb.mu.RLock()
-	defer lb.mu.RUnlock()
+// reusable returns the backend of the group that can serve the target
+// unchanged, or nil if the target is new or its settings changed. Draining
+// is not a setting of the backend and may differ.
+func (g *backendGroup) reusable(tier string, target config.TargetConfig) *Backend {
+	for _, backend := range g.backends {
+		if backend.URL != target.URL || backend.Tier != tier {
+			continue
+		}
 
-	backends, ok := lb.backendsByName[configName]
-	if !ok || len(backends) == 0 {
-		return nil
+		current := backend.target
+		current.Drain = target.Drain
+		if reflect.DeepEqual(current, target) {
+			return backend
+		}
 	}
+	return nil
+}
 
-	healthyBackends := make([]*Backend, 0, len(backends))
-	for _, backend := range backends {
-		if backend.IsHealthy() {
-			healthyBackends = append(healthyBackends, backend)
+// sameBackendSettings reports whether two configs of a group create their
+// backends the same way, so that existing backends can be kept
+func sameBackendSettings(a, b config.BackendConfig) bool {
+	return a.Protocol == b.Protocol &&
+		a.TLSSkipVerify == b.TLSSkipVerify &&
+		a.TLSCAFile == b.TLSCAFile &&
+		a.Weight == b.Weight &&
+		a.EWMADecay == b.EWMADecay &&
+		reflect.DeepEqual(a.HealthCheck, b.HealthCheck) &&
+		a.CircuitBreaker == b.CircuitBreaker &&
+		a.OutlierDetection == b.OutlierDetection &&
+		a.SlowStart == b.SlowStart
+}
+
+// replaceGroup swaps in a new version of a group, retiring the backends that
+// were dropped and starting the health checks of new backends. Must be
+// called with mu held.
+func (lb *LoadBalancer) replaceGroup(old, group *backendGroup) {
+	backends := make([]*Backend, 0, len(lb.backends)+len(group.backends))
+	inserted := false
+	for _, backend := range lb.backends {
+		if old == nil || !containsBackend(old.backends, backend) {
+			backends = append(backends, backend)
+			continue
+		}
+		if !inserted {
+			backends = append(backends, group.backends...)
+			inserted = true
 		}
 	}
+	if !inserted {
+		backends = append(backends, group.backends...)
+	}
 
-	if len(healthyBackends) == 0 {
-		return nil
+	// New backends join the probes of the backends they replace before
+	// those are stopped
+	if lb.checking {
+		for _, backend := range group.backends {
+			lb.startHealthCheck(backend)
+		}
 	}
+	if old != nil {
+		lb.retireBackends(old.backends, group.backends)
+		lb.publishAdded(old.backends, group.backends)
+	} else {
+		lb.publishAdded(nil, group.backends)
+	}
+
+	group.activate()
+	lb.backends = backends
+	lb.groups[group.name] = group
+}
 
-	switch lb.algorithm {
-	case "round_robin":
-		return lb.roundRobinForConfig(configName, healthyBackends)
-	case "least_connections":
-		return lb.leastConnections(healthyBackends)
-	case "weighted":
-		return lb.weighted(healthyBackends)
-	default:
-		return lb.roundRobinForConfig(configName, healthyBackends)
+// activate puts a group into service. Backends carried over from the
+// previous version of the group are shared with it, so they are only
+// changed here, once every group of a configuration has been built: they
+// take the drain flags of their targets and are handed to the outlier
+// detector and the balancer, if it tracks them.
+func (g *backendGroup) activate() {
+	for i, backend := range g.backends {
+		backend.SetDraining(g.drain[i])
+	}
+	if g.outlier != nil {
+		g.outlier.setBackends(g.backends)
+	}
+	if balancer, ok := g.balancer.(groupBalancer); ok {
+		balancer.setBackends(g.backends)
 	}
 }
 
-// GetBackend selects a backend using the configured algorithm
-func (lb *LoadBalancer) GetBackend(r *http.Request) *Backend {
-	lb.mu.RLock()
-	defer lb.mu.RUnlock()
+// retireBackends drains the backends of previous that are not part of
+// current. They stay reachable through the leases of the requests they have
+// in flight and are dropped once those completed. Must be called with mu held.
+func (lb *LoadBalancer) retireBackends(previous, current []*Backend) {
+	for _, backend := range previous {
+		if containsBackend(current, backend) {
+			continue
+		}
 
-	healthyBackends := lb.getHealthyBackends()
-	if len(healthyBackends) == 0 {
-		return nil
+		lb.stopHealthCheck(backend)
+		backend.SetDraining(true)
+		lb.retired = append(lb.retired, backend)
+		go lb.awaitDrained(backend)
+
+		// Backends recreated for a changed config are not reported
+		if !hasBackendNamed(current, backend.Name) {
+			backend.publish(EventBackendRemoved, "")
+		}
 	}
+}
 
-	switch lb.algorithm {
-	case "round_robin":
-		return lb.roundRobinForConfig("default", healthyBackends)
-	case "least_connections":
-		return lb.leastConnections(healthyBackends)
-	case "weighted":
-		return lb.weighted(healthyBackends)
-	default:
-		return lb.roundRobinForConfig("default", healthyBackends)
+// publishAdded reports the backends of current that have no counterpart in
+// previous as added
+func (lb *LoadBalancer) publishAdded(previous, current []*Backend) {
+	for _, backend := range current {
+		if !hasBackendNamed(previous, backend.Name) {
+			backend.publish(EventBackendAdded, "")
+		}
 	}
 }
 
-// getHealthyBackends returns only healthy backends
-func (lb *LoadBalancer) getHealthyBackends() []*Backend {
-	var healthy []*Backend
-	for _, backend := range lb.backends {
-		if backend.IsHealthy() {
-			healthy = append(healthy, backend)
+// hasBackendNamed reports whether a backend with the given name is in the
+// list
+func hasBackendNamed(backends []*Backend, name string) bool {
+	for _, b := range backends {
+		if b.Name == name {
+			return true
 		}
 	}
-	return healthy
+	return false
 }
 
-// roundRobinForConfig implements round-robin load balancing for a specific config
-func (lb *LoadBalancer) roundRobinForConfig(configName string, backends []*Backend) *Backend {
-	if len(backends) == 0 {
-		return nil
+// awaitDrained waits for the in-flight requests of a retired backend to
+// complete before releasing it
+func (lb *LoadBalancer) awaitDrained(backend *Backend) {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for backend.GetConnections() > 0 {
+		<-ticker.C
+	}
+	backend.closeIdleConnections()
+
+	lb.mu.Lock()
+	for i, retired := range lb.retired {
+		if retired == backend {
+			lb.retired = append(lb.retired[:i], lb.retired[i+1:]...)
+			break
+		}
+	}
+	lb.mu.Unlock()
+
+	logrus.WithField("backend", backend.Name).Info("Removed backend drained")
+	backend.publish(EventBackendDrained, "removed")
+}
+
+// drainPollInterval is how often a removed backend is checked for requests
+// still in flight
+const drainPollInterval = 100 * time.Millisecond
+
+// ErrNoHealthyBackends is returned when a group has no backend able to take
+// a request
+var ErrNoHealthyBackends = errors.New("no healthy backends available")
+
+// Lease ties a request to the backend selected for it. The backend's
+// connection count includes the request until Release is called, so
+// least-connections selection and status reporting see real in-flight load.
+type Lease struct {
+	Backend  *Backend
+	Sticky   bool // Backend was chosen from the request's session affinity
+	released int32
+}
+
+// Release returns the lease. It is safe to call more than once.
+func (l *Lease) Release() {
+	if atomic.CompareAndSwapInt32(&l.released, 0, 1) {
+		l.Backend.DecrementConnections()
 	}
+}
+
+// GetBackendForConfig selects a backend for a specific backend config name
+// using the balancing strategy of that group, skipping any excluded backends.
+// The caller must release the returned lease once the request has completed.
+func (lb *LoadBalancer) GetBackendForConfig(configName string, r *http.Request, exclude ...*Backend) (*Lease, error) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
 
-	// Get current index for this config
-	currentIndex, ok := lb.roundRobinIndex[configName]
+	return lb.selectBackend(configName, r, exclude, nil)
+}
+
+// selectBackend picks a backend of a group, spilling over to lower priority
+// tiers and then to the failover group as the higher tiers lose their
+// healthy backends. visited holds the groups already tried along the
+// failover chain. Must be called with mu held.
+func (lb *LoadBalancer) selectBackend(configName string, r *http.Request, exclude []*Backend, visited map[string]bool) (*Lease, error) {
+	group, ok := lb.groups[configName]
 	if !ok {
-		currentIndex = 0
+		return nil, fmt.Errorf("backend group not found: %s", configName)
 	}
 
-	next := atomic.AddInt32(&currentIndex, 1)
-	index := int(next-1) % len(backends)
-	backend := backends[index]
+	// Requests pinned to a backend bypass the balancing algorithm while that
+	// backend is available
+	if sticky := group.config.StickySession; sticky.Enabled {
+		if pinned, ok := stickyBackend(sticky, r, group.backends); ok && pinned != nil && !containsBackend(exclude, pinned) {
+			if pinned.IsAvailable() && pinned.hasCapacity() {
+				if _, err := pinned.breaker.tryAcquire(pinned.GetConnections()); err == nil {
+					return lease(pinned, true), nil
+				}
+			}
+			// Sessions of a drained backend always move on to another one
+			if sticky.Fallback == "fail" && !pinned.IsDraining() {
+				return nil, ErrStickyBackendUnavailable
+			}
+		}
+	}
 
-	// Update the index
-	lb.roundRobinIndex[configName] = next
+	var rejected rejection
 
-	backend.IncrementConnections()
-	go func() {
-		// Simulate connection cleanup after request
-		time.Sleep(100 * time.Millisecond)
-		backend.DecrementConnections()
-	}()
+	// Serve from the first tier that is still healthy enough
+	threshold := group.config.FailoverThreshold / 100
+	for i, tier := range group.tiers {
+		if healthyFraction(tier) < threshold {
+			continue
+		}
+		if backend := group.pick(r, tier, exclude, lb.locality, &rejected); backend != nil {
+			if i > 0 {
+				logrus.WithFields(logrus.Fields{
+					"group":   configName,
+					"tier":    backend.Tier,
+					"backend": backend.Name,
+				}).Debug("Request spilled over to lower priority tier")
+			}
+			return lease(backend, false), nil
+		}
+	}
 
-	return backend
+	if failover := group.config.FailoverBackend; failover != "" && !visited[failover] {
+		if visited == nil {
+			visited = make(map[string]bool)
+		}
+		visited[configName] = true
+
+		if l, err := lb.selectBackend(failover, r, exclude, visited); err == nil {
+			logrus.WithFields(logrus.Fields{
+				"group":    configName,
+				"failover": failover,
+				"backend":  l.Backend.Name,
+			}).Debug("Request failed over to backup group")
+			return l, nil
+		}
+	}
+
+	// Nothing is healthy enough; make do with whatever is left
+	if threshold > 0 {
+		for _, tier := range group.tiers {
+			if backend := group.pick(r, tier, exclude, lb.locality, &rejected); backend != nil {
+				return lease(backend, false), nil
+			}
+		}
+	}
+
+	if err := rejected.err(group.name); err != nil {
+		return nil, err
+	}
+	return nil, ErrNoHealthyBackends
 }
 
-// roundRobin implements round-robin load balancing (deprecated, use roundRobinForConfig)
-func (lb *LoadBalancer) roundRobin(backends []*Backend) *Backend {
-	return lb.roundRobinForConfig("default", backends)
+// rejection collects why backends that are otherwise available turned a
+// request away
+type rejection struct {
+	circuitOpen bool
+	retryAfter  time.Duration // Earliest time an open circuit accepts requests again
+	limited     bool          // A backend was at its concurrent request limit
 }
 
-// leastConnections implements least-connections load balancing
-func (lb *LoadBalancer) leastConnections(backends []*Backend) *Backend {
-	if len(backends) == 0 {
-		return nil
+// add records that a backend's breaker rejected a request with err
+func (r *rejection) add(err error, wait time.Duration) {
+	if errors.Is(err, ErrConcurrencyLimit) {
+		r.limited = true
+		return
+	}
+	if !r.circuitOpen || wait < r.retryAfter {
+		r.retryAfter = wait
 	}
+	r.circuitOpen = true
+}
 
-	var selected *Backend
-	minConnections := int32(-1)
+// err returns the error describing the rejections, nil if there were none.
+// Open circuits take precedence since they say when to come back.
+func (r *rejection) err(group string) error {
+	switch {
+	case r.circuitOpen:
+		return &CircuitOpenError{Group: group, RetryAfter: r.retryAfter}
+	case r.limited:
+		return fmt.Errorf("%w for backend group %s", ErrConcurrencyLimit, group)
+	}
+	return nil
+}
 
-	for _, backend := range backends {
-		connections := backend.GetConnections()
-		if minConnections == -1 || connections < minConnections {
-			minConnections = connections
-			selected = backend
+// pick runs the balancer over the backends of a tier that can take a
+// request, preferring those close to the proxy's locality. The picked
+// backend's breaker is acquired for the request. Backends turned away by
+// their breaker are recorded in rejected.
+func (g *backendGroup) pick(r *http.Request, tier []*Backend, exclude []*Backend, locality config.LocalityConfig, rejected *rejection) *Backend {
+	candidates := make([]*Backend, 0, len(tier))
+	for _, backend := range tier {
+		if !backend.IsAvailable() || !backend.hasCapacity() || containsBackend(exclude, backend) {
+			continue
+		}
+
+		if wait, err := backend.breaker.check(backend.GetConnections()); err != nil {
+			rejected.add(err, wait)
+			continue
 		}
+
+		candidates = append(candidates, backend)
 	}
 
-	if selected != nil {
-		selected.IncrementConnections()
-		go func() {
-			// Simulate connection cleanup after request
-			time.Sleep(100 * time.Millisecond)
-			selected.DecrementConnections()
-		}()
+	if g.config.LocalityRouting.Enabled {
+		candidates = preferLocal(g.config.LocalityRouting, locality, tier, candidates)
 	}
 
-	return selected
+	// Concurrent requests may take the last probe slot of a half-open
+	// breaker between the check and the pick; try the others then
+	for len(candidates) > 0 {
+		backend := g.balancer.Next(r, candidates)
+		if backend == nil {
+			return nil
+		}
+
+		wait, err := backend.breaker.tryAcquire(backend.GetConnections())
+		if err == nil {
+			return backend
+		}
+		rejected.add(err, wait)
+		candidates = removeBackend(candidates, backend)
+	}
+	return nil
 }
 
-// weighted implements weighted load balancing
-func (lb *LoadBalancer) weighted(backends []*Backend) *Backend {
-	if len(backends) == 0 {
-		return nil
+// removeBackend returns the backends without the given one, leaving the
+// original slice untouched
+func removeBackend(backends []*Backend, backend *Backend) []*Backend {
+	rest := make([]*Backend, 0, len(backends))
+	for _, b := range backends {
+		if b != backend {
+			rest = append(rest, b)
+		}
 	}
+	return rest
+}
 
-	// Calculate total weight
-	totalWeight := 0
-	for _, backend := range backends {
-		totalWeight += backend.Weight
+// healthyFraction returns the share of the backends that are available
+func healthyFraction(backends []*Backend) float64 {
+	if len(backends) == 0 {
+		return 0
 	}
 
-	if totalWeight == 0 {
-		return lb.roundRobin(backends) // Fallback to round-robin
+	healthy := 0
+	for _, backend := range backends {
+		if backend.IsAvailable() {
+			healthy++
+		}
 	}
+	return float64(healthy) / float64(len(backends))
+}
 
-	// Generate random number
-	random := rand.Intn(totalWeight)
+// lease assigns a request to a backend whose breaker has been acquired
+func lease(backend *Backend, sticky bool) *Lease {
+	backend.IncrementConnections()
+	return &Lease{Backend: backend, Sticky: sticky}
+}
 
-	// Select backend based on weight
-	currentWeight := 0
-	for _, backend := range backends {
-		currentWeight += backend.Weight
-		if random < currentWeight {
-			backend.IncrementConnections()
-			go func() {
-				// Simulate connection cleanup after request
-				time.Sleep(100 * time.Millisecond)
-				backend.DecrementConnections()
-			}()
-			return backend
+// containsBackend reports whether backend is in the list
+func containsBackend(backends []*Backend, backend *Backend) bool {
+	for _, b := range backends {
+		if b == backend {
+			return true
 		}
 	}
+	return false
+}
 
-	return backends[0] // Fallback
+// targetBackend returns the backend pointing at the given target, or nil if
+// there is none
+func targetBackend(backends []*Backend, target string) *Backend {
+	for _, b := range backends {
+		if b.URL == target {
+			return b
+		}
+	}
+	return nil
 }
 
 // StartHealthChecks starts health checking for all backends
 func (lb *LoadBalancer) StartHealthChecks() {
-	for name, checker := range lb.healthCheckers {
-		go func(n string, c *health.Checker) {
-			logrus.WithField("backend", n).Info("Starting health checks")
-
-			ticker := time.NewTicker(c.GetInterval())
-			defer ticker.Stop()
-
-			for {
-				select {
-				case <-ticker.C:
-					healthy := c.Check()
-
-					// Find the backend and update its health status
-					lb.mu.RLock()
-					for _, backend := range lb.backends {
-						if backend.Name == n {
-							wasHealthy := backend.IsHealthy()
-							backend.SetHealthy(healthy)
-
-							// Update Prometheus metric
-							if lb.metrics != nil {
-								lb.metrics.UpdateBackendHealth(n, healthy)
-							}
-
-							if wasHealthy != healthy {
-								logrus.WithFields(logrus.Fields{
-									"backend": n,
-									"healthy": healthy,
-								}).Info("Backend health status changed")
-							}
-							break
-						}
-					}
-					lb.mu.RUnlock()
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
 
-				case <-lb.stopHealthCheck:
-					logrus.WithField("backend", n).Info("Stopping health checks")
-					return
-				}
-			}
-		}(name, checker)
+	lb.checking = true
+	for _, backend := range lb.backends {
+		lb.startHealthCheck(backend)
 	}
 }
 
 // StopHealthChecks stops health checking
 func (lb *LoadBalancer) StopHealthChecks() {
-	close(lb.stopHealthCheck)
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	lb.checking = false
+	for _, backend := range lb.backends {
+		lb.stopHealthCheck(backend)
+	}
 }
 
-// UpdateBackends updates the backend configuration
-func (lb *LoadBalancer) UpdateBackends(configs []config.BackendConfig) error {
+// SetLocality sets the zone and region this proxy runs in, used by groups
+// with locality routing enabled
+func (lb *LoadBalancer) SetLocality(locality config.LocalityConfig) {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
 
-	// Stop existing health checks
-	lb.StopHealthChecks()
+	lb.locality = locality
+}
 
-	// Clear existing backends
-	lb.backends = lb.backends[:0]
-	lb.backendsByName = make(map[string][]*Backend)
-	lb.roundRobinIndex = make(map[string]int32)
-	lb.healthCheckers = make(map[string]*health.Checker)
-	lb.stopHealthCheck = make(chan struct{})
+// SetGroupTargets replaces the targets of a single backend group. Backends
+// of kept targets carry over their state, so only added and removed targets
+// are affected.
+func (lb *LoadBalancer) SetGroupTargets(name string, targets []config.TargetConfig) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
 
-	// Add new backends (similar to NewLoadBalancer)
-	for _, cfg := range configs {
-		configBackends := make([]*Backend, 0, len(cfg.Targets))
+	old, ok := lb.groups[name]
+	if !ok {
+		return fmt.Errorf("backend group not found: %s", name)
+	}
 
-		for _, target := range cfg.Targets {
-			if _, err := url.Parse(target); err != nil {
-				return fmt.Errorf("invalid backend URL %s: %w", target, err)
-			}
+	cfg := old.config
+	cfg.Targets = targets
 
-			backend := &Backend{
-				Name:          fmt.Sprintf("%s-%s", cfg.Name, target),
-				URL:           target,
-				Protocol:      cfg.Protocol,
-				TLSSkipVerify: cfg.TLSSkipVerify,
-				Weight:        cfg.Weight,
-			}
+	group, err := lb.buildGroup(cfg, old)
+	if err != nil {
+		return err
+	}
+	lb.replaceGroup(old, group)
 
-			backend.SetHealthy(true)
-
-			if cfg.HealthCheck.Enabled {
-				checker := health.NewChecker(target, cfg.HealthCheck.Path, health.Config{
-					Interval:           cfg.HealthCheck.Interval,
-					Timeout:            cfg.HealthCheck.Timeout,
-					HealthyThreshold:   cfg.HealthCheck.HealthyThreshold,
-					UnhealthyThreshold: cfg.HealthCheck.UnhealthyThreshold,
-				})
-				backend.checker = checker
-				lb.healthCheckers[backend.Name] = checker
-			}
+	logrus.WithFields(logrus.Fields{
+		"group":    name,
+		"backends": len(group.backends),
+	}).Info("Backend group targets updated")
+	return nil
+}
+
+// ErrBackendNotFound is returned by the admin operations when no backend
+// matches the given name
+var ErrBackendNotFound = errors.New("backend not found")
+
+// DrainBackend stops assigning new requests to the backends matching name,
+// either a backend name or a target URL shared by backends of several
+// groups. Requests in flight complete normally and sticky sessions move to
+// other backends.
+func (lb *LoadBalancer) DrainBackend(name string) ([]*Backend, error) {
+	return lb.setAdminDrain(name, true)
+}
+
+// UndrainBackend lets the backends matching name receive requests again
+func (lb *LoadBalancer) UndrainBackend(name string) ([]*Backend, error) {
+	return lb.setAdminDrain(name, false)
+}
+
+// setAdminDrain drains or undrains the backends matching name
+func (lb *LoadBalancer) setAdminDrain(name string, draining bool) ([]*Backend, error) {
+	backends := lb.FindBackends(name)
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrBackendNotFound, name)
+	}
+
+	for _, backend := range backends {
+		if !backend.setAdminDrain(draining) {
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"backend":     backend.Name,
+			"draining":    draining,
+			"connections": backend.GetConnections(),
+		}).Info("Backend drain state changed")
+
+		if draining {
+			backend.publish(EventBackendDraining, "admin")
+			go awaitAdminDrained(backend)
+		} else {
+			backend.publish(EventBackendUndrained, "admin")
+		}
+	}
+	return backends, nil
+}
+
+// awaitAdminDrained reports a backend drained through the admin API once its
+// requests in flight have completed, unless it is undrained first
+func awaitAdminDrained(backend *Backend) {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for backend.GetConnections() > 0 {
+		<-ticker.C
+		if atomic.LoadInt32(&backend.adminDrain) == 0 {
+			return
+		}
+	}
+	backend.publish(EventBackendDrained, "admin")
+}
+
+// Events returns the bus the lifecycle events of the backends are published on
+func (lb *LoadBalancer) Events() *EventBus {
+	return lb.events
+}
+
+// FindBackends returns the backends whose name or target URL is name
+func (lb *LoadBalancer) FindBackends(name string) []*Backend {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
 
-			lb.backends = append(lb.backends, backend)
-			configBackends = append(configBackends, backend)
+	var backends []*Backend
+	for _, backend := range lb.backends {
+		if backend.Name == name || backend.URL == name {
+			backends = append(backends, backend)
+		}
+	}
+	return backends
+}
+
+// WaitDrained blocks until none of the backends has requests in flight or
+// ctx is done. It returns whether the backends were drained.
+func WaitDrained(ctx context.Context, backends []*Backend) bool {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if inFlight(backends) == 0 {
+			return true
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// inFlight returns the number of requests in flight on the backends
+func inFlight(backends []*Backend) int32 {
+	var total int32
+	for _, backend := range backends {
+		total += backend.GetConnections()
+	}
+	return total
+}
+
+// UpdateBackends updates the backend configuration. Backends of targets that
+// are kept carry over their state, removed ones are drained, and nothing
+// changes if the new configuration cannot be applied.
+func (lb *LoadBalancer) UpdateBackends(configs []config.BackendConfig) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	groups := make(map[string]*backendGroup, len(configs))
+	var backends []*Backend
+	for _, cfg := range configs {
+		group, err := lb.buildGroup(cfg, lb.groups[cfg.Name])
+		if err != nil {
+			return err
 		}
+		groups[cfg.Name] = group
+		backends = append(backends, group.backends...)
+	}
+
+	if lb.checking {
+		for _, backend := range backends {
+			lb.startHealthCheck(backend)
+		}
+	}
 
-		lb.backendsByName[cfg.Name] = configBackends
-		lb.roundRobinIndex[cfg.Name] = 0
+	for _, group := range groups {
+		group.activate()
 	}
 
-	// Restart health checks
-	go lb.StartHealthChecks()
+	retired := len(lb.retired)
+	lb.retireBackends(lb.backends, backends)
+	lb.publishAdded(lb.backends, backends)
+	lb.groups = groups
+	lb.backends = backends
 
-	logrus.WithField("backends", len(lb.backends)).Info("Backends updated")
+	logrus.WithFields(logrus.Fields{
+		"backends": len(lb.backends),
+		"removed":  len(lb.retired) - retired,
+	}).Info("Backends updated")
 	return nil
 }
 
@@ -424,10 +1026,40 @@ func (lb *LoadBalancer) GetBackendStatus() map[string]interface{} {
 
 	status := make(map[string]interface{})
 	for _, backend := range lb.backends {
+		override := map[string]interface{}{"state": backend.healthOverride().String()}
+		if _, until, ok := backend.HealthOverride(); ok && !until.IsZero() {
+			override["until"] = until.Format(time.RFC3339)
+		}
+
+		status[backend.Name] = map[string]interface{}{
+			"url":              backend.URL,
+			"healthy":          backend.IsHealthy(),
+			"health_override":  override,
+			"ejected":          backend.IsEjected(),
+			"circuit":          backend.breaker.State(),
+			"tier":             backend.Tier,
+			"zone":             backend.Zone,
+			"region":           backend.Region,
+			"weight":           backend.Weight,
+			"labels":           backend.Labels,
+			"draining":         backend.IsDraining(),
+			"max_connections":  backend.MaxConnections,
+			"effective_weight": backend.EffectiveWeight(),
+			"slow_start":       backend.InSlowStart(),
+			"degraded":         backend.IsDegraded(),
+			"connections":      backend.GetConnections(),
+			"latency_ewma":     backend.LatencyEWMA().String(),
+		}
+	}
+
+	for _, backend := range lb.retired {
+		if _, ok := status[backend.Name]; ok {
+			continue
+		}
 		status[backend.Name] = map[string]interface{}{
 			"url":         backend.URL,
-			"healthy":     backend.IsHealthy(),
-			"weight":      backend.Weight,
+			"removed":     true,
+			"draining":    true,
 			"connections": backend.GetConnections(),
 		}
 	}
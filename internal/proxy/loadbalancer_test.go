@@ -0,0 +1,616 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+)
+
+// testGroup returns the config of a group balancing over the given targets
+func testGroup(name, algorithm string, urls ...string) config.BackendConfig {
+	cfg := config.BackendConfig{
+		Name:         name,
+		Protocol:     "http",
+		LoadBalancer: algorithm,
+		Weight:       1,
+	}
+	for _, url := range urls {
+		cfg.Targets = append(cfg.Targets, config.TargetConfig{URL: url})
+	}
+	return cfg
+}
+
+// newTestLoadBalancer creates a load balancer for the given groups
+func newTestLoadBalancer(t *testing.T, configs ...config.BackendConfig) *LoadBalancer {
+	t.Helper()
+
+	lb, err := NewLoadBalancer(configs, nil)
+	if err != nil {
+		t.Fatalf("NewLoadBalancer: %v", err)
+	}
+	return lb
+}
+
+// backendFor returns the backend of the load balancer serving the target
+func backendFor(t *testing.T, lb *LoadBalancer, url string) *Backend {
+	t.Helper()
+
+	backends := lb.FindBackends(url)
+	if len(backends) != 1 {
+		t.Fatalf("found %d backends for %s, want 1", len(backends), url)
+	}
+	return backends[0]
+}
+
+func TestLeaseCountsRequestInFlight(t *testing.T) {
+	lb := newTestLoadBalancer(t, testGroup("web", "round_robin", "http://a:80"))
+	backend := backendFor(t, lb, "http://a:80")
+
+	lease, err := lb.GetBackendForConfig("web", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("GetBackendForConfig: %v", err)
+	}
+	if got := backend.GetConnections(); got != 1 {
+		t.Fatalf("connections with a lease held = %d, want 1", got)
+	}
+
+	lease.Release()
+	lease.Release()
+	if got := backend.GetConnections(); got != 0 {
+		t.Errorf("connections after releasing twice = %d, want 0", got)
+	}
+}
+
+func TestLeastConnectionsFollowsLeases(t *testing.T) {
+	lb := newTestLoadBalancer(t, testGroup("web", "least_connections", "http://a:80", "http://b:80", "http://c:80"))
+
+	// Requests that are never released pile up evenly
+	for i := 0; i < 9; i++ {
+		if _, err := lb.GetBackendForConfig("web", httptest.NewRequest("GET", "/", nil)); err != nil {
+			t.Fatalf("GetBackendForConfig: %v", err)
+		}
+	}
+	for _, url := range []string{"http://a:80", "http://b:80", "http://c:80"} {
+		if got := backendFor(t, lb, url).GetConnections(); got != 3 {
+			t.Errorf("%s has %d requests in flight, want 3", url, got)
+		}
+	}
+
+	// Once b completes its requests it takes the next ones
+	b := backendFor(t, lb, "http://b:80")
+	for i := 0; i < 3; i++ {
+		b.DecrementConnections()
+	}
+	lease, err := lb.GetBackendForConfig("web", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("GetBackendForConfig: %v", err)
+	}
+	if lease.Backend != b {
+		t.Errorf("selected %s, want the idle backend %s", lease.Backend.URL, b.URL)
+	}
+}
+
+func TestHandlerHoldsLeaseWhileStreaming(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("last"))
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{Backends: []config.BackendConfig{testGroup("web", "round_robin", upstream.URL)}}
+	router, err := NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+	lb := newTestLoadBalancer(t, cfg.Backends...)
+	backend := backendFor(t, lb, upstream.URL)
+	handler := NewHandler(router, lb, nil)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/stream", nil))
+		done <- rec
+	}()
+
+	// The request stays in flight until its body has been relayed
+	deadline := time.Now().Add(2 * time.Second)
+	for backend.GetConnections() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("request never counted as in flight")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := backend.GetConnections(); got != 1 {
+		t.Fatalf("connections while streaming = %d, want 1", got)
+	}
+
+	close(release)
+	rec := <-done
+	if body := rec.Body.String(); body != "firstlast" {
+		t.Errorf("body = %q, want %q", body, "firstlast")
+	}
+	if got := backend.GetConnections(); got != 0 {
+		t.Errorf("connections after the response = %d, want 0", got)
+	}
+}
+
+func TestPriorityTierFailover(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold float64
+		unhealthy []string
+		want      string // Tier expected to serve, "" when none can
+	}{
+		{name: "primary healthy", unhealthy: nil, want: "primary"},
+		{name: "primary partly down without threshold", unhealthy: []string{"http://p1:80"}, want: "primary"},
+		{name: "primary below threshold", threshold: 75, unhealthy: []string{"http://p1:80"}, want: "secondary"},
+		{name: "primary down", unhealthy: []string{"http://p1:80", "http://p2:80"}, want: "secondary"},
+		{name: "both tiers down", unhealthy: []string{"http://p1:80", "http://p2:80", "http://s1:80"}, want: "dr"},
+		{name: "everything down", unhealthy: []string{"http://p1:80", "http://p2:80", "http://s1:80", "http://d1:80"}, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testGroup("api", "round_robin", "http://p1:80", "http://p2:80")
+			cfg.FailoverThreshold = tt.threshold
+			cfg.Tiers = []config.TierConfig{
+				{Name: "secondary", Targets: []config.TargetConfig{{URL: "http://s1:80"}}},
+				{Name: "dr", Targets: []config.TargetConfig{{URL: "http://d1:80"}}},
+			}
+			lb := newTestLoadBalancer(t, cfg)
+			for _, url := range tt.unhealthy {
+				backendFor(t, lb, url).SetHealthy(false)
+			}
+
+			for i := 0; i < 4; i++ {
+				lease, err := lb.GetBackendForConfig("api", httptest.NewRequest("GET", "/", nil))
+				if tt.want == "" {
+					if !errors.Is(err, ErrNoHealthyBackends) {
+						t.Fatalf("error %v, want %v", err, ErrNoHealthyBackends)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("GetBackendForConfig: %v", err)
+				}
+				if lease.Backend.Tier != tt.want {
+					t.Errorf("request served by tier %s, want %s", lease.Backend.Tier, tt.want)
+				}
+				lease.Release()
+			}
+		})
+	}
+}
+
+func TestPriorityTierThresholdFallback(t *testing.T) {
+	// With every tier below the threshold the remaining healthy targets still
+	// take traffic
+	cfg := testGroup("api", "round_robin", "http://p1:80", "http://p2:80")
+	cfg.FailoverThreshold = 100
+	cfg.Tiers = []config.TierConfig{{Name: "secondary", Targets: []config.TargetConfig{{URL: "http://s1:80"}, {URL: "http://s2:80"}}}}
+	lb := newTestLoadBalancer(t, cfg)
+	backendFor(t, lb, "http://p1:80").SetHealthy(false)
+	backendFor(t, lb, "http://s1:80").SetHealthy(false)
+
+	lease, err := lb.GetBackendForConfig("api", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("GetBackendForConfig: %v", err)
+	}
+	if lease.Backend.URL != "http://p2:80" {
+		t.Errorf("request went to %s, want the healthy primary target", lease.Backend.URL)
+	}
+}
+
+func TestFailoverBackendGroup(t *testing.T) {
+	primary := testGroup("api", "round_robin", "http://a:80")
+	primary.FailoverBackend = "backup"
+	backup := testGroup("backup", "round_robin", "http://backup:80")
+	backup.FailoverBackend = "api"
+	lb := newTestLoadBalancer(t, primary, backup)
+	a := backendFor(t, lb, "http://a:80")
+	b := backendFor(t, lb, "http://backup:80")
+
+	a.SetHealthy(false)
+	lease, err := lb.GetBackendForConfig("api", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("GetBackendForConfig: %v", err)
+	}
+	if lease.Backend != b {
+		t.Errorf("request went to %s, want the failover group", lease.Backend.URL)
+	}
+	lease.Release()
+
+	// Groups failing over to each other do not loop
+	b.SetHealthy(false)
+	if _, err := lb.GetBackendForConfig("api", httptest.NewRequest("GET", "/", nil)); !errors.Is(err, ErrNoHealthyBackends) {
+		t.Errorf("error %v, want %v", err, ErrNoHealthyBackends)
+	}
+}
+
+func TestPerTargetSettings(t *testing.T) {
+	cfg := testGroup("web", "weighted")
+	cfg.Weight = 2
+	cfg.Targets = []config.TargetConfig{
+		{URL: "http://a:80"},
+		{URL: "http://b:80", Weight: 6, Labels: map[string]string{"version": "canary"}, MaxConnections: 10},
+	}
+	lb := newTestLoadBalancer(t, cfg)
+	a := backendFor(t, lb, "http://a:80")
+	b := backendFor(t, lb, "http://b:80")
+
+	if a.Weight != 2 || b.Weight != 6 {
+		t.Errorf("weights %d and %d, want the group default 2 and 6", a.Weight, b.Weight)
+	}
+	if b.Labels["version"] != "canary" || b.MaxConnections != 10 {
+		t.Errorf("target settings not applied: labels %v, max_connections %d", b.Labels, b.MaxConnections)
+	}
+
+	// Traffic splits by the targets' weights
+	const requests = 4000
+	picked := 0
+	for i := 0; i < requests; i++ {
+		lease, err := lb.GetBackendForConfig("web", httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatalf("GetBackendForConfig: %v", err)
+		}
+		if lease.Backend == b {
+			picked++
+		}
+		lease.Release()
+	}
+	if share := float64(picked) / requests; share < 0.7 || share > 0.8 {
+		t.Errorf("target with weight 6 of 8 took %.1f%% of requests, want 75%%", share*100)
+	}
+}
+
+func TestTargetMaxConnections(t *testing.T) {
+	cfg := testGroup("web", "round_robin")
+	cfg.Targets = []config.TargetConfig{{URL: "http://a:80", MaxConnections: 1}, {URL: "http://b:80", MaxConnections: 1}}
+	lb := newTestLoadBalancer(t, cfg)
+
+	first, err := lb.GetBackendForConfig("web", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("GetBackendForConfig: %v", err)
+	}
+	second, err := lb.GetBackendForConfig("web", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("GetBackendForConfig: %v", err)
+	}
+	if first.Backend == second.Backend {
+		t.Fatalf("both requests went to %s despite its connection limit", first.Backend.URL)
+	}
+
+	// Both targets are full until one completes a request
+	if _, err := lb.GetBackendForConfig("web", httptest.NewRequest("GET", "/", nil)); err == nil {
+		t.Fatalf("request admitted with every target at its limit")
+	}
+	first.Release()
+	lease, err := lb.GetBackendForConfig("web", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("GetBackendForConfig after a release: %v", err)
+	}
+	if lease.Backend != first.Backend {
+		t.Errorf("request went to %s, want the target with capacity %s", lease.Backend.URL, first.Backend.URL)
+	}
+}
+
+func TestTargetDrainFlag(t *testing.T) {
+	cfg := testGroup("web", "round_robin")
+	cfg.Targets = []config.TargetConfig{{URL: "http://a:80"}, {URL: "http://b:80", Drain: true}}
+	lb := newTestLoadBalancer(t, cfg)
+
+	for i := 0; i < 4; i++ {
+		lease, err := lb.GetBackendForConfig("web", httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatalf("GetBackendForConfig: %v", err)
+		}
+		if lease.Backend.URL != "http://a:80" {
+			t.Fatalf("request went to the drained target %s", lease.Backend.URL)
+		}
+		lease.Release()
+	}
+}
+
+// retiredBackends returns the removed backends still finishing requests
+func retiredBackends(lb *LoadBalancer) []*Backend {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	return append([]*Backend(nil), lb.retired...)
+}
+
+func TestTargetUpdates(t *testing.T) {
+	base := outlierGroup(config.OutlierDetectionConfig{Consecutive5xx: 1}, "http://a:80", "http://b:80", "http://c:80")
+
+	tests := []struct {
+		name   string
+		update func(lb *LoadBalancer, targets []config.TargetConfig) error
+	}{
+		{
+			name: "UpdateBackends",
+			update: func(lb *LoadBalancer, targets []config.TargetConfig) error {
+				cfg := base
+				cfg.Targets = targets
+				return lb.UpdateBackends([]config.BackendConfig{cfg})
+			},
+		},
+		{
+			name: "SetGroupTargets",
+			update: func(lb *LoadBalancer, targets []config.TargetConfig) error {
+				return lb.SetGroupTargets("api", targets)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newTestLoadBalancer(t, base)
+			a := backendFor(t, lb, "http://a:80")
+			b := backendFor(t, lb, "http://b:80")
+			c := backendFor(t, lb, "http://c:80")
+
+			// a and c have requests in flight, b is ejected
+			leaseA := lease(a, false)
+			leaseC := lease(c, false)
+			b.ReportResult(500, nil, time.Millisecond)
+			if !b.IsEjected() {
+				t.Fatalf("b not ejected")
+			}
+
+			targets := []config.TargetConfig{{URL: "http://a:80"}, {URL: "http://b:80"}, {URL: "http://d:80"}}
+			if err := tt.update(lb, targets); err != nil {
+				t.Fatalf("update: %v", err)
+			}
+
+			// Kept targets keep their backend and its state
+			if backendFor(t, lb, "http://a:80") != a || a.GetConnections() != 1 {
+				t.Errorf("a was replaced or lost its in-flight request")
+			}
+			if backendFor(t, lb, "http://b:80") != b || !b.IsEjected() {
+				t.Errorf("b was replaced or lost its ejection")
+			}
+			if d := backendFor(t, lb, "http://d:80"); d.IsDraining() || !d.IsAvailable() {
+				t.Errorf("added target d does not take requests")
+			}
+
+			// The removed target drains its requests before it is dropped
+			if backends := lb.FindBackends("http://c:80"); len(backends) != 0 {
+				t.Errorf("removed target c is still part of the group")
+			}
+			if !c.IsDraining() || !containsBackend(retiredBackends(lb), c) {
+				t.Fatalf("removed target c is not draining")
+			}
+			for i := 0; i < 10; i++ {
+				l, err := lb.GetBackendForConfig("api", httptest.NewRequest("GET", "/", nil))
+				if err != nil {
+					t.Fatalf("GetBackendForConfig: %v", err)
+				}
+				if l.Backend == c || l.Backend == b {
+					t.Fatalf("request sent to %s", l.Backend.URL)
+				}
+				l.Release()
+			}
+
+			leaseC.Release()
+			deadline := time.Now().Add(2 * time.Second)
+			for containsBackend(retiredBackends(lb), c) {
+				if time.Now().After(deadline) {
+					t.Fatalf("c not dropped after its last request")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			leaseA.Release()
+			if a.GetConnections() != 0 {
+				t.Errorf("a has %d requests in flight after the release", a.GetConnections())
+			}
+		})
+	}
+}
+
+func TestUpdateBackendsChangedSettings(t *testing.T) {
+	cfg := testGroup("api", "round_robin", "http://a:80", "http://b:80")
+	lb := newTestLoadBalancer(t, cfg)
+	a := backendFor(t, lb, "http://a:80")
+	a.SetHealthy(false)
+	held := lease(a, false)
+
+	// A changed group weight recreates the backends with their health
+	cfg.Weight = 5
+	if err := lb.UpdateBackends([]config.BackendConfig{cfg}); err != nil {
+		t.Fatalf("UpdateBackends: %v", err)
+	}
+	replaced := backendFor(t, lb, "http://a:80")
+	if replaced == a || replaced.Weight != 5 {
+		t.Fatalf("a was not recreated with the new weight")
+	}
+	if replaced.IsHealthy() {
+		t.Errorf("recreated backend lost its health status")
+	}
+
+	// The previous backend finishes its request before it is dropped
+	if !a.IsDraining() || !containsBackend(retiredBackends(lb), a) {
+		t.Errorf("previous backend of a is not draining")
+	}
+	held.Release()
+}
+
+func TestUpdateBackendsGroups(t *testing.T) {
+	lb := newTestLoadBalancer(t, testGroup("api", "round_robin", "http://a:80"), testGroup("web", "round_robin", "http://w:80"))
+	w := backendFor(t, lb, "http://w:80")
+
+	if err := lb.UpdateBackends([]config.BackendConfig{testGroup("api", "round_robin", "http://a:80")}); err != nil {
+		t.Fatalf("UpdateBackends: %v", err)
+	}
+	if _, err := lb.GetBackendForConfig("web", httptest.NewRequest("GET", "/", nil)); err == nil {
+		t.Errorf("removed group still serves requests")
+	}
+	if !w.IsDraining() {
+		t.Errorf("backend of the removed group is not draining")
+	}
+
+	if err := lb.SetGroupTargets("web", []config.TargetConfig{{URL: "http://w:80"}}); err == nil {
+		t.Errorf("targets set on a removed group")
+	}
+}
+
+func TestUpdateBackendsFailedReload(t *testing.T) {
+	api := outlierGroup(config.OutlierDetectionConfig{Consecutive5xx: 1}, "http://a:80", "http://b:80")
+	lb := newTestLoadBalancer(t, api)
+	a := backendFor(t, lb, "http://a:80")
+	detector := a.outlier.detector.Load()
+
+	// The api group is valid, but the group after it is not
+	changed := api
+	changed.Targets = []config.TargetConfig{{URL: "http://a:80", Drain: true}, {URL: "http://c:80"}}
+	invalid := testGroup("web", "round_robin", "http://w:80")
+	invalid.HealthCheck = config.HealthCheckConfig{Enabled: true, Expect: config.HealthExpectConfig{BodyRegex: "("}}
+	if err := lb.UpdateBackends([]config.BackendConfig{changed, invalid}); err == nil {
+		t.Fatalf("invalid configuration applied")
+	}
+
+	if a.IsDraining() {
+		t.Errorf("failed reload drained a")
+	}
+	b := backendFor(t, lb, "http://b:80")
+	detector.mu.Lock()
+	tracked := append([]*Backend(nil), detector.backends...)
+	detector.mu.Unlock()
+	if len(tracked) != 2 || !containsBackend(tracked, a) || !containsBackend(tracked, b) {
+		t.Errorf("failed reload changed the backends of the outlier detector")
+	}
+	if len(lb.FindBackends("http://c:80")) != 0 || len(retiredBackends(lb)) != 0 {
+		t.Errorf("failed reload changed the backends")
+	}
+
+	// Applied once the configuration is valid
+	if err := lb.UpdateBackends([]config.BackendConfig{changed}); err != nil {
+		t.Fatalf("UpdateBackends: %v", err)
+	}
+	if backendFor(t, lb, "http://a:80") != a || !a.IsDraining() {
+		t.Errorf("a was not kept and drained")
+	}
+}
+
+func TestDrainBackend(t *testing.T) {
+	lb := newTestLoadBalancer(t, testGroup("api", "round_robin", "http://a:80", "http://b:80"))
+	a := backendFor(t, lb, "http://a:80")
+	held := lease(a, false)
+
+	if _, err := lb.DrainBackend("http://a:80"); err != nil {
+		t.Fatalf("DrainBackend: %v", err)
+	}
+	if _, err := lb.DrainBackend("http://unknown:80"); !errors.Is(err, ErrBackendNotFound) {
+		t.Errorf("error %v for an unknown backend, want %v", err, ErrBackendNotFound)
+	}
+
+	// No new requests, but the one in flight keeps its lease
+	for i := 0; i < 4; i++ {
+		l, err := lb.GetBackendForConfig("api", httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatalf("GetBackendForConfig: %v", err)
+		}
+		if l.Backend == a {
+			t.Fatalf("request sent to the draining backend")
+		}
+		l.Release()
+	}
+	if a.GetConnections() != 1 {
+		t.Fatalf("draining backend has %d requests in flight, want 1", a.GetConnections())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if WaitDrained(ctx, []*Backend{a}) {
+		t.Fatalf("backend reported drained with a request in flight")
+	}
+
+	held.Release()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !WaitDrained(ctx, []*Backend{a}) {
+		t.Fatalf("backend not drained after its last request")
+	}
+
+	if _, err := lb.UndrainBackend(a.Name); err != nil {
+		t.Fatalf("UndrainBackend: %v", err)
+	}
+	if a.IsDraining() || !a.IsAvailable() {
+		t.Errorf("undrained backend does not take requests")
+	}
+}
+
+func TestDrainMovesStickySessions(t *testing.T) {
+	for _, fallback := range []string{"rebalance", "fail"} {
+		cfg := stickyGroup(config.StickySessionConfig{Fallback: fallback})
+		lb := newTestLoadBalancer(t, cfg)
+		b := backendFor(t, lb, "http://b:80")
+
+		if _, err := lb.DrainBackend(b.Name); err != nil {
+			t.Fatalf("DrainBackend: %v", err)
+		}
+		l, err := lb.GetBackendForConfig("app", pinnedRequest(cfg.StickySession, b))
+		if err != nil {
+			t.Fatalf("%s: GetBackendForConfig: %v", fallback, err)
+		}
+		if l.Backend == b || l.Sticky {
+			t.Errorf("%s: session stayed on the draining backend", fallback)
+		}
+	}
+}
+
+func TestDrainSurvivesReload(t *testing.T) {
+	cfg := testGroup("api", "round_robin", "http://a:80", "http://b:80")
+
+	tests := []struct {
+		name   string
+		reload func(lb *LoadBalancer) error
+	}{
+		{
+			name:   "same settings",
+			reload: func(lb *LoadBalancer) error { return lb.UpdateBackends([]config.BackendConfig{cfg}) },
+		},
+		{
+			name: "changed settings",
+			reload: func(lb *LoadBalancer) error {
+				changed := cfg
+				changed.Weight = 3
+				return lb.UpdateBackends([]config.BackendConfig{changed})
+			},
+		},
+		{
+			name: "discovered targets",
+			reload: func(lb *LoadBalancer) error {
+				return lb.SetGroupTargets("api", []config.TargetConfig{{URL: "http://a:80"}, {URL: "http://b:80"}, {URL: "http://c:80"}})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newTestLoadBalancer(t, cfg)
+			if _, err := lb.DrainBackend("http://a:80"); err != nil {
+				t.Fatalf("DrainBackend: %v", err)
+			}
+			if err := tt.reload(lb); err != nil {
+				t.Fatalf("reload: %v", err)
+			}
+			if !backendFor(t, lb, "http://a:80").IsDraining() {
+				t.Errorf("drain undone by the reload")
+			}
+			if backendFor(t, lb, "http://b:80").IsDraining() {
+				t.Errorf("reload drained another backend")
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+)
+
+// preferLocal narrows the candidates of a tier down to those in the proxy's
+// zone, or failing that its region. A locality is skipped when too few of
+// its targets are healthy or all of its candidates are overloaded, in which
+// case traffic spills over to the next locality and finally to every
+// candidate.
+func preferLocal(cfg config.LocalityRoutingConfig, locality config.LocalityConfig, tier, candidates []*Backend) []*Backend {
+	levels := []func(*Backend) bool{
+		func(b *Backend) bool { return locality.Zone != "" && b.Zone == locality.Zone },
+		func(b *Backend) bool { return locality.Region != "" && b.Region == locality.Region },
+	}
+
+	for _, local := range levels {
+		members := filterBackends(tier, local)
+		if len(members) == 0 || healthyFraction(members) < cfg.MinHealthyPercent/100 {
+			continue
+		}
+
+		nearby := filterBackends(candidates, func(b *Backend) bool {
+			return local(b) && !overloaded(cfg, b)
+		})
+		if len(nearby) > 0 {
+			return nearby
+		}
+	}
+
+	return candidates
+}
+
+// overloaded reports whether a backend has reached the connection limit of
+// local targets
+func overloaded(cfg config.LocalityRoutingConfig, b *Backend) bool {
+	return cfg.MaxConnections > 0 && int(b.GetConnections()) >= cfg.MaxConnections
+}
+
+// filterBackends returns the backends matching keep
+func filterBackends(backends []*Backend, keep func(*Backend) bool) []*Backend {
+	var filtered []*Backend
+	for _, backend := range backends {
+		if keep(backend) {
+			filtered = append(filtered, backend)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+)
+
+// localityGroup returns a group with two targets in zone-a, one more in
+// region-1 and one in another region
+func localityGroup(routing config.LocalityRoutingConfig) config.BackendConfig {
+	cfg := testGroup("web", "round_robin")
+	cfg.Targets = []config.TargetConfig{
+		{URL: "http://a1:80", Zone: "zone-a", Region: "region-1"},
+		{URL: "http://a2:80", Zone: "zone-a", Region: "region-1"},
+		{URL: "http://b1:80", Zone: "zone-b", Region: "region-1"},
+		{URL: "http://c1:80", Zone: "zone-c", Region: "region-2"},
+	}
+	cfg.LocalityRouting = routing
+	cfg.LocalityRouting.Enabled = true
+	return cfg
+}
+
+// pickedTargets returns the targets serving a run of requests to the web
+// group, sorted
+func pickedTargets(t *testing.T, lb *LoadBalancer) []string {
+	t.Helper()
+
+	seen := make(map[string]bool)
+	for i := 0; i < 8; i++ {
+		lease, err := lb.GetBackendForConfig("web", httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatalf("GetBackendForConfig: %v", err)
+		}
+		seen[lease.Backend.URL] = true
+		lease.Release()
+	}
+
+	var picked []string
+	for url := range seen {
+		picked = append(picked, url)
+	}
+	sort.Strings(picked)
+	return picked
+}
+
+func TestPreferLocal(t *testing.T) {
+	tests := []struct {
+		name      string
+		routing   config.LocalityRoutingConfig
+		unhealthy []string
+		loaded    []string // Targets with a request in flight
+		want      []string
+	}{
+		{
+			name: "zone",
+			want: []string{"http://a1:80", "http://a2:80"},
+		},
+		{
+			name:      "region once the zone is down",
+			unhealthy: []string{"http://a1:80", "http://a2:80"},
+			want:      []string{"http://b1:80"},
+		},
+		{
+			name:      "any once the region is down",
+			unhealthy: []string{"http://a1:80", "http://a2:80", "http://b1:80"},
+			want:      []string{"http://c1:80"},
+		},
+		{
+			name:      "zone at the healthy threshold",
+			routing:   config.LocalityRoutingConfig{MinHealthyPercent: 50},
+			unhealthy: []string{"http://a1:80"},
+			want:      []string{"http://a2:80"},
+		},
+		{
+			name:      "zone below the healthy threshold",
+			routing:   config.LocalityRoutingConfig{MinHealthyPercent: 60},
+			unhealthy: []string{"http://a1:80"},
+			want:      []string{"http://a2:80", "http://b1:80"},
+		},
+		{
+			name:      "region below the healthy threshold",
+			routing:   config.LocalityRoutingConfig{MinHealthyPercent: 60},
+			unhealthy: []string{"http://a1:80", "http://a2:80"},
+			want:      []string{"http://b1:80", "http://c1:80"},
+		},
+		{
+			name:    "zone overloaded",
+			routing: config.LocalityRoutingConfig{MaxConnections: 1},
+			loaded:  []string{"http://a1:80", "http://a2:80"},
+			want:    []string{"http://b1:80"},
+		},
+		{
+			name:    "zone partly overloaded",
+			routing: config.LocalityRoutingConfig{MaxConnections: 1},
+			loaded:  []string{"http://a1:80"},
+			want:    []string{"http://a2:80"},
+		},
+		{
+			name:    "everything local overloaded",
+			routing: config.LocalityRoutingConfig{MaxConnections: 1},
+			loaded:  []string{"http://a1:80", "http://a2:80", "http://b1:80"},
+			want:    []string{"http://a1:80", "http://a2:80", "http://b1:80", "http://c1:80"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newTestLoadBalancer(t, localityGroup(tt.routing))
+			lb.SetLocality(config.LocalityConfig{Zone: "zone-a", Region: "region-1"})
+
+			for _, url := range tt.unhealthy {
+				backendFor(t, lb, url).SetHealthy(false)
+			}
+			for _, url := range tt.loaded {
+				held := lease(backendFor(t, lb, url), false)
+				defer held.Release()
+			}
+
+			if got := pickedTargets(t, lb); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("picked %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreferLocalAfterReload(t *testing.T) {
+	cfg := &config.Config{Backends: []config.BackendConfig{localityGroup(config.LocalityRoutingConfig{})}}
+	cfg.Server.Locality = config.LocalityConfig{Zone: "zone-a", Region: "region-1"}
+	router, err := NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+	lb := newTestLoadBalancer(t, cfg.Backends...)
+	s := &Server{config: cfg, router: router, handler: NewHandler(router, lb, nil), loadBalancer: lb}
+	s.loadBalancer.SetLocality(cfg.Server.Locality)
+
+	if got := pickedTargets(t, s.loadBalancer); !reflect.DeepEqual(got, []string{"http://a1:80", "http://a2:80"}) {
+		t.Fatalf("picked %v before the reload, want the zone-a targets", got)
+	}
+
+	// The proxy moved to another zone of region-1
+	moved := *cfg
+	moved.Server.Locality = config.LocalityConfig{Zone: "zone-b", Region: "region-1"}
+	if err := s.ReloadConfig(&moved); err != nil {
+		t.Fatalf("ReloadConfig: %v", err)
+	}
+	if got := pickedTargets(t, s.loadBalancer); !reflect.DeepEqual(got, []string{"http://b1:80"}) {
+		t.Errorf("picked %v after the reload, want the zone-b target", got)
+	}
+
+	// Without a zone, the region is preferred
+	moved.Server.Locality = config.LocalityConfig{Region: "region-2"}
+	if err := s.ReloadConfig(&moved); err != nil {
+		t.Fatalf("ReloadConfig: %v", err)
+	}
+	if got := pickedTargets(t, s.loadBalancer); !reflect.DeepEqual(got, []string{"http://c1:80"}) {
+		t.Errorf("picked %v after the second reload, want the region-2 target", got)
+	}
+}
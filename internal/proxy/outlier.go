@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+	"github.com/os-dev/quic-reverse-proxy/internal/telemetry"
+	"github.com/sirupsen/logrus"
+)
+
+// outlierState is the passive health state of a single backend
+type outlierState struct {
+	// Replaced on reload while requests report their outcome
+	detector atomic.Pointer[outlierDetector]
+
+	consecutive5xx           int32 // atomic
+	consecutiveGatewayErrors int32 // atomic
+	consecutiveSlow          int32 // atomic
+	ejectedUntil             int64 // atomic, unix nanoseconds
+
+	// Guarded by detector.mu
+	ejections    int
+	lastEjection time.Time
+}
+
+// outlierDetector ejects backends of a group that keep failing live traffic.
+// Counters are updated lock free on the request path; the mutex only
+// serialises ejection decisions so the maximum ejection percentage holds.
+type outlierDetector struct {
+	cfg      config.OutlierDetectionConfig
+	backends []*Backend
+	metrics  *telemetry.Metrics
+	mu       sync.Mutex
+}
+
+// newOutlierDetector creates a detector for the backends of a group
+func newOutlierDetector(cfg config.OutlierDetectionConfig, backends []*Backend, metrics *telemetry.Metrics) *outlierDetector {
+	d := &outlierDetector{
+		cfg:      cfg,
+		backends: backends,
+		metrics:  metrics,
+	}
+	for _, backend := range backends {
+		backend.outlier.detector.Store(d)
+	}
+	return d
+}
+
+// setBackends replaces the backends of the group after its targets changed.
+// Backends carried over keep their ejection state.
+func (d *outlierDetector) setBackends(backends []*Backend) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, backend := range backends {
+		backend.outlier.detector.Store(d)
+	}
+	d.backends = backends
+}
+
+// report feeds the outcome of a request to b into its outlier detector
+func (s *outlierState) report(b *Backend, statusCode int, err error, latency time.Duration) {
+	d := s.detector.Load()
+	if d == nil {
+		return
+	}
+
+	gatewayError := err != nil || statusCode == 502 || statusCode == 503 || statusCode == 504
+	serverError := gatewayError || statusCode >= 500
+
+	if d.count(&s.consecutiveGatewayErrors, gatewayError, d.cfg.ConsecutiveGatewayErrors) {
+		d.eject(b, "consecutive_gateway_errors")
+	}
+	if d.count(&s.consecutive5xx, serverError, d.cfg.Consecutive5xx) {
+		d.eject(b, "consecutive_5xx")
+	}
+	if d.cfg.LatencyThreshold > 0 && err == nil {
+		if d.count(&s.consecutiveSlow, latency > d.cfg.LatencyThreshold, d.cfg.ConsecutiveSlow) {
+			d.eject(b, "latency")
+		}
+	}
+}
+
+// count updates a consecutive counter and reports whether it reached the
+// threshold
+func (d *outlierDetector) count(counter *int32, failed bool, threshold int) bool {
+	if !failed {
+		atomic.StoreInt32(counter, 0)
+		return false
+	}
+	return threshold > 0 && int(atomic.AddInt32(counter, 1)) >= threshold
+}
+
+// eject takes a backend out of rotation unless doing so would exceed the
+// maximum ejection percentage of the group
+func (d *outlierDetector) eject(b *Backend, reason string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if b.IsEjected() {
+		return
+	}
+
+	ejected := 0
+	for _, backend := range d.backends {
+		if backend.IsEjected() {
+			ejected++
+		}
+	}
+	maxEjected := len(d.backends) * d.cfg.MaxEjectionPercent / 100
+	if maxEjected < 1 {
+		maxEjected = 1
+	}
+	if ejected >= maxEjected {
+		logrus.WithFields(logrus.Fields{
+			"backend": b.Name,
+			"reason":  reason,
+			"ejected": ejected,
+		}).Warn("Outlier not ejected, maximum ejection percentage reached")
+		return
+	}
+
+	// The ejection multiplier is forgotten once the backend has gone twice
+	// the maximum ejection time without being ejected
+	now := time.Now()
+	if now.Sub(b.outlier.lastEjection) > 2*d.cfg.MaxEjectionTime {
+		b.outlier.ejections = 0
+	}
+	b.outlier.ejections++
+	b.outlier.lastEjection = now
+
+	duration := d.cfg.BaseEjectionTime << uint(b.outlier.ejections-1)
+	if duration <= 0 || duration > d.cfg.MaxEjectionTime {
+		duration = d.cfg.MaxEjectionTime
+	}
+
+	atomic.StoreInt32(&b.outlier.consecutive5xx, 0)
+	atomic.StoreInt32(&b.outlier.consecutiveGatewayErrors, 0)
+	atomic.StoreInt32(&b.outlier.consecutiveSlow, 0)
+	atomic.StoreInt64(&b.outlier.ejectedUntil, now.Add(duration).UnixNano())
+
+	if d.metrics != nil {
+		d.metrics.RecordBackendEjection(b.Name, reason)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"backend":   b.Name,
+		"reason":    reason,
+		"duration":  duration.String(),
+		"ejections": b.outlier.ejections,
+	}).Warn("Backend ejected by outlier detection")
+	b.publish(EventBackendEjected, reason)
+}
+
+// IsEjected returns true while the backend is ejected by outlier detection
+func (b *Backend) IsEjected() bool {
+	until := atomic.LoadInt64(&b.outlier.ejectedUntil)
+	if until == 0 {
+		return false
+	}
+	if time.Now().UnixNano() < until {
+		return true
+	}
+
+	// The ejection has expired; the first caller to notice reports it
+	if atomic.CompareAndSwapInt64(&b.outlier.ejectedUntil, until, 0) {
+		if d := b.outlier.detector.Load(); d != nil && d.metrics != nil {
+			d.metrics.RecordBackendUnejected(b.Name)
+		}
+		logrus.WithField("backend", b.Name).Info("Backend returned from outlier ejection")
+		b.publish(EventBackendUnejected, "")
+	}
+	return false
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+)
+
+func outlierGroup(od config.OutlierDetectionConfig, urls ...string) config.BackendConfig {
+	cfg := testGroup("api", "round_robin", urls...)
+	od.Enabled = true
+	if od.BaseEjectionTime == 0 {
+		od.BaseEjectionTime = time.Minute
+	}
+	if od.MaxEjectionTime == 0 {
+		od.MaxEjectionTime = 10 * time.Minute
+	}
+	if od.MaxEjectionPercent == 0 {
+		od.MaxEjectionPercent = 50
+	}
+	cfg.OutlierDetection = od
+	return cfg
+}
+
+func TestOutlierConsecutiveErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		od      config.OutlierDetectionConfig
+		report  func(b *Backend)
+		ejected bool
+	}{
+		{
+			name:    "consecutive 5xx",
+			od:      config.OutlierDetectionConfig{Consecutive5xx: 3},
+			report:  func(b *Backend) { b.ReportResult(500, nil, time.Millisecond) },
+			ejected: true,
+		},
+		{
+			name:    "consecutive gateway errors",
+			od:      config.OutlierDetectionConfig{ConsecutiveGatewayErrors: 3},
+			report:  func(b *Backend) { b.ReportResult(0, errors.New("connection refused"), time.Millisecond) },
+			ejected: true,
+		},
+		{
+			name:    "500 is not a gateway error",
+			od:      config.OutlierDetectionConfig{ConsecutiveGatewayErrors: 3},
+			report:  func(b *Backend) { b.ReportResult(500, nil, time.Millisecond) },
+			ejected: false,
+		},
+		{
+			name:    "slow responses",
+			od:      config.OutlierDetectionConfig{LatencyThreshold: 100 * time.Millisecond, ConsecutiveSlow: 3},
+			report:  func(b *Backend) { b.ReportResult(200, nil, time.Second) },
+			ejected: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newTestLoadBalancer(t, outlierGroup(tt.od, "http://a:80", "http://b:80"))
+			a := backendFor(t, lb, "http://a:80")
+
+			for i := 0; i < 3; i++ {
+				tt.report(a)
+			}
+			if a.IsEjected() != tt.ejected {
+				t.Errorf("ejected = %v, want %v", a.IsEjected(), tt.ejected)
+			}
+		})
+	}
+}
+
+func TestOutlierSuccessResetsCount(t *testing.T) {
+	lb := newTestLoadBalancer(t, outlierGroup(config.OutlierDetectionConfig{Consecutive5xx: 3}, "http://a:80", "http://b:80"))
+	a := backendFor(t, lb, "http://a:80")
+
+	for i := 0; i < 10; i++ {
+		a.ReportResult(503, nil, time.Millisecond)
+		a.ReportResult(503, nil, time.Millisecond)
+		a.ReportResult(200, nil, time.Millisecond)
+	}
+	if a.IsEjected() {
+		t.Errorf("backend ejected although its errors were never consecutive")
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	od := config.OutlierDetectionConfig{Consecutive5xx: 1, MaxEjectionPercent: 50}
+	lb := newTestLoadBalancer(t, outlierGroup(od, "http://a:80", "http://b:80", "http://c:80", "http://d:80"))
+
+	ejected := 0
+	for _, url := range []string{"http://a:80", "http://b:80", "http://c:80", "http://d:80"} {
+		backend := backendFor(t, lb, url)
+		backend.ReportResult(500, nil, time.Millisecond)
+		if backend.IsEjected() {
+			ejected++
+		}
+	}
+	if ejected != 2 {
+		t.Errorf("%d of 4 backends ejected, want at most 50%%", ejected)
+	}
+}
+
+func TestOutlierEjectionExpiresAndBacksOff(t *testing.T) {
+	od := config.OutlierDetectionConfig{
+		Consecutive5xx:   1,
+		BaseEjectionTime: 50 * time.Millisecond,
+		MaxEjectionTime:  time.Second,
+	}
+	lb := newTestLoadBalancer(t, outlierGroup(od, "http://a:80", "http://b:80"))
+	a := backendFor(t, lb, "http://a:80")
+
+	a.ReportResult(500, nil, time.Millisecond)
+	if !a.IsEjected() {
+		t.Fatalf("backend not ejected")
+	}
+
+	// Ejected backends receive no requests
+	for i := 0; i < 4; i++ {
+		lease, err := lb.GetBackendForConfig("api", httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatalf("GetBackendForConfig: %v", err)
+		}
+		if lease.Backend == a {
+			t.Fatalf("ejected backend selected")
+		}
+		lease.Release()
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if a.IsEjected() {
+		t.Fatalf("backend still ejected after the base ejection time")
+	}
+
+	// A second ejection lasts twice as long
+	a.ReportResult(500, nil, time.Millisecond)
+	until := time.Unix(0, atomic.LoadInt64(&a.outlier.ejectedUntil))
+	if d := time.Until(until); d < 80*time.Millisecond || d > 100*time.Millisecond {
+		t.Errorf("second ejection lasts %v, want 100ms", d)
+	}
+}
+
+func TestOutlierReloadWhileReporting(t *testing.T) {
+	od := config.OutlierDetectionConfig{Consecutive5xx: 3, BaseEjectionTime: time.Millisecond, MaxEjectionTime: 5 * time.Millisecond}
+	cfg := outlierGroup(od, "http://a:80", "http://b:80", "http://c:80")
+	lb := newTestLoadBalancer(t, cfg)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				lease, err := lb.GetBackendForConfig("api", httptest.NewRequest("GET", "/", nil))
+				if err != nil {
+					continue
+				}
+				status := 200
+				if (n+i)%2 == 0 {
+					status = 503
+				}
+				lease.Backend.ReportResult(status, nil, time.Millisecond)
+				lease.Backend.IsEjected()
+				lease.Release()
+			}
+		}(i)
+	}
+
+	// Reloads keep the detector for the targets that stay and replace it
+	// when its settings change
+	for i := 0; i < 50; i++ {
+		reloaded := cfg
+		reloaded.Targets = cfg.Targets[:2+i%2]
+		if i%5 == 0 {
+			reloaded.OutlierDetection.Consecutive5xx = 2 + i%2
+		}
+		if err := lb.UpdateBackends([]config.BackendConfig{reloaded}); err != nil {
+			t.Fatalf("UpdateBackends: %v", err)
+		}
+		if err := lb.SetGroupTargets("api", cfg.Targets[:3-i%2]); err != nil {
+			t.Fatalf("SetGroupTargets: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// healthOverride is a health state forced on a backend through the admin API
+type healthOverride int32
+
+const (
+	overrideNone healthOverride = iota
+	overrideHealthy
+	overrideUnhealthy
+)
+
+// String returns the name of the override
+func (o healthOverride) String() string {
+	switch o {
+	case overrideHealthy:
+		return "healthy"
+	case overrideUnhealthy:
+		return "unhealthy"
+	default:
+		return "auto"
+	}
+}
+
+// HealthOverride returns the health forced on the backend, when it expires,
+// and whether an override is in effect at all. A zero expiry means the
+// override stays until it is cleared.
+func (b *Backend) HealthOverride() (healthy bool, until time.Time, ok bool) {
+	override := b.healthOverride()
+	if override == overrideNone {
+		return false, time.Time{}, false
+	}
+
+	if expires := atomic.LoadInt64(&b.overrideUntil); expires != 0 {
+		until = time.Unix(0, expires)
+	}
+	return override == overrideHealthy, until, true
+}
+
+// healthOverride returns the override in effect. Expired overrides no longer
+// apply even before expireHealthOverride has cleared them.
+func (b *Backend) healthOverride() healthOverride {
+	override := healthOverride(atomic.LoadInt32(&b.override))
+	if override == overrideNone {
+		return overrideNone
+	}
+
+	if expires := atomic.LoadInt64(&b.overrideUntil); expires != 0 && time.Now().UnixNano() >= expires {
+		return overrideNone
+	}
+	return override
+}
+
+// setHealthOverride forces the backend's health until the given time, or
+// until cleared when it is zero. overrideNone clears the override.
+func (b *Backend) setHealthOverride(override healthOverride, until time.Time) {
+	var expires int64
+	if override != overrideNone && !until.IsZero() {
+		expires = until.UnixNano()
+	}
+	atomic.StoreInt64(&b.overrideUntil, expires)
+	atomic.StoreInt32(&b.override, int32(override))
+}
+
+// expireHealthOverride clears the override set to expire at until. It
+// returns false if the override was replaced or cleared in the meantime.
+func (b *Backend) expireHealthOverride(until time.Time) bool {
+	if !atomic.CompareAndSwapInt64(&b.overrideUntil, until.UnixNano(), 0) {
+		return false
+	}
+	atomic.StoreInt32(&b.override, int32(overrideNone))
+	return true
+}
+
+// OverrideHealth forces the backends matching name healthy or unhealthy
+// regardless of what their health checks report. The override lasts for ttl,
+// or until it is cleared when ttl is zero.
+func (lb *LoadBalancer) OverrideHealth(name string, healthy bool, ttl time.Duration) ([]*Backend, error) {
+	override := overrideUnhealthy
+	if healthy {
+		override = overrideHealthy
+	}
+
+	var until time.Time
+	if ttl > 0 {
+		until = time.Now().Add(ttl)
+	}
+	return lb.applyHealthOverride(name, override, until, ttl)
+}
+
+// ClearHealthOverride returns the backends matching name to the health
+// reported by their health checks
+func (lb *LoadBalancer) ClearHealthOverride(name string) ([]*Backend, error) {
+	return lb.applyHealthOverride(name, overrideNone, time.Time{}, 0)
+}
+
+// applyHealthOverride sets the override of the backends matching name
+func (lb *LoadBalancer) applyHealthOverride(name string, override healthOverride, until time.Time, ttl time.Duration) ([]*Backend, error) {
+	backends := lb.FindBackends(name)
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrBackendNotFound, name)
+	}
+
+	for _, backend := range backends {
+		wasHealthy := backend.IsHealthy()
+		backend.setHealthOverride(override, until)
+		lb.healthChanged(backend, wasHealthy, "override")
+
+		logrus.WithFields(logrus.Fields{
+			"backend":  backend.Name,
+			"override": override.String(),
+			"ttl":      ttl.String(),
+		}).Info("Backend health override changed")
+
+		if ttl > 0 {
+			backend := backend
+			time.AfterFunc(ttl, func() {
+				if backend.expireHealthOverride(until) {
+					logrus.WithField("backend", backend.Name).Info("Backend health override expired")
+					lb.healthChanged(backend, override == overrideHealthy, "override_expired")
+				}
+			})
+		}
+	}
+	return backends, nil
+}
+
+// healthChanged updates the metrics of a backend whose health may have
+// changed from wasHealthy for the given reason, and ramps up its traffic if
+// it recovered
+func (lb *LoadBalancer) healthChanged(backend *Backend, wasHealthy bool, reason string) {
+	healthy := backend.IsHealthy()
+
+	if lb.metrics != nil {
+		lb.metrics.UpdateBackendHealth(backend.Name, healthy)
+		lb.metrics.UpdateHealthOverride(backend.Name, int(backend.healthOverride()))
+	}
+
+	if !wasHealthy && healthy {
+		backend.beginSlowStart()
+	}
+
+	if wasHealthy != healthy {
+		logrus.WithFields(logrus.Fields{
+			"backend": backend.Name,
+			"healthy": healthy,
+			"reason":  reason,
+		}).Info("Backend health status changed")
+
+		if healthy {
+			backend.publish(EventBackendHealthy, reason)
+		} else {
+			backend.publish(EventBackendUnhealthy, reason)
+		}
+	}
+}
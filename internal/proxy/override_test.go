@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+)
+
+func TestHealthOverridePrecedence(t *testing.T) {
+	tests := []struct {
+		name    string
+		probe   bool // Health reported by the health checks
+		healthy bool // Forced health
+	}{
+		{name: "unhealthy over passing probes", probe: true, healthy: false},
+		{name: "healthy over failing probes", probe: false, healthy: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newTestLoadBalancer(t, testGroup("api", "round_robin", "http://a:80", "http://b:80"))
+			a := backendFor(t, lb, "http://a:80")
+
+			if _, err := lb.OverrideHealth("http://a:80", tt.healthy, 0); err != nil {
+				t.Fatalf("OverrideHealth: %v", err)
+			}
+
+			// Health checks keep reporting without undoing the override
+			a.SetHealthy(tt.probe)
+			if a.IsHealthy() != tt.healthy {
+				t.Errorf("healthy = %v, want the forced %v", a.IsHealthy(), tt.healthy)
+			}
+			healthy, until, ok := a.HealthOverride()
+			if !ok || healthy != tt.healthy || !until.IsZero() {
+				t.Errorf("override = %v %v %v, want %v without expiry", healthy, until, ok, tt.healthy)
+			}
+
+			selected := false
+			for i := 0; i < 4; i++ {
+				l, err := lb.GetBackendForConfig("api", httptest.NewRequest("GET", "/", nil))
+				if err != nil {
+					t.Fatalf("GetBackendForConfig: %v", err)
+				}
+				selected = selected || l.Backend == a
+				l.Release()
+			}
+			if selected != tt.healthy {
+				t.Errorf("backend selected = %v, want %v", selected, tt.healthy)
+			}
+
+			// Clearing the override returns to the probe results
+			if _, err := lb.ClearHealthOverride(a.Name); err != nil {
+				t.Fatalf("ClearHealthOverride: %v", err)
+			}
+			if _, _, ok := a.HealthOverride(); ok || a.IsHealthy() != tt.probe {
+				t.Errorf("healthy = %v after clearing, want the probe result %v", a.IsHealthy(), tt.probe)
+			}
+		})
+	}
+}
+
+func TestHealthOverrideExpiry(t *testing.T) {
+	lb := newTestLoadBalancer(t, testGroup("api", "round_robin", "http://a:80"))
+	a := backendFor(t, lb, "http://a:80")
+
+	if _, err := lb.OverrideHealth(a.Name, false, 30*time.Millisecond); err != nil {
+		t.Fatalf("OverrideHealth: %v", err)
+	}
+	if _, until, ok := a.HealthOverride(); !ok || time.Until(until) <= 0 {
+		t.Fatalf("override without its expiry")
+	}
+	if a.IsHealthy() {
+		t.Fatalf("backend healthy during the override")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if _, _, ok := a.HealthOverride(); ok || !a.IsHealthy() {
+		t.Errorf("override still in effect after its ttl")
+	}
+}
+
+func TestHealthOverrideReplaced(t *testing.T) {
+	lb := newTestLoadBalancer(t, testGroup("api", "round_robin", "http://a:80"))
+	a := backendFor(t, lb, "http://a:80")
+
+	// The timer of a replaced override leaves the new one in place
+	if _, err := lb.OverrideHealth(a.Name, false, 20*time.Millisecond); err != nil {
+		t.Fatalf("OverrideHealth: %v", err)
+	}
+	if _, err := lb.OverrideHealth(a.Name, false, 0); err != nil {
+		t.Fatalf("OverrideHealth: %v", err)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, _, ok := a.HealthOverride(); !ok || a.IsHealthy() {
+		t.Errorf("override cleared by the timer of the previous one")
+	}
+}
+
+func TestHealthOverrideStatusAndReload(t *testing.T) {
+	cfg := testGroup("api", "round_robin", "http://a:80", "http://b:80")
+	lb := newTestLoadBalancer(t, cfg)
+
+	if _, err := lb.OverrideHealth("http://unknown:80", false, 0); !errors.Is(err, ErrBackendNotFound) {
+		t.Errorf("error %v for an unknown backend, want %v", err, ErrBackendNotFound)
+	}
+	if _, err := lb.OverrideHealth("http://a:80", false, time.Hour); err != nil {
+		t.Fatalf("OverrideHealth: %v", err)
+	}
+
+	// Overrides are kept by backends recreated on reload
+	cfg.Weight = 2
+	if err := lb.UpdateBackends([]config.BackendConfig{cfg}); err != nil {
+		t.Fatalf("UpdateBackends: %v", err)
+	}
+	a := backendFor(t, lb, "http://a:80")
+	if _, _, ok := a.HealthOverride(); !ok || a.IsHealthy() {
+		t.Errorf("override lost on reload")
+	}
+
+	status := lb.GetBackendStatus()[a.Name].(map[string]interface{})
+	override := status["health_override"].(map[string]interface{})
+	if override["state"] != "unhealthy" || override["until"] == nil || status["healthy"] != false {
+		t.Errorf("status %v does not report the override", status)
+	}
+}
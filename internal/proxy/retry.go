@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// retryBudgetWindow is the period over which the retry budget is computed
+	retryBudgetWindow = 10 * time.Second
+
+	// maxRetryBodySize is the largest request body buffered so that the
+	// request can be replayed on another backend
+	maxRetryBodySize = 64 << 10
+)
+
+// retryBudget caps retries to a percentage of the requests sent to a group
+// so that a struggling group is not hit by a retry storm
+type retryBudget struct {
+	mu          sync.Mutex
+	ratio       float64
+	minRetries  int
+	windowStart time.Time
+	requests    int
+	retries     int
+}
+
+// newRetryBudget creates a retry budget for the given policy
+func newRetryBudget(policy config.RetryPolicyConfig) *retryBudget {
+	return &retryBudget{
+		ratio:       policy.BudgetPercent / 100,
+		minRetries:  policy.MinRetriesPerSecond * int(retryBudgetWindow/time.Second),
+		windowStart: time.Now(),
+	}
+}
+
+// matches reports whether the budget enforces the limits of a policy
+func (b *retryBudget) matches(policy config.RetryPolicyConfig) bool {
+	limits := newRetryBudget(policy)
+	return b.ratio == limits.ratio && b.minRetries == limits.minRetries
+}
+
+// roll starts a new window once the current one has elapsed. Must be called
+// with mu held.
+func (b *retryBudget) roll(now time.Time) {
+	if now.Sub(b.windowStart) >= retryBudgetWindow {
+		b.windowStart = now
+		b.requests = 0
+		b.retries = 0
+	}
+}
+
+// recordRequest counts an original (non-retry) request
+func (b *retryBudget) recordRequest() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.roll(time.Now())
+	b.requests++
+}
+
+// tryRetry reserves a retry, returning false if the budget is exhausted
+func (b *retryBudget) tryRetry() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.roll(time.Now())
+	allowed := int(float64(b.requests)*b.ratio) + b.minRetries
+	if b.retries >= allowed {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+// retryBackoff waits before the given retry attempt using exponential backoff
+// with full jitter. It returns false if the context ends first.
+func retryBackoff(ctx context.Context, policy config.RetryPolicyConfig, attempt int) bool {
+	backoff := policy.BackoffBase << uint(attempt-1)
+	if backoff <= 0 || backoff > policy.BackoffMax {
+		backoff = policy.BackoffMax
+	}
+
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff) + 1)))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// isIdempotent reports whether a request may safely be sent more than once
+func isIdempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isUpgrade reports whether the request asks for a protocol upgrade, such as
+// a WebSocket handshake
+func isUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != ""
+}
+
+// makeReplayable buffers a small request body so that it can be sent again on
+// retry. It returns false if the body cannot be replayed.
+func makeReplayable(r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return true
+	}
+	if r.ContentLength > maxRetryBodySize {
+		return false
+	}
+
+	original := r.Body
+	body, err := io.ReadAll(io.LimitReader(original, maxRetryBodySize+1))
+	if err != nil || len(body) > maxRetryBodySize {
+		// Forward the body unchanged; the request just won't be retried
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), original), original}
+		return false
+	}
+	original.Close()
+
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return true
+}
+
+// isConnectionError reports whether an upstream error means the connection
+// to the backend could not be established or broke before a response
+// arrived, so the request can be sent to another backend
+func isConnectionError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var handshakeErr *quic.HandshakeTimeoutError
+	if errors.As(err, &handshakeErr) {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// shouldRetryStatus reports whether a response status is configured as retryable
+func shouldRetryStatus(policy config.RetryPolicyConfig, status int) bool {
+	for _, code := range policy.RetryOn {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+)
+
+func TestIsConnectionError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "dial", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("no route to host")}, want: true},
+		{name: "refused", err: fmt.Errorf("read: %w", &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}), want: true},
+		{name: "reset", err: &net.OpError{Op: "read", Net: "tcp", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}}, want: true},
+		{name: "dns", err: &net.DNSError{Err: "no such host", Name: "backend"}, want: true},
+		{name: "client cancelled", err: context.Canceled, want: false},
+		{name: "deadline", err: context.DeadlineExceeded, want: false},
+		{name: "other", err: errors.New("tls: bad certificate"), want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isConnectionError(tt.err); got != tt.want {
+			t.Errorf("%s: isConnectionError = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestShouldRetryStopsForCancelledClient(t *testing.T) {
+	transport := &upstreamTransport{config: &config.BackendConfig{}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+	if !transport.shouldRetry(req, nil, refused) {
+		t.Errorf("connection refused was not retried")
+	}
+	cancel()
+	if transport.shouldRetry(req, nil, refused) {
+		t.Errorf("retried after the client went away")
+	}
+}
+
+// closedAddress returns the URL of a local port nothing listens on
+func closedAddress(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return "http://" + addr
+}
+
+func TestHandlerRetriesConnectionErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	retries := func(n int) *int { return &n }
+
+	tests := []struct {
+		name       string
+		retryCount *int
+		wantFailed bool
+	}{
+		{name: "retries enabled", retryCount: retries(1), wantFailed: false},
+		{name: "retries disabled", retryCount: retries(0), wantFailed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group := testGroup("web", "round_robin", closedAddress(t), upstream.URL)
+			group.RetryCount = tt.retryCount
+			group.RetryPolicy = config.RetryPolicyConfig{BudgetPercent: 100, MinRetriesPerSecond: 10}
+
+			cfg := &config.Config{Backends: []config.BackendConfig{group}}
+			router, err := NewRouter(cfg)
+			if err != nil {
+				t.Fatalf("NewRouter: %v", err)
+			}
+			handler := NewHandler(router, newTestLoadBalancer(t, group), nil)
+
+			failed := false
+			for i := 0; i < 4; i++ {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+				if rec.Code != http.StatusOK {
+					failed = true
+				}
+			}
+			if failed != tt.wantFailed {
+				t.Errorf("some requests failed: %v, want %v", failed, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestRetryBudgetsAcrossReload(t *testing.T) {
+	policy := config.RetryPolicyConfig{BudgetPercent: 20, MinRetriesPerSecond: 3}
+	routes := func(policy config.RetryPolicyConfig, names ...string) *Router {
+		cfg := &config.Config{}
+		for _, name := range names {
+			group := testGroup(name, "round_robin", "http://"+name+":80")
+			group.RetryPolicy = policy
+			cfg.Backends = append(cfg.Backends, group)
+		}
+		router, err := NewRouter(cfg)
+		if err != nil {
+			t.Fatalf("NewRouter: %v", err)
+		}
+		return router
+	}
+	budgetOf := func(h *Handler, name string) *retryBudget {
+		backend, ok := h.router.Load().GetBackend(name)
+		if !ok {
+			t.Fatalf("group %s not routed", name)
+		}
+		return h.retryBudget(backend)
+	}
+
+	h := NewHandler(routes(policy, "web", "api"), nil, nil)
+	first := budgetOf(h, "web")
+	budgetOf(h, "api")
+
+	tests := []struct {
+		name   string
+		change func(*config.RetryPolicyConfig)
+		kept   bool
+	}{
+		{name: "unchanged", change: func(*config.RetryPolicyConfig) {}, kept: true},
+		{name: "other retry settings", change: func(p *config.RetryPolicyConfig) { p.PerTryTimeout = time.Second }, kept: true},
+		{name: "budget percent", change: func(p *config.RetryPolicyConfig) { p.BudgetPercent = 50 }},
+		{name: "minimum retries", change: func(p *config.RetryPolicyConfig) { p.MinRetriesPerSecond = 10 }},
+	}
+
+	for _, tt := range tests {
+		changed := policy
+		tt.change(&changed)
+		h.SetRouter(routes(changed, "web"))
+
+		budget := budgetOf(h, "web")
+		if kept := budget == first; kept != tt.kept {
+			t.Errorf("%s: budget kept = %v, want %v", tt.name, kept, tt.kept)
+		}
+		if !budget.matches(changed) {
+			t.Errorf("%s: budget allows %v%% and %d retries, want the reloaded policy", tt.name, budget.ratio*100, budget.minRetries)
+		}
+		if _, ok := h.retryBudgets["api"]; ok {
+			t.Errorf("%s: budget of the removed group kept", tt.name)
+		}
+		first = budget
+	}
+}
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// pathPattern is a compiled route path. Segments are matched literally,
+// except that "*" matches any single segment, or any remainder as the last
+// segment, "**" matches any number of segments including none, and "{name}"
+// captures a parameter within a segment. A "*" that is only part of a segment
+// is matched literally, as it always has been.
+type pathPattern struct {
+	exact  string         // Set for patterns without wildcards or parameters
+	prefix string         // Literal part before the first wildcard or parameter
+	re     *regexp.Regexp // Set otherwise
+	rest   int            // Group of re capturing a trailing wildcard, 0 if none
+}
+
+// paramName is a valid name of a captured parameter
+var paramName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// paramRef finds parameters referenced in a rewrite or header template
+var paramRef = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// compilePathPattern compiles a route path pattern
+func compilePathPattern(pattern string) (*pathPattern, error) {
+	pattern = path.Clean(pattern)
+	if !strings.ContainsAny(pattern, "*{}") {
+		return &pathPattern{exact: pattern}, nil
+	}
+
+	segments := strings.Split(strings.Trim(pattern, "/"), "/")
+	seen := make(map[string]bool)
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	literal := true
+	var prefix strings.Builder
+	rest := 0
+	for i, segment := range segments {
+		last := i == len(segments)-1
+
+		switch {
+		case (segment == "**" || segment == "*") && last:
+			// Also matches the path without any remainder: /api/** matches /api
+			expr.WriteString("((?:/.*)?)")
+			rest = len(seen) + 1
+			literal = false
+			continue
+		case segment == "**":
+			expr.WriteString("(?:/.*)?")
+			literal = false
+			continue
+		case segment == "*":
+			expr.WriteString("/[^/]+")
+			literal = false
+			continue
+		}
+
+		expr.WriteString("/")
+		if literal {
+			prefix.WriteString("/")
+		}
+		for segment != "" {
+			open := strings.IndexByte(segment, '{')
+			if open < 0 {
+				if strings.Contains(segment, "}") {
+					return nil, fmt.Errorf("invalid path pattern %s: unexpected }", pattern)
+				}
+				expr.WriteString(regexp.QuoteMeta(segment))
+				if literal {
+					prefix.WriteString(segment)
+				}
+				break
+			}
+
+			end := strings.IndexByte(segment[open:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path pattern %s: unclosed {", pattern)
+			}
+			if strings.Contains(segment[:open], "}") {
+				return nil, fmt.Errorf("invalid path pattern %s: unexpected }", pattern)
+			}
+			name := segment[open+1 : open+end]
+			if !paramName.MatchString(name) {
+				return nil, fmt.Errorf("invalid path pattern %s: invalid parameter name %q", pattern, name)
+			}
+			if seen[name] {
+				return nil, fmt.Errorf("invalid path pattern %s: duplicate parameter %s", pattern, name)
+			}
+			seen[name] = true
+
+			expr.WriteString(regexp.QuoteMeta(segment[:open]))
+			expr.WriteString("(?P<" + name + ">[^/]+)")
+			if literal {
+				prefix.WriteString(segment[:open])
+			}
+			literal = false
+			segment = segment[open+end+1:]
+		}
+	}
+	expr.WriteString("$")
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid path pattern %s: %w", pattern, err)
+	}
+	return &pathPattern{prefix: prefix.String(), re: re, rest: rest}, nil
+}
+
+// match reports whether a cleaned request path matches the pattern, adding
+// the captured parameters to params
+func (p *pathPattern) match(requestPath string, params map[string]string) bool {
+	if p.re == nil {
+		return requestPath == p.exact
+	}
+	if !strings.HasPrefix(requestPath, p.prefix) {
+		return false
+	}
+	return matchRegexp(p.re, requestPath, params)
+}
+
+// prefixOf returns the part of a cleaned request path matched before the
+// trailing wildcard of the pattern, or false if the pattern has none or
+// does not match
+func (p *pathPattern) prefixOf(requestPath string) (string, bool) {
+	if p.rest == 0 {
+		return "", false
+	}
+	loc := p.re.FindStringSubmatchIndex(requestPath)
+	if loc == nil {
+		return "", false
+	}
+	return requestPath[:loc[2*p.rest]], true
+}
+
+// names returns the parameters captured by the pattern
+func (p *pathPattern) names() []string {
+	if p.re == nil {
+		return nil
+	}
+	return p.re.SubexpNames()
+}
+
+// compilePathRegex compiles a route path regular expression, anchored to
+// match the whole path. Named groups are captured as parameters.
+func compilePathRegex(expr string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid path regex %s: %w", expr, err)
+	}
+	return re, nil
+}
+
+// matchRegexp reports whether value matches re, adding its named groups to
+// params
+func matchRegexp(re *regexp.Regexp, value string, params map[string]string) bool {
+	groups := re.FindStringSubmatch(value)
+	if groups == nil {
+		return false
+	}
+	for i, name := range re.SubexpNames() {
+		if name != "" && i < len(groups) {
+			params[name] = groups[i]
+		}
+	}
+	return true
+}
+
+// checkTemplate returns an error if a rewrite or header template refers to
+// a parameter not in names
+func checkTemplate(template string, names map[string]bool) error {
+	for _, ref := range paramRef.FindAllStringSubmatch(template, -1) {
+		if !names[ref[1]] {
+			return fmt.Errorf("unknown path parameter %s in %q", ref[1], template)
+		}
+	}
+	return nil
+}
+
+// expandTemplate replaces the {name} references in a template with the
+// captured parameters
+func expandTemplate(template string, params map[string]string) string {
+	if !strings.Contains(template, "{") {
+		return template
+	}
+	return paramRef.ReplaceAllStringFunc(template, func(ref string) string {
+		return params[ref[1:len(ref)-1]]
+	})
+}
+
+// routeParamsKey is the context key of the parameters captured by a route
+type routeParamsKey struct{}
+
+// withRouteParams returns a copy of the request carrying the parameters
+// captured by its route
+func withRouteParams(req *http.Request, params map[string]string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), routeParamsKey{}, params))
+}
+
+// RouteParams returns the path parameters captured by the route of a
+// request, or nil if none were
+func RouteParams(req *http.Request) map[string]string {
+	params, _ := req.Context().Value(routeParamsKey{}).(map[string]string)
+	return params
+}
@@ -1,9 +1,11 @@
 package proxy
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"path"
+	"regexp"
 	"sort"
 	"strings"
 
@@ -12,11 +14,20 @@ import (
 
 // Router handles request routing based on configured rules
 type Router struct {
-	rules          []config.RouteRule
+	routes         []route
 	defaultBackend string
 	backends       map[string]*config.BackendConfig
 }
 
+// route is a routing rule with its path patterns compiled
+type route struct {
+	rule      config.RouteRule
+	key       string         // Identifies the rule across reloads, see routeKey
+	path      *pathPattern   // nil when the rule has no path
+	pathRegex *regexp.Regexp // nil when the rule has no path_regex
+	captures  bool           // Whether the patterns capture parameters
+}
+
 // NewRouter creates a new router with the given configuration
 func NewRouter(cfg *config.Config) (*Router, error) {
 	if len(cfg.Backends) == 0 {
@@ -36,6 +47,16 @@ func NewRouter(cfg *config.Config) (*Router, error) {
 		return rules[i].Priority > rules[j].Priority
 	})
 
+	// Compile the path patterns once rather than on every request
+	routes := make([]route, len(rules))
+	for i, rule := range rules {
+		compiled, err := compileRoute(rule)
+		if err != nil {
+			return nil, fmt.Errorf("route to %s: %w", rule.Backend, err)
+		}
+		routes[i] = compiled
+	}
+
 	// Set default backend
 	defaultBackend := cfg.Routing.DefaultBackend
 	if defaultBackend == "" && len(cfg.Backends) > 0 {
@@ -43,22 +64,112 @@ func NewRouter(cfg *config.Config) (*Router, error) {
 	}
 
 	return &Router{
-		rules:          rules,
+		routes:         routes,
 		defaultBackend: defaultBackend,
 		backends:       backends,
 	}, nil
 }
 
+// compileRoute compiles the path patterns of a rule and checks that its
+// rewrite and headers only refer to parameters the patterns capture
+func compileRoute(rule config.RouteRule) (route, error) {
+	compiled := route{rule: rule, key: routeKey(rule)}
+	names := make(map[string]bool)
+
+	if rule.Path != "" {
+		pattern, err := compilePathPattern(rule.Path)
+		if err != nil {
+			return route{}, err
+		}
+		compiled.path = pattern
+		for _, name := range pattern.names() {
+			if name != "" {
+				names[name] = true
+			}
+		}
+	}
+
+	if rule.PathRegex != "" {
+		re, err := compilePathRegex(rule.PathRegex)
+		if err != nil {
+			return route{}, err
+		}
+		compiled.pathRegex = re
+		for _, name := range re.SubexpNames() {
+			if name != "" {
+				names[name] = true
+			}
+		}
+	}
+
+	compiled.captures = len(names) > 0
+
+	if err := checkTemplate(rule.Rewrite, names); err != nil {
+		return route{}, fmt.Errorf("rewrite: %w", err)
+	}
+	for header, value := range rule.RequestHeaders {
+		if err := checkTemplate(value, names); err != nil {
+			return route{}, fmt.Errorf("request header %s: %w", header, err)
+		}
+	}
+	return compiled, nil
+}
+
+// routeKey identifies a rule by its settings, so the state kept for a rule
+// carries over reloads that leave it unchanged
+func routeKey(rule config.RouteRule) string {
+	key, _ := json.Marshal(rule)
+	return string(key)
+}
+
+// hasRoute reports whether the router has a rule with the given key
+func (r *Router) hasRoute(key string) bool {
+	for i := range r.routes {
+		if r.routes[i].key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// RouteMatch is the outcome of routing a request
+type RouteMatch struct {
+	Rule    *config.RouteRule // nil when the default backend was used
+	Backend *config.BackendConfig
+	Params  map[string]string // Parameters captured from the path, if any
+	key     string            // Key of the rule, see routeKey
+
+	// StripPrefix is the part of the path removed before forwarding, empty
+	// if the rule does not strip its prefix
+	StripPrefix string
+}
+
 // Route finds the appropriate backend for the given request
 func (r *Router) Route(req *http.Request) (*config.BackendConfig, error) {
+	match, err := r.Match(req)
+	if err != nil {
+		return nil, err
+	}
+	return match.Backend, nil
+}
+
+// Match finds the rule and backend for the given request
+func (r *Router) Match(req *http.Request) (*RouteMatch, error) {
 	// Try each rule in priority order
-	for _, rule := range r.rules {
-		if r.matchRule(req, &rule) {
-			backend, ok := r.backends[rule.Backend]
+	for i := range r.routes {
+		route := &r.routes[i]
+		if params, ok := r.matchRule(req, route); ok {
+			backend, ok := r.backends[route.rule.Backend]
 			if !ok {
-				return nil, fmt.Errorf("backend not found: %s", rule.Backend)
+				return nil, fmt.Errorf("backend not found: %s", route.rule.Backend)
 			}
-			return backend, nil
+			return &RouteMatch{
+				Rule:        &route.rule,
+				Backend:     backend,
+				Params:      params,
+				key:         route.key,
+				StripPrefix: route.stripPrefix(req),
+			}, nil
 		}
 	}
 
@@ -66,33 +177,62 @@ func (r *Router) Route(req *http.Request) (*config.BackendConfig, error) {
 	if r.defaultBackend != "" {
 		backend, ok := r.backends[r.defaultBackend]
 		if ok {
-			return backend, nil
+			return &RouteMatch{Backend: backend}, nil
 		}
 	}
 
 	return nil, fmt.Errorf("no matching route found for: %s %s", req.Method, req.URL.Path)
 }
 
-// matchRule checks if a request matches a routing rule
-func (r *Router) matchRule(req *http.Request, rule *config.RouteRule) bool {
-	// Check path pattern
-	if rule.Path != "" {
-		if !r.matchPath(req.URL.Path, rule.Path) {
-			return false
+// stripPrefix returns the prefix a matched request is forwarded without:
+// the path_prefix of the rule, or the path matched before the trailing
+// wildcard of its path pattern
+func (r *route) stripPrefix(req *http.Request) string {
+	if !r.rule.StripPrefix {
+		return ""
+	}
+	if r.rule.PathPrefix != "" {
+		return r.rule.PathPrefix
+	}
+	if r.path != nil {
+		prefix, _ := r.path.prefixOf(path.Clean(req.URL.Path))
+		return prefix
+	}
+	return ""
+}
+
+// matchRule checks if a request matches a routing rule, returning the
+// parameters captured from its path
+func (r *Router) matchRule(req *http.Request, route *route) (map[string]string, bool) {
+	rule := &route.rule
+
+	var params map[string]string
+	if route.captures {
+		params = make(map[string]string)
+	}
+
+	// Check path patterns
+	if route.path != nil || route.pathRegex != nil {
+		requestPath := path.Clean(req.URL.Path)
+		if route.path != nil && !route.path.match(requestPath, params) {
+			return nil, false
+		}
+		if route.pathRegex != nil && !matchRegexp(route.pathRegex, requestPath, params) {
+			return nil, false
 		}
 	}
 
 	// Check path prefix
 	if rule.PathPrefix != "" {
 		if !strings.HasPrefix(req.URL.Path, rule.PathPrefix) {
-			return false
+			return nil, false
 		}
 	}
 
 	// Check host
 	if rule.Host != "" {
 		if req.Host != rule.Host {
-			return false
+			return nil, false
 		}
 	}
 
@@ -106,7 +246,7 @@ func (r *Router) matchRule(req *http.Request, rule *config.RouteRule) bool {
 			}
 		}
 		if !methodMatch {
-			return false
+			return nil, false
 		}
 	}
 
@@ -114,62 +254,12 @@ func (r *Router) matchRule(req *http.Request, rule *config.RouteRule) bool {
 	if len(rule.Headers) > 0 {
 		for key, value := range rule.Headers {
 			if req.Header.Get(key) != value {
-				return false
+				return nil, false
 			}
 		}
 	}
 
-	return true
-}
-
-// matchPath checks if a path matches a pattern (supports wildcards)
-func (r *Router) matchPath(requestPath, pattern string) bool {
-	// Clean paths
-	requestPath = path.Clean(requestPath)
-	pattern = path.Clean(pattern)
-
-	// Exact match
-	if requestPath == pattern {
-		return true
-	}
-
-	// Wildcard match: /api/* matches /api/users, /api/posts, etc.
-	if strings.HasSuffix(pattern, "/*") {
-		prefix := strings.TrimSuffix(pattern, "/*")
-		if prefix == "" {
-			return true // /* matches everything
-		}
-		return strings.HasPrefix(requestPath, prefix+"/") || requestPath == prefix
-	}
-
-	// Single wildcard: /api/*/details matches /api/123/details
-	if strings.Contains(pattern, "*") {
-		return r.matchWildcard(requestPath, pattern)
-	}
-
-	return false
-}
-
-// matchWildcard matches paths with wildcards
-func (r *Router) matchWildcard(requestPath, pattern string) bool {
-	// Split into segments
-	pathSegments := strings.Split(strings.Trim(requestPath, "/"), "/")
-	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
-
-	if len(pathSegments) != len(patternSegments) {
-		return false
-	}
-
-	for i := range patternSegments {
-		if patternSegments[i] == "*" {
-			continue
-		}
-		if pathSegments[i] != patternSegments[i] {
-			return false
-		}
-	}
-
-	return true
+	return params, true
 }
 
 // GetBackend returns a backend by name
@@ -182,19 +272,3 @@ func (r *Router) GetBackend(name string) (*config.BackendConfig, bool) {
 func (r *Router) GetAllBackends() map[string]*config.BackendConfig {
 	return r.backends
 }
-
-// ShouldStripPrefix checks if the prefix should be stripped for this request
-func (r *Router) ShouldStripPrefix(req *http.Request) (bool, string) {
-	for _, rule := range r.rules {
-		if r.matchRule(req, &rule) && rule.StripPrefix {
-			if rule.PathPrefix != "" {
-				return true, rule.PathPrefix
-			}
-			if rule.Path != "" && strings.HasSuffix(rule.Path, "/*") {
-				prefix := strings.TrimSuffix(rule.Path, "/*")
-				return true, prefix
-			}
-		}
-	}
-	return false, ""
-}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+)
+
+func newTestRouter(t *testing.T, rules ...config.RouteRule) *Router {
+	t.Helper()
+
+	router, err := NewRouter(&config.Config{
+		Backends: []config.BackendConfig{{Name: "default"}, {Name: "api"}},
+		Routing:  config.RoutingConfig{Rules: rules, DefaultBackend: "default"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	return router
+}
+
+func TestRouterPathPatterns(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		match   bool
+		params  map[string]string
+	}{
+		{"/api", "/api", true, nil},
+		{"/api", "/api/users", false, nil},
+		{"/api/*", "/api", true, nil},
+		{"/api/*", "/api/users/42", true, nil},
+		{"/api/*", "/apis", false, nil},
+		{"/api/*/details", "/api/42/details", true, nil},
+		{"/api/*/details", "/api/42/43/details", false, nil},
+		{"/api/**", "/api", true, nil},
+		{"/api/**", "/api/users/42", true, nil},
+		{"/api/**/raw", "/api/a/b/raw", true, nil},
+		{"/api/**/raw", "/api/raw", true, nil},
+		{"/api/**/raw", "/api/a/b", false, nil},
+		{"/users/{id}", "/users/42", true, map[string]string{"id": "42"}},
+		{"/users/{id}", "/users/42/posts", false, nil},
+		{"/users/{id}", "/users/", false, nil},
+		{"/users/{user}/posts/{post}", "/users/7/posts/9", true, map[string]string{"user": "7", "post": "9"}},
+		{"/files/{name}.json", "/files/report.json", true, map[string]string{"name": "report"}},
+		{"/files/{name}.json", "/files/report.xml", false, nil},
+		{"/v1.0/{id}", "/v1x0/42", false, nil},
+		// A * within a segment is matched literally
+		{"/files/*.jpg", "/files/*.jpg", true, nil},
+		{"/files/*.jpg", "/files/a.jpg", false, nil},
+		{"/files/x*/{name}", "/files/x*/a", true, map[string]string{"name": "a"}},
+		{"/files/x*/{name}", "/files/xy/a", false, nil},
+	}
+
+	for _, tt := range tests {
+		router := newTestRouter(t, config.RouteRule{Path: tt.pattern, Backend: "api"})
+		match, err := router.Match(httptest.NewRequest("GET", tt.path, nil))
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.pattern, tt.path, err)
+		}
+
+		if matched := match.Backend.Name == "api"; matched != tt.match {
+			t.Errorf("%s %s: matched %v, want %v", tt.pattern, tt.path, matched, tt.match)
+			continue
+		}
+		if tt.match && !reflect.DeepEqual(match.Params, tt.params) && (len(match.Params) != 0 || len(tt.params) != 0) {
+			t.Errorf("%s %s: params %v, want %v", tt.pattern, tt.path, match.Params, tt.params)
+		}
+	}
+}
+
+func TestRouterPathRegex(t *testing.T) {
+	router := newTestRouter(t, config.RouteRule{PathRegex: `/orders/(?P<id>[0-9]+)`, Backend: "api"})
+
+	match, err := router.Match(httptest.NewRequest("GET", "/orders/123", nil))
+	if err != nil || match.Backend.Name != "api" {
+		t.Fatalf("regex did not match /orders/123: %v", err)
+	}
+	if match.Params["id"] != "123" {
+		t.Errorf("captured id %q, want 123", match.Params["id"])
+	}
+
+	// The expression is anchored to the whole path
+	for _, path := range []string{"/orders/abc", "/orders/123/items", "/v2/orders/123"} {
+		match, err := router.Match(httptest.NewRequest("GET", path, nil))
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if match.Backend.Name == "api" {
+			t.Errorf("regex matched %s", path)
+		}
+	}
+}
+
+func TestRouterRewriteAndHeaders(t *testing.T) {
+	router := newTestRouter(t, config.RouteRule{
+		Path:           "/users/{id}/avatar",
+		Backend:        "api",
+		Rewrite:        "/v2/avatars/{id}",
+		RequestHeaders: map[string]string{"X-User-ID": "{id}"},
+	})
+
+	req := httptest.NewRequest("GET", "/users/42/avatar", nil)
+	match, err := router.Match(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyRoute(req, match)
+
+	if req.URL.Path != "/v2/avatars/42" {
+		t.Errorf("rewritten path %s, want /v2/avatars/42", req.URL.Path)
+	}
+	if got := req.Header.Get("X-User-ID"); got != "42" {
+		t.Errorf("X-User-ID %q, want 42", got)
+	}
+}
+
+func TestRouterStripPrefix(t *testing.T) {
+	tests := []struct {
+		rules []config.RouteRule
+		path  string
+		strip string
+	}{
+		{[]config.RouteRule{{PathPrefix: "/api", StripPrefix: true, Backend: "api"}}, "/api/users", "/api"},
+		{[]config.RouteRule{{Path: "/api/**", StripPrefix: true, Backend: "api"}}, "/api/users/42", "/api"},
+		{[]config.RouteRule{{Path: "/api/*", StripPrefix: true, Backend: "api"}}, "/api", "/api"},
+		{[]config.RouteRule{{Path: "/users/{id}/**", StripPrefix: true, Backend: "api"}}, "/users/42/posts", "/users/42"},
+		{[]config.RouteRule{{Path: "/a/**/raw/**", StripPrefix: true, Backend: "api"}}, "/a/b/raw/c", "/a/b/raw"},
+		{[]config.RouteRule{{Path: "/users/{id}", StripPrefix: true, Backend: "api"}}, "/users/42", ""},
+		{[]config.RouteRule{{Path: "/api/**", Backend: "api"}}, "/api/users", ""},
+		// The rule chosen by priority decides, not the first rule that strips
+		{[]config.RouteRule{
+			{Path: "/api/**", StripPrefix: true, Backend: "api"},
+			{Path: "/api/v2/**", Priority: 10, Backend: "api"},
+		}, "/api/v2/users", ""},
+		{[]config.RouteRule{
+			{Path: "/api/**", Backend: "api"},
+			{Path: "/api/v2/**", StripPrefix: true, Priority: 10, Backend: "api"},
+		}, "/api/v2/users", "/api/v2"},
+	}
+
+	for _, tt := range tests {
+		router := newTestRouter(t, tt.rules...)
+		match, err := router.Match(httptest.NewRequest("GET", tt.path, nil))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		if match.StripPrefix != tt.strip {
+			t.Errorf("%+v %s: strip %q, want %q", tt.rules, tt.path, match.StripPrefix, tt.strip)
+		}
+	}
+}
+
+func TestRouterInvalidPatterns(t *testing.T) {
+	rules := []config.RouteRule{
+		{Path: "/users/{id", Backend: "api"},
+		{Path: "/users/{1d}", Backend: "api"},
+		{Path: "/users/{id}/{id}", Backend: "api"},
+		{PathRegex: "/users/(", Backend: "api"},
+		{Path: "/users/{id}", Rewrite: "/v2/{user}", Backend: "api"},
+		{Path: "/users/*", RequestHeaders: map[string]string{"X-User": "{id}"}, Backend: "api"},
+	}
+
+	for _, rule := range rules {
+		_, err := NewRouter(&config.Config{
+			Backends: []config.BackendConfig{{Name: "api"}},
+			Routing:  config.RoutingConfig{Rules: []config.RouteRule{rule}},
+		})
+		if err == nil {
+			t.Errorf("rule %+v was accepted", rule)
+		}
+	}
+}
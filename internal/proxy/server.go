@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/os-dev/quic-reverse-proxy/internal/config"
+	"github.com/os-dev/quic-reverse-proxy/internal/discovery"
 	"github.com/os-dev/quic-reverse-proxy/internal/quic"
 	"github.com/os-dev/quic-reverse-proxy/internal/telemetry"
 	"github.com/sirupsen/logrus"
@@ -22,6 +24,11 @@ type Server struct {
 	handler      *Handler
 	telemetry    *telemetry.Manager
 	loadBalancer *LoadBalancer
+	discovery    *discovery.Manager
+	webhooks     *webhooks
+
+	mu         sync.Mutex                   // Guards config, router, discovery and discovered
+	discovered map[string]discovery.Targets // Latest targets by discovery provider
 }
 
 // NewServer creates a new reverse proxy server
@@ -37,6 +44,13 @@ func NewServer(cfg *config.Config, telemetryManager *telemetry.Manager) (*Server
 	if err != nil {
 		return nil, fmt.Errorf("failed to create load balancer: %w", err)
 	}
+	loadBalancer.SetLocality(cfg.Server.Locality)
+
+	// Create service discovery providers
+	discoveryManager, err := discovery.NewManager(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create service discovery: %w", err)
+	}
 
 	// Create proxy handler with router
 	handler := NewHandler(router, loadBalancer, telemetryManager.GetMetrics())
@@ -74,6 +88,8 @@ func NewServer(cfg *config.Config, telemetryManager *telemetry.Manager) (*Server
 		handler:      handler,
 		telemetry:    telemetryManager,
 		loadBalancer: loadBalancer,
+		discovery:    discoveryManager,
+		discovered:   make(map[string]discovery.Targets),
 	}, nil
 }
 
@@ -82,6 +98,17 @@ func (s *Server) Start() error {
 	// Start health checks
 	s.loadBalancer.StartHealthChecks()
 
+	// Start watching for discovered targets
+	s.mu.Lock()
+	discoveryManager := s.discovery
+	s.mu.Unlock()
+	discoveryManager.Start(s.discoveryApply(discoveryManager))
+
+	// Start pushing backend events to webhooks
+	s.mu.Lock()
+	s.webhooks = startWebhooks(s.loadBalancer.Events(), s.config.Events)
+	s.mu.Unlock()
+
 	logrus.WithFields(logrus.Fields{
 		"address":  s.config.Server.Address,
 		"backends": len(s.config.Backends),
@@ -115,9 +142,19 @@ func (s *Server) Start() error {
 func (s *Server) Shutdown(ctx context.Context) error {
 	logrus.Info("Shutting down reverse proxy server")
 
-	// Stop health checks
+	// Stop service discovery and health checks
+	s.mu.Lock()
+	discoveryManager := s.discovery
+	s.mu.Unlock()
+	discoveryManager.Stop()
 	s.loadBalancer.StopHealthChecks()
 
+	// Stop pushing events
+	s.mu.Lock()
+	s.webhooks.stop()
+	s.webhooks = nil
+	s.mu.Unlock()
+
 	// Shutdown HTTP fallback server
 	if s.httpServer != nil {
 		if err := s.httpServer.Shutdown(ctx); err != nil {
@@ -141,22 +178,129 @@ func (s *Server) GetMetrics() *telemetry.Metrics {
 	return s.telemetry.GetMetrics()
 }
 
+// GetLoadBalancer returns the load balancer of the server
+func (s *Server) GetLoadBalancer() *LoadBalancer {
+	return s.loadBalancer
+}
+
 // ReloadConfig reloads the server configuration
 func (s *Server) ReloadConfig(newConfig *config.Config) error {
 	logrus.Info("Reloading server configuration")
 
-	// Update backend configuration
-	if err := s.loadBalancer.UpdateBackends(newConfig.Backends); err != nil {
+	// Build the new routes first, so an invalid rule rejects the reload
+	router, err := NewRouter(newConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create router: %w", err)
+	}
+
+	s.mu.Lock()
+
+	// Create new discovery providers if they changed. The targets of the
+	// providers that remain are kept until they report again.
+	discoveryManager, discovered := s.discovery, s.discovered
+	restartDiscovery := !discovery.SameProviders(s.config, newConfig)
+	if restartDiscovery {
+		if discoveryManager, err = discovery.NewManager(newConfig); err != nil {
+			s.mu.Unlock()
+			return fmt.Errorf("failed to create service discovery: %w", err)
+		}
+
+		discovered = make(map[string]discovery.Targets)
+		for provider, targets := range s.discovered {
+			if discoveryManager.Has(provider) {
+				discovered[provider] = targets
+			}
+		}
+	}
+
+	// Update backend configuration, keeping the discovered targets. Nothing
+	// else changes if the new backends are rejected.
+	if err := s.loadBalancer.UpdateBackends(discovery.Merge(newConfig.Backends, discovered)); err != nil {
+		s.mu.Unlock()
 		return fmt.Errorf("failed to update backends: %w", err)
 	}
+	s.loadBalancer.SetLocality(newConfig.Server.Locality)
+
+	// Restart the webhooks if they changed
+	if s.webhooks != nil && !sameWebhooks(s.config.Events, newConfig.Events) {
+		s.webhooks.stop()
+		s.webhooks = startWebhooks(s.loadBalancer.Events(), newConfig.Events)
+	}
+
+	// Route requests with the new rules
+	s.router = router
+	s.handler.SetRouter(router)
 
 	// Update configuration
+	previous := s.discovery
 	s.config = newConfig
+	s.discovery = discoveryManager
+	s.discovered = discovered
+	s.mu.Unlock()
+
+	// Providers apply their targets under mu, so they must be stopped
+	// without holding it. Targets the old providers report meanwhile are
+	// ignored by applyDiscoveredTargets.
+	if restartDiscovery {
+		previous.Stop()
+		discoveryManager.Start(s.discoveryApply(discoveryManager))
+	}
 
 	logrus.Info("Configuration reloaded successfully")
 	return nil
 }
 
+// discoveryApply returns the function applying the targets reported by the
+// providers of a discovery manager
+func (s *Server) discoveryApply(manager *discovery.Manager) discovery.ApplyFunc {
+	return func(provider string, targets discovery.Targets) {
+		s.applyDiscoveredTargets(manager, provider, targets)
+	}
+}
+
+// applyDiscoveredTargets applies the latest targets of a discovery provider
+// to the load balancer, unless its manager was replaced by a reload
+func (s *Server) applyDiscoveredTargets(manager *discovery.Manager, provider string, targets discovery.Targets) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if manager != s.discovery {
+		return
+	}
+
+	// Only the groups this provider reported on, now or before, change
+	groups := make(map[string]bool)
+	for group := range s.discovered[provider] {
+		groups[group] = true
+	}
+	for group := range targets {
+		if _, ok := s.router.GetBackend(group); !ok {
+			logrus.WithFields(logrus.Fields{
+				"provider": provider,
+				"group":    group,
+			}).Warn("Ignoring discovered targets for unknown backend group")
+			continue
+		}
+		groups[group] = true
+	}
+	s.discovered[provider] = targets
+
+	for _, backend := range discovery.Merge(s.config.Backends, s.discovered) {
+		if !groups[backend.Name] {
+			continue
+		}
+		if err := s.loadBalancer.SetGroupTargets(backend.Name, backend.Targets); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"provider": provider,
+				"group":    backend.Name,
+				"error":    err.Error(),
+			}).Error("Failed to apply discovered targets")
+		}
+	}
+
+	logrus.WithField("provider", provider).Info("Applied discovered targets")
+}
+
 // HealthCheck returns the server health status
 func (s *Server) HealthCheck() map[string]interface{} {
 	status := map[string]interface{}{
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+	"github.com/os-dev/quic-reverse-proxy/internal/discovery"
+)
+
+// newDiscoveringServer returns a server watching the targets listed in a
+// file_sd file, with the file path
+func newDiscoveringServer(t *testing.T, backends ...config.BackendConfig) (*Server, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "targets.yaml")
+	writeTargets(t, path, "http://d:80")
+
+	cfg := &config.Config{Backends: backends}
+	cfg.Discovery.FileSD = []config.FileSDConfig{{Files: []string{path}, RefreshInterval: 10 * time.Millisecond}}
+
+	router, err := NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+	manager, err := discovery.NewManager(cfg)
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	lb := newTestLoadBalancer(t, backends...)
+	s := &Server{
+		config:       cfg,
+		router:       router,
+		handler:      NewHandler(router, lb, nil),
+		loadBalancer: lb,
+		discovery:    manager,
+		discovered:   make(map[string]discovery.Targets),
+	}
+	manager.Start(s.discoveryApply(manager))
+	t.Cleanup(func() {
+		s.mu.Lock()
+		manager := s.discovery
+		s.mu.Unlock()
+		manager.Stop()
+	})
+	return s, path
+}
+
+// writeTargets replaces the file_sd file with targets for the web group
+func writeTargets(t *testing.T, path string, url string) {
+	t.Helper()
+
+	data := "- backend: web\n  targets: [\"" + url + "\"]\n"
+	if err := os.WriteFile(path+".tmp", []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitTarget waits for the load balancer to serve or stop serving a target
+func waitTarget(t *testing.T, lb *LoadBalancer, url string, present bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for (len(lb.FindBackends(url)) > 0) != present {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never became present = %v", url, present)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReloadConfigDiscovery(t *testing.T) {
+	web := testGroup("web", "round_robin", "http://a:80")
+	s, path := newDiscoveringServer(t, web)
+	waitTarget(t, s.loadBalancer, "http://d:80", true)
+
+	s.mu.Lock()
+	manager := s.discovery
+	s.mu.Unlock()
+
+	// A rejected reload leaves the running providers and their targets
+	// alone, even when it changes the providers
+	invalid := *s.config
+	invalid.Discovery.FileSD = []config.FileSDConfig{{Files: []string{path}, RefreshInterval: 20 * time.Millisecond}}
+	broken := checkedGroup("web", "http://a:80")
+	broken.HealthCheck.Expect.BodyRegex = "("
+	invalid.Backends = []config.BackendConfig{broken}
+	if err := s.ReloadConfig(&invalid); err == nil {
+		t.Fatalf("ReloadConfig accepted an invalid backend")
+	}
+	s.mu.Lock()
+	unchanged := s.discovery == manager && len(s.discovered) == 1
+	s.mu.Unlock()
+	if !unchanged {
+		t.Fatalf("discovery replaced by a rejected reload")
+	}
+	waitTarget(t, s.loadBalancer, "http://d:80", true)
+	writeTargets(t, path, "http://e:80")
+	waitTarget(t, s.loadBalancer, "http://e:80", true)
+
+	// Changing the providers keeps the targets discovered so far until the
+	// new providers report
+	valid := invalid
+	valid.Backends = []config.BackendConfig{web}
+	if err := s.ReloadConfig(&valid); err != nil {
+		t.Fatalf("ReloadConfig: %v", err)
+	}
+	if len(s.loadBalancer.FindBackends("http://e:80")) != 1 {
+		t.Errorf("discovered target dropped by the reload")
+	}
+	if s.discovery == manager {
+		t.Fatalf("discovery not restarted with the new providers")
+	}
+	writeTargets(t, path, "http://f:80")
+	waitTarget(t, s.loadBalancer, "http://f:80", true)
+	waitTarget(t, s.loadBalancer, "http://e:80", false)
+}
+
+func TestReloadConfigRoutes(t *testing.T) {
+	cfg := &config.Config{Backends: []config.BackendConfig{
+		testGroup("web", "round_robin", "http://w:80"),
+		testGroup("api", "round_robin", "http://a:80"),
+	}}
+	router, err := NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+	lb := newTestLoadBalancer(t, cfg.Backends...)
+	s := &Server{config: cfg, router: router, handler: NewHandler(router, lb, nil), loadBalancer: lb}
+
+	routed := func() string {
+		t.Helper()
+		match, err := s.handler.router.Load().Match(httptest.NewRequest("GET", "/api/users", nil))
+		if err != nil {
+			t.Fatalf("Match: %v", err)
+		}
+		return match.Backend.Name
+	}
+
+	// A rule the router rejects leaves the current routes in place
+	invalid := *cfg
+	invalid.Routing.Rules = []config.RouteRule{{Path: "/api/**", Backend: "api", Rewrite: "/{missing}"}}
+	if err := s.ReloadConfig(&invalid); err == nil {
+		t.Fatalf("ReloadConfig accepted an invalid rule")
+	}
+	if got := routed(); got != "web" {
+		t.Errorf("routed to %s after a rejected reload, want web", got)
+	}
+
+	valid := *cfg
+	valid.Routing.Rules = []config.RouteRule{{Path: "/api/**", Backend: "api"}}
+	if err := s.ReloadConfig(&valid); err != nil {
+		t.Fatalf("ReloadConfig: %v", err)
+	}
+	if got := routed(); got != "api" {
+		t.Errorf("routed to %s after the reload, want api", got)
+	}
+}
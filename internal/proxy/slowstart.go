@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// beginSlowStart starts ramping up the traffic share of a backend that has
+// just recovered or been added. It does nothing when slow start is disabled.
+func (b *Backend) beginSlowStart() {
+	if !b.slowStart.Enabled {
+		return
+	}
+
+	atomic.StoreInt64(&b.slowStartSince, time.Now().UnixNano())
+	logrus.WithFields(logrus.Fields{
+		"backend": b.Name,
+		"window":  b.slowStart.Window.String(),
+	}).Info("Backend entering slow start")
+}
+
+// InSlowStart returns true while the backend's weight is still ramping up
+func (b *Backend) InSlowStart() bool {
+	return b.slowStartFactor() < 1
+}
+
+// IsDegraded returns true if the health checks report the backend as
+// degraded, in which case it keeps only part of its weight
+func (b *Backend) IsDegraded() bool {
+	return atomic.LoadInt32(&b.degraded) == 1
+}
+
+// setDegraded sets whether the backend is degraded
+func (b *Backend) setDegraded(degraded bool) {
+	value := int32(0)
+	if degraded {
+		value = 1
+	}
+	atomic.StoreInt32(&b.degraded, value)
+}
+
+// weightFactor returns the fraction of its configured weight the backend
+// currently receives, lowered while it ramps up or is degraded
+func (b *Backend) weightFactor() float64 {
+	factor := b.slowStartFactor()
+	if b.IsDegraded() {
+		factor *= b.degradedWeight
+	}
+	return factor
+}
+
+// slowStartFactor returns the fraction of its configured weight the backend
+// receives while ramping up, between the configured minimum and 1
+func (b *Backend) slowStartFactor() float64 {
+	since := atomic.LoadInt64(&b.slowStartSince)
+	if since == 0 {
+		return 1
+	}
+
+	elapsed := time.Since(time.Unix(0, since))
+	if elapsed >= b.slowStart.Window {
+		atomic.CompareAndSwapInt64(&b.slowStartSince, since, 0)
+		return 1
+	}
+
+	progress := float64(elapsed) / float64(b.slowStart.Window)
+	min := b.slowStart.MinWeightPercent / 100
+	if b.slowStart.Curve == "exponential" {
+		// Grows geometrically from min to 1 over the window
+		return min * math.Pow(1/min, progress)
+	}
+	return min + (1-min)*progress
+}
+
+// EffectiveWeight returns the weight the backend is currently balanced with
+func (b *Backend) EffectiveWeight() float64 {
+	return float64(b.Weight) * b.weightFactor()
+}
+
+// admit reports whether a backend picked by an algorithm that ignores weights
+// should take the request, shedding the part of its traffic it is not yet
+// allowed to receive
+func admit(b *Backend) bool {
+	factor := b.weightFactor()
+	return factor >= 1 || rand.Float64() < factor
+}
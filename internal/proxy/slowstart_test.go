@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"math"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+)
+
+// rampedBackend returns a backend that began slow start elapsed ago
+func rampedBackend(cfg config.SlowStartConfig, elapsed time.Duration) *Backend {
+	b := &Backend{Weight: 10, slowStart: cfg}
+	atomic.StoreInt64(&b.slowStartSince, time.Now().Add(-elapsed).UnixNano())
+	return b
+}
+
+func TestSlowStartWeightRamp(t *testing.T) {
+	linear := config.SlowStartConfig{Enabled: true, Window: time.Minute, Curve: "linear", MinWeightPercent: 10}
+	exponential := config.SlowStartConfig{Enabled: true, Window: time.Minute, Curve: "exponential", MinWeightPercent: 10}
+
+	tests := []struct {
+		name    string
+		cfg     config.SlowStartConfig
+		elapsed time.Duration
+		want    float64
+	}{
+		{name: "linear start", cfg: linear, elapsed: 0, want: 1},
+		{name: "linear halfway", cfg: linear, elapsed: 30 * time.Second, want: 5.5},
+		{name: "linear done", cfg: linear, elapsed: 2 * time.Minute, want: 10},
+		{name: "exponential start", cfg: exponential, elapsed: 0, want: 1},
+		{name: "exponential halfway", cfg: exponential, elapsed: 30 * time.Second, want: 10 * 0.1 * math.Sqrt(10)},
+		{name: "exponential done", cfg: exponential, elapsed: 2 * time.Minute, want: 10},
+	}
+
+	for _, tt := range tests {
+		b := rampedBackend(tt.cfg, tt.elapsed)
+		if got := b.EffectiveWeight(); math.Abs(got-tt.want) > 0.05 {
+			t.Errorf("%s: effective weight %.2f, want %.2f", tt.name, got, tt.want)
+		}
+	}
+
+	// The ramp ends once the window has passed
+	b := rampedBackend(linear, 2*time.Minute)
+	b.EffectiveWeight()
+	if b.InSlowStart() || atomic.LoadInt64(&b.slowStartSince) != 0 {
+		t.Errorf("backend still in slow start after its window")
+	}
+}
+
+func TestSlowStartDisabled(t *testing.T) {
+	b := &Backend{Weight: 10}
+	b.beginSlowStart()
+	if b.InSlowStart() || b.EffectiveWeight() != 10 {
+		t.Errorf("slow start began although it is disabled")
+	}
+}
+
+func TestSlowStartSharesTraffic(t *testing.T) {
+	cfg := testGroup("api", "round_robin", "http://a:80", "http://b:80")
+	cfg.SlowStart = config.SlowStartConfig{Enabled: true, Window: time.Hour, Curve: "linear", MinWeightPercent: 10}
+	lb := newTestLoadBalancer(t, cfg)
+	b := backendFor(t, lb, "http://b:80")
+	b.beginSlowStart()
+
+	const requests = 2000
+	picked := 0
+	for i := 0; i < requests; i++ {
+		lease, err := lb.GetBackendForConfig("api", httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatalf("GetBackendForConfig: %v", err)
+		}
+		if lease.Backend == b {
+			picked++
+		}
+		lease.Release()
+	}
+
+	// Round robin gives b half of its turns at 10% weight: about 5%
+	if share := float64(picked) / requests; share < 0.02 || share > 0.1 {
+		t.Errorf("backend in slow start took %.1f%% of requests, want about 5%%", share*100)
+	}
+}
+
+func TestSlowStartForAddedTargets(t *testing.T) {
+	cfg := testGroup("api", "round_robin", "http://a:80")
+	cfg.SlowStart = config.SlowStartConfig{Enabled: true, Window: time.Hour, MinWeightPercent: 10}
+	lb := newTestLoadBalancer(t, cfg)
+
+	// Targets present from the start take full traffic
+	if backendFor(t, lb, "http://a:80").InSlowStart() {
+		t.Errorf("initial target in slow start")
+	}
+
+	if err := lb.SetGroupTargets("api", []config.TargetConfig{{URL: "http://a:80"}, {URL: "http://b:80"}}); err != nil {
+		t.Fatalf("SetGroupTargets: %v", err)
+	}
+	if backendFor(t, lb, "http://a:80").InSlowStart() {
+		t.Errorf("kept target entered slow start")
+	}
+	if !backendFor(t, lb, "http://b:80").InSlowStart() {
+		t.Errorf("added target did not enter slow start")
+	}
+}
+
+func TestSlowStartForRecoveredTargets(t *testing.T) {
+	cfg := testGroup("api", "round_robin", "http://a:80", "http://b:80")
+	cfg.SlowStart = config.SlowStartConfig{Enabled: true, Window: time.Hour, MinWeightPercent: 10}
+	lb := newTestLoadBalancer(t, cfg)
+	b := backendFor(t, lb, "http://b:80")
+
+	b.SetHealthy(false)
+	lb.healthChanged(b, true, "health_check")
+	if b.InSlowStart() {
+		t.Errorf("unhealthy target in slow start")
+	}
+
+	b.SetHealthy(true)
+	lb.healthChanged(b, false, "health_check")
+	if !b.InSlowStart() {
+		t.Errorf("recovered target did not enter slow start")
+	}
+	if w := b.EffectiveWeight(); w > 0.2 {
+		t.Errorf("recovered target has effective weight %.2f, want about 0.1", w)
+	}
+}
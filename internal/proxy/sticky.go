@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+)
+
+// ErrStickyBackendUnavailable is returned when a request is pinned to a
+// backend that cannot serve it and the group is configured not to rebalance
+var ErrStickyBackendUnavailable = errors.New("sticky backend unavailable")
+
+// affinityID returns the identifier written into affinity cookies for a
+// backend. It is derived from the target URL so that it stays stable across
+// reloads without exposing internal addresses to clients.
+func affinityID(b *Backend) string {
+	return strconv.FormatUint(hashKey(b.URL), 36)
+}
+
+// affinityValue encodes the affinity for a backend, signing it when a secret
+// is configured
+func affinityValue(cfg config.StickySessionConfig, b *Backend) string {
+	id := affinityID(b)
+	if cfg.Secret == "" {
+		return id
+	}
+	return id + "." + signAffinity(cfg.Secret, id)
+}
+
+// requestAffinity returns the backend identifier carried by the request, or
+// an empty string if there is none or its signature does not verify
+func requestAffinity(cfg config.StickySessionConfig, r *http.Request) string {
+	value := ""
+	if cfg.Header != "" {
+		value = r.Header.Get(cfg.Header)
+	}
+	if value == "" {
+		if cookie, err := r.Cookie(cfg.CookieName); err == nil {
+			value = cookie.Value
+		}
+	}
+	if value == "" {
+		return ""
+	}
+
+	if cfg.Secret == "" {
+		return value
+	}
+
+	id, signature, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(signAffinity(cfg.Secret, id))) {
+		return ""
+	}
+	return id
+}
+
+// signAffinity computes the HMAC of an affinity identifier
+func signAffinity(secret, id string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setAffinity pins the client to the backend that served the response
+func setAffinity(cfg config.StickySessionConfig, resp *http.Response, b *Backend, secure bool) {
+	value := affinityValue(cfg, b)
+
+	cookie := &http.Cookie{
+		Name:     cfg.CookieName,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if cfg.TTL > 0 {
+		cookie.MaxAge = int(cfg.TTL.Seconds())
+	}
+	resp.Header.Add("Set-Cookie", cookie.String())
+
+	if cfg.Header != "" {
+		resp.Header.Set(cfg.Header, value)
+	}
+}
+
+// stickyBackend resolves the backend a request is pinned to. The returned
+// flag is true when the request carried a valid affinity for this group,
+// even if the backend is not currently available.
+func stickyBackend(cfg config.StickySessionConfig, r *http.Request, backends []*Backend) (*Backend, bool) {
+	id := requestAffinity(cfg, r)
+	if id == "" {
+		return nil, false
+	}
+
+	for _, backend := range backends {
+		if affinityID(backend) == id {
+			return backend, true
+		}
+	}
+	return nil, true
+}
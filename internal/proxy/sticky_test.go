@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+)
+
+func stickyGroup(sticky config.StickySessionConfig) config.BackendConfig {
+	cfg := testGroup("app", "round_robin", "http://a:80", "http://b:80", "http://c:80")
+	sticky.Enabled = true
+	if sticky.CookieName == "" {
+		sticky.CookieName = "qrp_affinity"
+	}
+	if sticky.Fallback == "" {
+		sticky.Fallback = "rebalance"
+	}
+	cfg.StickySession = sticky
+	return cfg
+}
+
+// pinnedRequest returns a request carrying the affinity cookie of a backend
+func pinnedRequest(cfg config.StickySessionConfig, b *Backend) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: cfg.CookieName, Value: affinityValue(cfg, b)})
+	return req
+}
+
+func TestStickySessionPinsRequests(t *testing.T) {
+	cfg := stickyGroup(config.StickySessionConfig{Secret: "s3cret"})
+	lb := newTestLoadBalancer(t, cfg)
+	b := backendFor(t, lb, "http://b:80")
+
+	for i := 0; i < 10; i++ {
+		lease, err := lb.GetBackendForConfig("app", pinnedRequest(cfg.StickySession, b))
+		if err != nil {
+			t.Fatalf("GetBackendForConfig: %v", err)
+		}
+		if lease.Backend != b || !lease.Sticky {
+			t.Fatalf("request %d went to %s (sticky %v), want pinned to %s", i, lease.Backend.URL, lease.Sticky, b.URL)
+		}
+		lease.Release()
+	}
+}
+
+func TestStickySessionHeader(t *testing.T) {
+	cfg := stickyGroup(config.StickySessionConfig{Header: "X-Affinity"})
+	lb := newTestLoadBalancer(t, cfg)
+	c := backendFor(t, lb, "http://c:80")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Affinity", affinityValue(cfg.StickySession, c))
+	for i := 0; i < 5; i++ {
+		lease, err := lb.GetBackendForConfig("app", req)
+		if err != nil {
+			t.Fatalf("GetBackendForConfig: %v", err)
+		}
+		if lease.Backend != c {
+			t.Fatalf("request went to %s, want pinned to %s", lease.Backend.URL, c.URL)
+		}
+		lease.Release()
+	}
+}
+
+func TestStickySessionRejectsForgedAffinity(t *testing.T) {
+	sticky := config.StickySessionConfig{Enabled: true, CookieName: "qrp_affinity", Secret: "s3cret"}
+	backend := &Backend{URL: "http://a:80"}
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "signed", value: affinityValue(sticky, backend), want: affinityID(backend)},
+		{name: "unsigned", value: affinityID(backend), want: ""},
+		{name: "wrong signature", value: affinityID(backend) + ".Zm9yZ2Vk", want: ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: sticky.CookieName, Value: tt.value})
+		if got := requestAffinity(sticky, req); got != tt.want {
+			t.Errorf("%s: affinity %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStickySessionFallback(t *testing.T) {
+	tests := []struct {
+		fallback string
+		wantErr  error
+	}{
+		{fallback: "rebalance"},
+		{fallback: "fail", wantErr: ErrStickyBackendUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fallback, func(t *testing.T) {
+			cfg := stickyGroup(config.StickySessionConfig{Fallback: tt.fallback})
+			lb := newTestLoadBalancer(t, cfg)
+			b := backendFor(t, lb, "http://b:80")
+			b.SetHealthy(false)
+
+			lease, err := lb.GetBackendForConfig("app", pinnedRequest(cfg.StickySession, b))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetBackendForConfig: %v", err)
+			}
+			if lease.Backend == b || lease.Sticky {
+				t.Errorf("request stayed on the unhealthy pinned backend")
+			}
+		})
+	}
+}
+
+func TestSetAffinityCookie(t *testing.T) {
+	sticky := config.StickySessionConfig{CookieName: "qrp_affinity", Header: "X-Affinity", TTL: time.Hour}
+	backend := &Backend{URL: "http://a:80"}
+
+	resp := &http.Response{Header: make(http.Header)}
+	setAffinity(sticky, resp, backend, true)
+
+	cookie := resp.Header.Get("Set-Cookie")
+	for _, attr := range []string{"qrp_affinity=" + affinityID(backend), "Max-Age=3600", "HttpOnly", "Secure", "SameSite=Lax"} {
+		if !strings.Contains(cookie, attr) {
+			t.Errorf("cookie %q is missing %s", cookie, attr)
+		}
+	}
+	if got := resp.Header.Get("X-Affinity"); got != affinityID(backend) {
+		t.Errorf("affinity header %q, want %q", got, affinityID(backend))
+	}
+}
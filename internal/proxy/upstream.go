@@ -0,0 +1,314 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+	"github.com/os-dev/quic-reverse-proxy/internal/quic"
+	"github.com/sirupsen/logrus"
+)
+
+// Transport returns the round tripper used to reach the backend. It is
+// created on first use and shared by all requests so connections are reused.
+func (b *Backend) Transport() http.RoundTripper {
+	b.transportOnce.Do(func() {
+		if b.Protocol == "h3" {
+			b.transport = quic.NewRoundTripper(b.tlsConfig)
+			return
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if b.tlsConfig != nil {
+			transport.TLSClientConfig = b.tlsConfig.Clone()
+		}
+		b.transport = transport
+	})
+	return b.transport
+}
+
+// newTLSConfig returns the TLS settings used to connect to the targets of a
+// group, or nil when the defaults apply
+func newTLSConfig(cfg config.BackendConfig) (*tls.Config, error) {
+	if !cfg.TLSSkipVerify && cfg.TLSCAFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.TLSSkipVerify}
+	if cfg.TLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tls ca file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in tls ca file %s", cfg.TLSCAFile)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// closeIdleConnections closes the idle connections of the backend's
+// transport once it no longer receives requests
+func (b *Backend) closeIdleConnections() {
+	b.transportOnce.Do(func() {}) // Synchronises with the transport's creation
+	if closer, ok := b.transport.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// upstreamTransport sends a proxied request to the backends of a group. A
+// backend is selected for every attempt, so a failed attempt can be retried
+// against a different target before anything is written to the client.
+type upstreamTransport struct {
+	handler *Handler
+	config  *config.BackendConfig
+	budget  *retryBudget
+	retries int     // Retries allowed for this request
+	hedge   *hedger // nil when the request is not hedged
+
+	// Backend that produced the returned response or error
+	backend *Backend
+	sticky  bool
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var (
+		resp  *http.Response
+		err   error
+		tried []*Backend
+	)
+
+	for attempt := 0; ; attempt++ {
+		lease, leaseErr := t.handler.loadBalancer.GetBackendForConfig(t.config.Name, req, tried...)
+		if leaseErr != nil {
+			if attempt == 0 {
+				return nil, leaseErr
+			}
+			// No other backend to retry on; return the last result
+			break
+		}
+
+		if resp != nil {
+			discardResponse(resp)
+		}
+
+		tried = append(tried, lease.Backend)
+		lease, resp, tried, err = t.send(req, lease, tried)
+		t.backend = lease.Backend
+		t.sticky = lease.Sticky
+
+		if attempt >= t.retries || !t.shouldRetry(req, resp, err) {
+			break
+		}
+
+		if !t.budget.tryRetry() {
+			logrus.WithFields(logrus.Fields{
+				"backend_group": t.config.Name,
+				"url":           req.URL.String(),
+			}).Warn("Retry budget exhausted, not retrying")
+			break
+		}
+
+		if t.handler.metrics != nil {
+			t.handler.metrics.RecordBackendRequest(lease.Backend.Name, "retry", 0)
+		}
+
+		if !retryBackoff(req.Context(), t.config.RetryPolicy, attempt+1) {
+			break
+		}
+	}
+
+	return resp, err
+}
+
+// send sends the request to the leased backend, hedging it if enabled. It
+// returns the lease of the backend that produced the result and tried with
+// every backend the request was sent to.
+func (t *upstreamTransport) send(req *http.Request, lease *Lease, tried []*Backend) (*Lease, *http.Response, []*Backend, error) {
+	if t.hedge != nil {
+		return t.hedged(req, lease, tried)
+	}
+
+	resp, err := t.attempt(req, lease)
+	return lease, resp, tried, err
+}
+
+// attempt sends the request to the leased backend
+func (t *upstreamTransport) attempt(req *http.Request, lease *Lease) (*http.Response, error) {
+	backend := lease.Backend
+
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	if perTry := t.config.RetryPolicy.PerTryTimeout; perTry > 0 {
+		ctx, cancel = context.WithTimeout(ctx, perTry)
+	}
+
+	outreq := req.Clone(ctx)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			// Nothing was sent, so the half-open probe slot taken by the
+			// lease goes back to the breaker
+			cancel()
+			backend.breaker.abandon()
+			lease.Release()
+			return nil, err
+		}
+		outreq.Body = body
+	}
+	rewriteForBackend(outreq, backend)
+
+	start := time.Now()
+	resp, err := backend.Transport().RoundTrip(outreq)
+	latency := time.Since(start)
+
+	if err != nil {
+		cancel()
+		lease.Release()
+
+		logrus.WithFields(logrus.Fields{
+			"backend": backend.Name,
+			"error":   err.Error(),
+			"url":     outreq.URL.String(),
+		}).Error("Backend request failed")
+
+		backend.ReportResult(0, err, latency)
+		if t.handler.metrics != nil {
+			t.handler.metrics.RecordBackendRequest(backend.Name, "error", latency)
+		}
+		return nil, err
+	}
+
+	backend.ObserveLatency(latency)
+	backend.ReportResult(resp.StatusCode, nil, latency)
+	if t.handler.metrics != nil {
+		t.handler.metrics.RecordBackendRequest(backend.Name, "success", latency)
+	}
+
+	// Keep the lease until the response body has been fully relayed
+	wrapLeaseBody(resp, func() {
+		cancel()
+		lease.Release()
+	})
+	return resp, nil
+}
+
+// shouldRetry reports whether the outcome of an attempt may be retried.
+// Transport errors are only retried when the connection failed or the
+// per-try timeout expired; errors after the backend may have acted on the
+// request are returned as is.
+func (t *upstreamTransport) shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	// The client went away or the overall deadline passed
+	if req.Context().Err() != nil {
+		return false
+	}
+	if err != nil {
+		return isConnectionError(err) || (t.config.RetryPolicy.PerTryTimeout > 0 && errors.Is(err, context.DeadlineExceeded))
+	}
+	return shouldRetryStatus(t.config.RetryPolicy, resp.StatusCode)
+}
+
+// backendName returns the name of the backend that served the request
+func (t *upstreamTransport) backendName() string {
+	if t.backend == nil {
+		return "error"
+	}
+	return t.backend.Name
+}
+
+// rewriteForBackend points an outgoing request at the backend
+func rewriteForBackend(req *http.Request, backend *Backend) {
+	target, _ := url.Parse(backend.URL) // Error already handled in load balancer
+
+	// Map backend protocol to the correct scheme for the request
+	switch backend.Protocol {
+	case "h3", "https":
+		req.URL.Scheme = "https"
+	case "http":
+		req.URL.Scheme = "http"
+	default:
+		req.URL.Scheme = target.Scheme
+	}
+
+	req.URL.Host = target.Host
+	req.Host = target.Host
+
+	if target.Path != "" {
+		req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
+		req.URL.RawPath = ""
+	}
+	if target.RawQuery != "" {
+		if req.URL.RawQuery == "" {
+			req.URL.RawQuery = target.RawQuery
+		} else {
+			req.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
+		}
+	}
+}
+
+// singleJoiningSlash joins two URL paths with exactly one slash between them
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// leaseBody releases a backend lease once the response body is closed
+type leaseBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *leaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// leaseConn is a leaseBody for upgraded connections, whose body must stay
+// writable for ReverseProxy to relay it
+type leaseConn struct {
+	*leaseBody
+	io.Writer
+}
+
+// wrapLeaseBody makes the response release done once its body is closed
+func wrapLeaseBody(resp *http.Response, done func()) {
+	body := &leaseBody{ReadCloser: resp.Body, done: done}
+	if conn, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &leaseConn{leaseBody: body, Writer: conn}
+		return
+	}
+	resp.Body = body
+}
+
+// discardResponse drains and closes a response that will not be relayed so
+// its connection can be reused
+func discardResponse(resp *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	resp.Body.Close()
+}
+
+// isTimeout reports whether an upstream error was caused by a deadline
+func isTimeout(err error) bool {
+	var netErr interface{ Timeout() bool }
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// webhookQueueSize is the number of events a webhook may fall behind by
+// before it has to catch up from the recent events of the bus
+const webhookQueueSize = 64
+
+// webhooks posts backend events to the configured URLs
+type webhooks struct {
+	config config.EventsConfig
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// startWebhooks starts delivering the events published on bus to the
+// webhooks of cfg
+func startWebhooks(bus *EventBus, cfg config.EventsConfig) *webhooks {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &webhooks{config: cfg, cancel: cancel}
+
+	for _, webhook := range cfg.Webhooks {
+		sender := newWebhookSender(webhook)
+		after := bus.LastID()
+
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			sender.run(ctx, bus, after)
+		}()
+	}
+	return w
+}
+
+// stop stops delivering events and waits for deliveries in progress to be
+// abandoned
+func (w *webhooks) stop() {
+	if w == nil {
+		return
+	}
+	w.cancel()
+	w.wg.Wait()
+}
+
+// sameWebhooks reports whether the webhooks of two configs are identical
+func sameWebhooks(a, b config.EventsConfig) bool {
+	return reflect.DeepEqual(a.Webhooks, b.Webhooks)
+}
+
+// webhookSender posts events to a single webhook
+type webhookSender struct {
+	config config.WebhookConfig
+	types  map[EventType]bool // nil sends all events
+	client *http.Client
+}
+
+// newWebhookSender creates a sender for a webhook
+func newWebhookSender(cfg config.WebhookConfig) *webhookSender {
+	s := &webhookSender{
+		config: cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+	}
+	if len(cfg.Events) > 0 {
+		s.types = make(map[EventType]bool)
+		for _, eventType := range cfg.Events {
+			s.types[EventType(eventType)] = true
+		}
+	}
+	return s
+}
+
+// run delivers the events published after the given ID until ctx is
+// cancelled. When the webhook falls behind, it catches up from the recent
+// events kept by the bus.
+func (s *webhookSender) run(ctx context.Context, bus *EventBus, after uint64) {
+	events, unsubscribe := bus.Subscribe("webhook", after, webhookQueueSize)
+	defer func() { unsubscribe() }()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				logrus.WithFields(logrus.Fields{
+					"webhook":       s.config.URL,
+					"last_event_id": after,
+				}).Warn("Webhook fell behind, catching up from recent events")
+				events, unsubscribe = bus.Subscribe("webhook", after, webhookQueueSize)
+				continue
+			}
+			after = event.ID
+
+			if s.types != nil && !s.types[event.Type] {
+				continue
+			}
+			s.deliver(ctx, event)
+		}
+	}
+}
+
+// deliver posts an event, retrying with exponential backoff until it is
+// accepted or the retries are exhausted
+func (s *webhookSender) deliver(ctx context.Context, event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	backoff := s.config.RetryBackoff
+	attempts := 0
+	for {
+		attempts++
+		if err = s.post(ctx, body); err == nil {
+			return
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+		if attempts > s.config.MaxRetries {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"webhook":  s.config.URL,
+		"event":    event.Type,
+		"backend":  event.Backend,
+		"error":    err.Error(),
+		"attempts": attempts,
+	}).Error("Failed to deliver event to webhook")
+}
+
+// post sends a single delivery attempt
+func (s *webhookSender) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "quic-reverse-proxy")
+	for name, value := range s.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	discardResponse(resp)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
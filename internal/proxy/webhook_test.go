@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/os-dev/quic-reverse-proxy/internal/config"
+)
+
+// webhookServer records the events posted to it
+type webhookServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	attempts []time.Time
+	events   []Event
+}
+
+// newWebhookServer starts a webhook answering with the status returned by
+// respond for each attempt
+func newWebhookServer(t *testing.T, respond func(attempt int) int) *webhookServer {
+	t.Helper()
+
+	s := &webhookServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil || r.Header.Get("X-Token") != "secret" {
+			t.Errorf("invalid delivery: %v, token %q", err, r.Header.Get("X-Token"))
+		}
+
+		s.mu.Lock()
+		s.attempts = append(s.attempts, time.Now())
+		attempt := len(s.attempts)
+		s.mu.Unlock()
+
+		status := respond(attempt)
+		if status == http.StatusOK {
+			s.mu.Lock()
+			s.events = append(s.events, event)
+			s.mu.Unlock()
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// delivered returns the attempts made and the events accepted so far
+func (s *webhookServer) delivered() ([]time.Time, []Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time(nil), s.attempts...), append([]Event(nil), s.events...)
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		maxRetries   int
+		wantAttempts int
+		delivered    bool
+	}{
+		{name: "accepted", failures: 0, maxRetries: 2, wantAttempts: 1, delivered: true},
+		{name: "accepted after retries", failures: 2, maxRetries: 2, wantAttempts: 3, delivered: true},
+		{name: "retries exhausted", failures: 5, maxRetries: 2, wantAttempts: 3, delivered: false},
+		{name: "no retries", failures: 1, maxRetries: 0, wantAttempts: 1, delivered: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newWebhookServer(t, func(attempt int) int {
+				if attempt <= tt.failures {
+					return http.StatusBadGateway
+				}
+				return http.StatusOK
+			})
+
+			backoff := 10 * time.Millisecond
+			sender := newWebhookSender(config.WebhookConfig{
+				URL:          server.URL,
+				Headers:      map[string]string{"X-Token": "secret"},
+				Timeout:      time.Second,
+				MaxRetries:   tt.maxRetries,
+				RetryBackoff: backoff,
+			})
+			sender.deliver(context.Background(), Event{ID: 7, Type: EventBackendEjected, Backend: "api"})
+
+			attempts, events := server.delivered()
+			if len(attempts) != tt.wantAttempts {
+				t.Fatalf("%d attempts, want %d", len(attempts), tt.wantAttempts)
+			}
+			if delivered := len(events) == 1 && events[0].ID == 7; delivered != tt.delivered {
+				t.Errorf("delivered = %v, want %v", delivered, tt.delivered)
+			}
+
+			// The backoff doubles after every retry
+			for i := 1; i < len(attempts); i++ {
+				if gap := attempts[i].Sub(attempts[i-1]); gap < backoff<<(i-1) {
+					t.Errorf("retry %d after %v, want at least %v", i, gap, backoff<<(i-1))
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookRetriesCancelled(t *testing.T) {
+	server := newWebhookServer(t, func(int) int { return http.StatusServiceUnavailable })
+	sender := newWebhookSender(config.WebhookConfig{
+		URL:          server.URL,
+		Headers:      map[string]string{"X-Token": "secret"},
+		Timeout:      time.Second,
+		MaxRetries:   10,
+		RetryBackoff: time.Hour,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sender.deliver(ctx, Event{ID: 1, Type: EventBackendAdded})
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	waitClosed(t, done, "delivery")
+	if attempts, _ := server.delivered(); len(attempts) != 1 {
+		t.Errorf("%d attempts, want 1 before the backoff", len(attempts))
+	}
+}
+
+func TestWebhookCatchesUp(t *testing.T) {
+	release := make(chan struct{})
+	server := newWebhookServer(t, func(attempt int) int {
+		if attempt == 1 {
+			<-release
+		}
+		return http.StatusOK
+	})
+
+	bus := NewEventBus(nil)
+	hooks := startWebhooks(bus, config.EventsConfig{Webhooks: []config.WebhookConfig{{
+		URL:     server.URL,
+		Headers: map[string]string{"X-Token": "secret"},
+		Timeout: 5 * time.Second,
+	}}})
+	defer hooks.stop()
+
+	// Fall behind by more than the queue while the first delivery is
+	// held up
+	bus.Publish(Event{Type: EventBackendAdded})
+	for attempts, _ := server.delivered(); len(attempts) == 0; attempts, _ = server.delivered() {
+		time.Sleep(5 * time.Millisecond)
+	}
+	total := webhookQueueSize + 20
+	for i := 1; i < total; i++ {
+		bus.Publish(Event{Type: EventBackendAdded})
+	}
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, events := server.delivered()
+		if len(events) == total {
+			for i, event := range events {
+				if event.ID != uint64(i+1) {
+					t.Fatalf("event %d delivered as #%d", event.ID, i+1)
+				}
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d events delivered", len(events), total)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -8,12 +8,14 @@ import (
 )
 
 // NewRoundTripper creates an http3.RoundTripper that can be used by an httputil.ReverseProxy
-// to route traffic to HTTP/3 enabled backend services.
-func NewRoundTripper(tlsSkipVerify bool) *http3.RoundTripper {
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: tlsSkipVerify,
-		NextProtos:         []string{"h3"}, // Explicitly request HTTP/3 ALPN
+// to route traffic to HTTP/3 enabled backend services. tlsConfig may be nil.
+func NewRoundTripper(tlsConfig *tls.Config) *http3.RoundTripper {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	} else {
+		tlsConfig = tlsConfig.Clone()
 	}
+	tlsConfig.NextProtos = []string{"h3"} // Explicitly request HTTP/3 ALPN
 
 	quicConfig := &quic.Config{}
 
@@ -33,9 +33,15 @@ type Metrics struct {
 	HTTPResponseSize    *prometheus.HistogramVec
 
 	// Backend metrics
-	BackendRequests     *prometheus.CounterVec
-	BackendResponseTime *prometheus.HistogramVec
-	BackendHealthStatus *prometheus.GaugeVec
+	BackendRequests       *prometheus.CounterVec
+	BackendResponseTime   *prometheus.HistogramVec
+	BackendHealthStatus   *prometheus.GaugeVec
+	BackendHealthOverride *prometheus.GaugeVec
+	BackendEjections      *prometheus.CounterVec
+	BackendEjected        *prometheus.GaugeVec
+	BackendCircuitState   *prometheus.GaugeVec
+	HedgedRequests        *prometheus.CounterVec
+	EventsDropped         *prometheus.CounterVec
 }
 
 // NewMetrics creates and registers all Prometheus metrics
@@ -170,6 +176,54 @@ func NewMetrics() *Metrics {
 			},
 			[]string{"backend"},
 		),
+
+		BackendHealthOverride: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "backend_health_override",
+				Help: "Manual backend health override (0=none, 1=forced healthy, 2=forced unhealthy)",
+			},
+			[]string{"backend"},
+		),
+
+		BackendEjections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "backend_outlier_ejections_total",
+				Help: "Total number of backend ejections by the outlier detector",
+			},
+			[]string{"backend", "reason"}, // consecutive_5xx, consecutive_gateway_errors, latency
+		),
+
+		BackendEjected: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "backend_outlier_ejected",
+				Help: "Backend ejection status (1=ejected, 0=serving)",
+			},
+			[]string{"backend"},
+		),
+
+		BackendCircuitState: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "backend_circuit_state",
+				Help: "Backend circuit breaker state (0=closed, 1=half-open, 2=open)",
+			},
+			[]string{"backend"},
+		),
+
+		HedgedRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "backend_hedged_requests_total",
+				Help: "Total number of hedged requests by outcome",
+			},
+			[]string{"backend", "outcome"}, // sent, won, lost
+		),
+
+		EventsDropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "backend_events_dropped_total",
+				Help: "Total number of backend events dropped for subscribers falling behind",
+			},
+			[]string{"subscriber"}, // sse, webhook
+		),
 	}
 
 	// Register all metrics with Prometheus
@@ -189,6 +243,12 @@ func NewMetrics() *Metrics {
 		m.BackendRequests,
 		m.BackendResponseTime,
 		m.BackendHealthStatus,
+		m.BackendHealthOverride,
+		m.BackendEjections,
+		m.BackendEjected,
+		m.BackendCircuitState,
+		m.HedgedRequests,
+		m.EventsDropped,
 	)
 
 	return m
@@ -261,6 +321,39 @@ func (m *Metrics) UpdateBackendHealth(backend string, healthy bool) {
 	m.BackendHealthStatus.WithLabelValues(backend).Set(value)
 }
 
+// UpdateHealthOverride updates the manual health override of a backend
+func (m *Metrics) UpdateHealthOverride(backend string, state int) {
+	m.BackendHealthOverride.WithLabelValues(backend).Set(float64(state))
+}
+
+// RecordBackendEjection records a backend being ejected by outlier detection
+func (m *Metrics) RecordBackendEjection(backend, reason string) {
+	m.BackendEjections.WithLabelValues(backend, reason).Inc()
+	m.BackendEjected.WithLabelValues(backend).Set(1)
+}
+
+// RecordBackendUnejected records an ejected backend returning to service
+func (m *Metrics) RecordBackendUnejected(backend string) {
+	m.BackendEjected.WithLabelValues(backend).Set(0)
+}
+
+// UpdateCircuitState updates the circuit breaker state of a backend
+func (m *Metrics) UpdateCircuitState(backend string, state int) {
+	m.BackendCircuitState.WithLabelValues(backend).Set(float64(state))
+}
+
+// RecordHedge records a hedged request of a backend group being sent, or
+// whether it won or lost against the original request
+func (m *Metrics) RecordHedge(backend, outcome string) {
+	m.HedgedRequests.WithLabelValues(backend, outcome).Inc()
+}
+
+// RecordEventDropped records a backend event dropped for a subscriber that
+// fell behind
+func (m *Metrics) RecordEventDropped(subscriber string) {
+	m.EventsDropped.WithLabelValues(subscriber).Inc()
+}
+
 // MetricsServer provides HTTP endpoint for Prometheus metrics
 type MetricsServer struct {
 	server *http.Server
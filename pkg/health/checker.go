@@ -1,20 +1,35 @@
 package health
 
 import (
+	"crypto/tls"
+	"io"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/quic-go/quic-go/http3"
 	"github.com/sirupsen/logrus"
 )
 
 // Config represents health check configuration
 type Config struct {
+	Type               string      // "http", "https", "h3", "grpc", "tcp" or "tls"
+	TLSConfig          *tls.Config // Used by the https, h3, grpc and tls probes, may be nil
+	GRPCService        string      // Service checked by the grpc probe, empty for the whole server
+	GRPCTLS            bool        // Send the grpc probe over TLS instead of h2c
+	Method             string      // Method of the HTTP probes, defaults to GET
+	Host               string      // Host header of the HTTP probes, defaults to the target
+	Headers            map[string]string
+	Expect             Expect // Assertions on the response of the HTTP probes
 	Interval           time.Duration
 	Timeout            time.Duration
 	HealthyThreshold   int
 	UnhealthyThreshold int
+	Jitter             time.Duration // Random spread of the interval between probes
+	HistorySize        int           // Number of recent probes kept, see History; defaults to 10, negative to keep none
 }
 
 // Checker performs health checks on backend services
@@ -22,11 +37,24 @@ type Checker struct {
 	baseURL            string
 	path               string
 	config             Config
-	client             *http.Client
+	client             *http.Client        // nil for the tcp and tls probes
+	h3                 *http3.RoundTripper // Set for the h3 probe so it can be closed
 	mu                 sync.RWMutex
 	consecutiveSuccess int
 	consecutiveFailure int
 	isHealthy          bool
+	isDegraded         bool
+	history            []Probe // Ring buffer of the latest probes
+	historyNext        int     // Index the next probe is written to
+}
+
+// Probe is the outcome of a single health check
+type Probe struct {
+	Time     time.Time
+	Duration time.Duration
+	Status   string // HTTP status code or gRPC serving status, if a response was received
+	Result   string // "healthy", "degraded" or "unhealthy"
+	Error    string
 }
 
 // NewChecker creates a new health checker
@@ -44,36 +72,80 @@ func NewChecker(baseURL, path string, config Config) *Checker {
 	if config.UnhealthyThreshold == 0 {
 		config.UnhealthyThreshold = 3
 	}
-
-	// Create HTTP client with timeout
-	client := &http.Client{
-		Timeout: config.Timeout,
-		// Don't follow redirects for health checks
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
+	if config.Type == "" {
+		config.Type = "http"
+	}
+	if config.Method == "" {
+		config.Method = http.MethodGet
+	}
+	switch {
+	case config.HistorySize == 0:
+		config.HistorySize = 10
+	case config.HistorySize < 0:
+		config.HistorySize = 0 // History disabled
 	}
 
-	return &Checker{
+	c := &Checker{
 		baseURL:   baseURL,
 		path:      path,
 		config:    config,
-		client:    client,
 		isHealthy: true, // Start as healthy
+		history:   make([]Probe, 0, config.HistorySize),
+	}
+
+	switch config.Type {
+	case "tcp", "tls":
+		// Probed by connecting, see probeConnect
+	case "h3":
+		c.h3 = &http3.RoundTripper{TLSClientConfig: c.tlsConfig("h3")}
+		c.client = newHTTPClient(config.Timeout, c.h3)
+	case "grpc":
+		c.client = newHTTPClient(config.Timeout, c.newGRPCTransport())
+	default:
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if config.TLSConfig != nil {
+			transport.TLSClientConfig = config.TLSConfig.Clone()
+		}
+		c.client = newHTTPClient(config.Timeout, transport)
+	}
+
+	return c
+}
+
+// newHTTPClient creates the HTTP client of a health checker
+func newHTTPClient(timeout time.Duration, transport http.RoundTripper) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		// Don't follow redirects for health checks
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
 	}
 }
 
 // Check performs a health check and returns the current health status
 func (c *Checker) Check() bool {
-	success := c.performCheck()
+	result, probe := c.performCheck()
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if success {
+	c.record(probe)
+
+	if result != resultUnhealthy {
 		c.consecutiveSuccess++
 		c.consecutiveFailure = 0
 
+		// Degraded responses still count as successes
+		if degraded := result == resultDegraded; degraded != c.isDegraded {
+			c.isDegraded = degraded
+			logrus.WithFields(logrus.Fields{
+				"url":      c.getURL(),
+				"degraded": degraded,
+			}).Info("Backend degraded status changed")
+		}
+
 		// Mark as healthy if we've reached the threshold
 		if !c.isHealthy && c.consecutiveSuccess >= c.config.HealthyThreshold {
 			c.isHealthy = true
@@ -93,22 +165,79 @@ func (c *Checker) Check() bool {
 	return c.isHealthy
 }
 
-// performCheck performs the actual HTTP health check
-func (c *Checker) performCheck() bool {
+// performCheck performs the actual health check
+func (c *Checker) performCheck() (result, Probe) {
+	probe := Probe{Time: time.Now()}
+
+	var res result
+	switch {
+	case c.client == nil:
+		res = resultOf(c.probeConnect(&probe))
+	case c.config.Type == "grpc":
+		res = resultOf(c.probeGRPC(&probe))
+	default:
+		res = c.probeHTTP(&probe)
+	}
+
+	probe.Duration = time.Since(probe.Time)
+	probe.Result = res.String()
+	return res, probe
+}
+
+// record adds a probe to the history, replacing the oldest one once full.
+// Must be called with mu held.
+func (c *Checker) record(probe Probe) {
+	if c.config.HistorySize == 0 {
+		return
+	}
+	if len(c.history) < c.config.HistorySize {
+		c.history = append(c.history, probe)
+	} else {
+		c.history[c.historyNext] = probe
+	}
+	c.historyNext = (c.historyNext + 1) % c.config.HistorySize
+}
+
+// History returns the latest probes, oldest first
+func (c *Checker) History() []Probe {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.historyLocked()
+}
+
+// historyLocked returns the latest probes, oldest first. Must be called with
+// mu held.
+func (c *Checker) historyLocked() []Probe {
+	history := make([]Probe, 0, len(c.history))
+	if len(c.history) < c.config.HistorySize {
+		return append(history, c.history...)
+	}
+	history = append(history, c.history[c.historyNext:]...)
+	return append(history, c.history[:c.historyNext]...)
+}
+
+// probeHTTP performs an HTTP health check over HTTP/1.1, HTTP/2 or HTTP/3
+func (c *Checker) probeHTTP(probe *Probe) result {
 	url := c.getURL()
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequest(c.config.Method, url, nil)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"url":   url,
 			"error": err.Error(),
 		}).Debug("Failed to create health check request")
-		return false
+		return resultUnhealthy
 	}
 
 	// Add health check specific headers
 	req.Header.Set("User-Agent", "quic-reverse-proxy-health-checker/1.0")
 	req.Header.Set("Cache-Control", "no-cache")
+	for name, value := range c.config.Headers {
+		req.Header.Set(name, value)
+	}
+	if c.config.Host != "" {
+		req.Host = c.config.Host
+	}
 
 	start := time.Now()
 	resp, err := c.client.Do(req)
@@ -120,15 +249,31 @@ func (c *Checker) performCheck() bool {
 			"error":    err.Error(),
 			"duration": duration.String(),
 		}).Debug("Health check request failed")
-		return false
+		probe.Error = err.Error()
+		return resultUnhealthy
 	}
 	defer resp.Body.Close()
+	probe.Status = strconv.Itoa(resp.StatusCode)
+
+	var body []byte
+	if c.config.Expect.needsBody() {
+		if body, err = io.ReadAll(io.LimitReader(resp.Body, maxBodyBytes)); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"url":   url,
+				"error": err.Error(),
+			}).Warn("Failed to read health check response")
+			probe.Error = err.Error()
+			return resultUnhealthy
+		}
+	}
 
-	// Consider 200-299 status codes as healthy
-	success := resp.StatusCode >= 200 && resp.StatusCode < 300
+	result, reason := c.config.Expect.evaluate(resp.StatusCode, body)
+	if result == resultUnhealthy {
+		probe.Error = reason
+	}
 
 	logLevel := logrus.DebugLevel
-	if !success {
+	if result != resultHealthy {
 		logLevel = logrus.WarnLevel
 	}
 
@@ -136,10 +281,12 @@ func (c *Checker) performCheck() bool {
 		"url":      url,
 		"status":   resp.StatusCode,
 		"duration": duration.String(),
-		"success":  success,
+		"success":  result != resultUnhealthy,
+		"degraded": result == resultDegraded,
+		"reason":   reason,
 	}).Log(logLevel, "Health check completed")
 
-	return success
+	return result
 }
 
 // getURL constructs the full health check URL
@@ -149,10 +296,30 @@ func (c *Checker) getURL() string {
 		return c.baseURL + c.path
 	}
 
-	baseURL.Path = c.path
+	// Probe with the scheme the backend is reached with
+	path := c.path
+	switch c.config.Type {
+	case "https", "h3":
+		baseURL.Scheme = "https"
+	case "http":
+		baseURL.Scheme = "http"
+	case "grpc":
+		baseURL.Scheme = "http"
+		if c.config.GRPCTLS {
+			baseURL.Scheme = "https"
+		}
+		path = grpcHealthPath
+	}
+
+	baseURL.Path = path
 	return baseURL.String()
 }
 
+// URL returns the URL probed by the checker
+func (c *Checker) URL() string {
+	return c.getURL()
+}
+
 // IsHealthy returns the current health status
 func (c *Checker) IsHealthy() bool {
 	c.mu.RLock()
@@ -160,23 +327,68 @@ func (c *Checker) IsHealthy() bool {
 	return c.isHealthy
 }
 
+// IsDegraded returns true if the backend is healthy but reported itself as
+// degraded in its last health check
+func (c *Checker) IsDegraded() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.isHealthy && c.isDegraded
+}
+
 // GetInterval returns the health check interval
 func (c *Checker) GetInterval() time.Duration {
 	return c.config.Interval
 }
 
+// InitialDelay returns a random delay before the first probe, so checkers
+// started together do not probe in lockstep
+func (c *Checker) InitialDelay() time.Duration {
+	return time.Duration(rand.Int63n(int64(c.config.Interval)))
+}
+
+// NextDelay returns the time until the next probe: the interval spread at
+// random by up to half the jitter either way
+func (c *Checker) NextDelay() time.Duration {
+	if c.config.Jitter <= 0 {
+		return c.config.Interval
+	}
+	return c.config.Interval - c.config.Jitter/2 + time.Duration(rand.Int63n(int64(c.config.Jitter)))
+}
+
 // GetStats returns health check statistics
 func (c *Checker) GetStats() map[string]interface{} {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
+	history := make([]map[string]interface{}, 0, len(c.history))
+	for _, probe := range c.historyLocked() {
+		entry := map[string]interface{}{
+			"time":     probe.Time.Format(time.RFC3339Nano),
+			"duration": probe.Duration.String(),
+			"result":   probe.Result,
+		}
+		if probe.Status != "" {
+			entry["status"] = probe.Status
+		}
+		if probe.Error != "" {
+			entry["error"] = probe.Error
+		}
+		history = append(history, entry)
+	}
+
 	return map[string]interface{}{
 		"url":                 c.getURL(),
 		"healthy":             c.isHealthy,
+		"degraded":            c.isHealthy && c.isDegraded,
+		"history":             history,
 		"consecutive_success": c.consecutiveSuccess,
 		"consecutive_failure": c.consecutiveFailure,
 		"config": map[string]interface{}{
+			"type":                c.config.Type,
+			"method":              c.config.Method,
+			"grpc_service":        c.config.GRPCService,
 			"interval":            c.config.Interval.String(),
+			"jitter":              c.config.Jitter.String(),
 			"timeout":             c.config.Timeout.String(),
 			"healthy_threshold":   c.config.HealthyThreshold,
 			"unhealthy_threshold": c.config.UnhealthyThreshold,
@@ -205,12 +417,23 @@ func (c *Checker) SetHealthy(healthy bool) {
 	c.consecutiveFailure = 0
 }
 
+// Close releases the connections held by the checker
+func (c *Checker) Close() {
+	if c.h3 != nil {
+		c.h3.Close()
+	}
+	if c.client != nil {
+		c.client.CloseIdleConnections()
+	}
+}
+
 // Reset resets the health checker state
 func (c *Checker) Reset() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	c.isHealthy = true
+	c.isDegraded = false
 	c.consecutiveSuccess = 0
 	c.consecutiveFailure = 0
 
@@ -0,0 +1,44 @@
+package health
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckerHistorySize(t *testing.T) {
+	tests := []struct {
+		size  int
+		kept  int // Probes kept out of the 12 recorded
+		first time.Duration
+	}{
+		{size: 0, kept: 10, first: 2},
+		{size: 3, kept: 3, first: 9},
+		{size: 20, kept: 12, first: 0},
+		{size: -1, kept: 0},
+		{size: -5, kept: 0},
+	}
+
+	for _, tt := range tests {
+		c := NewChecker("http://a:80", "/health", Config{HistorySize: tt.size})
+		for i := 0; i < 12; i++ {
+			c.mu.Lock()
+			c.record(Probe{Duration: time.Duration(i)})
+			c.mu.Unlock()
+		}
+
+		history := c.History()
+		if len(history) != tt.kept {
+			t.Errorf("size %d: %d probes kept, want %d", tt.size, len(history), tt.kept)
+			continue
+		}
+		for i, probe := range history {
+			if want := tt.first + time.Duration(i); probe.Duration != want {
+				t.Errorf("size %d: probe %d is #%d, want #%d", tt.size, i, probe.Duration, want)
+			}
+		}
+		if stats := c.GetStats()["history"].([]map[string]interface{}); len(stats) != tt.kept {
+			t.Errorf("size %d: %d probes in the stats, want %d", tt.size, len(stats), tt.kept)
+		}
+		c.Close()
+	}
+}
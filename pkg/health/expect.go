@@ -0,0 +1,196 @@
+package health
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// result is the outcome of a single probe
+type result int
+
+const (
+	resultUnhealthy result = iota
+	resultHealthy
+	resultDegraded // Serving, but should receive less traffic
+)
+
+// String returns the name of the result
+func (r result) String() string {
+	switch r {
+	case resultHealthy:
+		return "healthy"
+	case resultDegraded:
+		return "degraded"
+	default:
+		return "unhealthy"
+	}
+}
+
+// resultOf converts the outcome of a pass/fail probe
+func resultOf(success bool) result {
+	if success {
+		return resultHealthy
+	}
+	return resultUnhealthy
+}
+
+// maxBodyBytes bounds the part of a health check response body that is
+// inspected by the body assertions
+const maxBodyBytes = 64 * 1024
+
+// StatusRange is an inclusive range of HTTP status codes
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+// ParseStatusRanges parses status codes and ranges written as "200",
+// "200-299" or "2xx"
+func ParseStatusRanges(values []string) ([]StatusRange, error) {
+	ranges := make([]StatusRange, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+
+		var r StatusRange
+		var err error
+		switch {
+		case len(value) == 3 && strings.HasSuffix(strings.ToLower(value), "xx"):
+			var class int
+			if class, err = strconv.Atoi(value[:1]); err == nil {
+				r = StatusRange{Min: class * 100, Max: class*100 + 99}
+			}
+		case strings.Contains(value, "-"):
+			low, high, _ := strings.Cut(value, "-")
+			if r.Min, err = strconv.Atoi(strings.TrimSpace(low)); err == nil {
+				r.Max, err = strconv.Atoi(strings.TrimSpace(high))
+			}
+		default:
+			if r.Min, err = strconv.Atoi(value); err == nil {
+				r.Max = r.Min
+			}
+		}
+
+		if err != nil || r.Min < 100 || r.Max > 599 || r.Min > r.Max {
+			return nil, fmt.Errorf("invalid status code range: %s", value)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// matchStatus reports whether code is within one of the ranges
+func matchStatus(ranges []StatusRange, code int) bool {
+	for _, r := range ranges {
+		if code >= r.Min && code <= r.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// Expect contains the assertions an HTTP health check response must pass
+type Expect struct {
+	Status         []StatusRange  // Healthy status codes, any 2xx when empty
+	BodyContains   string         // Substring the body must contain
+	BodyRegex      *regexp.Regexp // Pattern the body must match
+	JSONPath       string         // Dot separated path into a JSON body, such as "status" or "checks.0.state"
+	JSONValues     []string       // Healthy values at JSONPath, any value when empty
+	DegradedStatus []StatusRange  // Status codes reported as degraded
+	DegradedValues []string       // Values at JSONPath reported as degraded
+}
+
+// needsBody reports whether the assertions inspect the response body
+func (e *Expect) needsBody() bool {
+	return e.BodyContains != "" || e.BodyRegex != nil || e.JSONPath != ""
+}
+
+// evaluate applies the assertions to a response, returning the reason when
+// the response is not healthy. A degraded status passes the status check,
+// but the body assertions still apply to it.
+func (e *Expect) evaluate(status int, body []byte) (result, string) {
+	degraded := matchStatus(e.DegradedStatus, status)
+
+	expected := status >= 200 && status < 300
+	if len(e.Status) > 0 {
+		expected = matchStatus(e.Status, status)
+	}
+	if !expected && !degraded {
+		return resultUnhealthy, fmt.Sprintf("unexpected status %d", status)
+	}
+
+	if e.BodyContains != "" && !bytes.Contains(body, []byte(e.BodyContains)) {
+		return resultUnhealthy, "body does not contain expected text"
+	}
+	if e.BodyRegex != nil && !e.BodyRegex.Match(body) {
+		return resultUnhealthy, "body does not match expected pattern"
+	}
+
+	if e.JSONPath != "" {
+		value, err := lookupJSON(body, e.JSONPath)
+		if err != nil {
+			return resultUnhealthy, err.Error()
+		}
+		if containsValue(e.DegradedValues, value) {
+			return resultDegraded, fmt.Sprintf("%s is %s", e.JSONPath, value)
+		}
+		if len(e.JSONValues) > 0 && !containsValue(e.JSONValues, value) {
+			return resultUnhealthy, fmt.Sprintf("%s is %s", e.JSONPath, value)
+		}
+	}
+
+	if degraded {
+		return resultDegraded, fmt.Sprintf("degraded status %d", status)
+	}
+	return resultHealthy, ""
+}
+
+// lookupJSON returns the value at a dot separated path of a JSON document.
+// Strings are returned as is, other values in their JSON encoding.
+func lookupJSON(body []byte, path string) (string, error) {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return "", fmt.Errorf("body is not valid JSON: %w", err)
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		switch node := value.(type) {
+		case map[string]interface{}:
+			next, ok := node[key]
+			if !ok {
+				return "", fmt.Errorf("%s not found in body", path)
+			}
+			value = next
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node) {
+				return "", fmt.Errorf("%s not found in body", path)
+			}
+			value = node[index]
+		default:
+			return "", fmt.Errorf("%s not found in body", path)
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// containsValue reports whether value is in the list
+func containsValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
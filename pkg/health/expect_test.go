@@ -0,0 +1,66 @@
+package health
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestParseStatusRanges(t *testing.T) {
+	ranges, err := ParseStatusRanges([]string{"204", "300-302", "4xx"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for code, want := range map[int]bool{204: true, 200: false, 301: true, 303: false, 404: true, 500: false} {
+		if got := matchStatus(ranges, code); got != want {
+			t.Errorf("status %d: got %v, want %v", code, got, want)
+		}
+	}
+
+	for _, value := range []string{"abc", "302-300", "99", "6xx"} {
+		if _, err := ParseStatusRanges([]string{value}); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestExpectEvaluate(t *testing.T) {
+	ready := Expect{
+		JSONPath:       "status",
+		JSONValues:     []string{"ok"},
+		DegradedValues: []string{"degraded"},
+	}
+
+	tests := []struct {
+		name   string
+		expect Expect
+		status int
+		body   string
+		want   result
+	}{
+		{"default 2xx", Expect{}, 204, "", resultHealthy},
+		{"default rejects 3xx", Expect{}, 301, "", resultUnhealthy},
+		{"status set", Expect{Status: []StatusRange{{Min: 200, Max: 200}, {Min: 429, Max: 429}}}, 429, "", resultHealthy},
+		{"degraded status", Expect{DegradedStatus: []StatusRange{{Min: 429, Max: 429}}}, 429, "", resultDegraded},
+		{"degraded status with broken body", Expect{DegradedStatus: []StatusRange{{Min: 429, Max: 429}}, BodyContains: "UP"}, 429, "Bad Gateway", resultUnhealthy},
+		{"degraded status with passing body", Expect{DegradedStatus: []StatusRange{{Min: 429, Max: 429}}, BodyContains: "UP"}, 429, "state: UP", resultDegraded},
+		{"degraded status with invalid json", Expect{DegradedStatus: []StatusRange{{Min: 503, Max: 503}}, JSONPath: "status"}, 503, "<html>", resultUnhealthy},
+		{"degraded status with healthy json", Expect{DegradedStatus: []StatusRange{{Min: 429, Max: 429}}, JSONPath: "status", JSONValues: []string{"ok"}}, 429, `{"status":"ok"}`, resultDegraded},
+		{"body contains", Expect{BodyContains: "UP"}, 200, "state: UP", resultHealthy},
+		{"body missing text", Expect{BodyContains: "UP"}, 200, "state: DOWN", resultUnhealthy},
+		{"body regex", Expect{BodyRegex: regexp.MustCompile(`^v\d+`)}, 200, "v12 ready", resultHealthy},
+		{"json healthy", ready, 200, `{"status":"ok"}`, resultHealthy},
+		{"json degraded", ready, 200, `{"status":"degraded"}`, resultDegraded},
+		{"json unexpected value", ready, 200, `{"status":"down"}`, resultUnhealthy},
+		{"json missing path", ready, 200, `{"state":"ok"}`, resultUnhealthy},
+		{"json invalid", ready, 200, `not json`, resultUnhealthy},
+		{"json nested", Expect{JSONPath: "checks.1.up", JSONValues: []string{"true"}}, 200, `{"checks":[{"up":false},{"up":true}]}`, resultHealthy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, reason := tt.expect.evaluate(tt.status, []byte(tt.body)); got != tt.want {
+				t.Errorf("got %v (%s), want %v", got, reason, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// grpcHealthPath is the method of the standard gRPC health checking protocol
+const grpcHealthPath = "/grpc.health.v1.Health/Check"
+
+// Serving statuses of grpc.health.v1.HealthCheckResponse
+const (
+	grpcStatusUnknown        = 0
+	grpcStatusServing        = 1
+	grpcStatusNotServing     = 2
+	grpcStatusServiceUnknown = 3
+)
+
+// maxGRPCResponse bounds the health check response read from a target
+const maxGRPCResponse = 64 * 1024
+
+// newGRPCTransport creates the HTTP/2 transport of the grpc probe, speaking
+// h2 over TLS or cleartext h2c
+func (c *Checker) newGRPCTransport() http.RoundTripper {
+	if c.config.GRPCTLS {
+		return &http2.Transport{TLSClientConfig: c.tlsConfig("h2")}
+	}
+
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// probeGRPC calls grpc.health.v1.Health/Check for the configured service
+// and reports whether the target is SERVING
+func (c *Checker) probeGRPC(probe *Probe) bool {
+	url := c.getURL()
+
+	start := time.Now()
+	status, err := c.callGRPCHealth(url)
+	duration := time.Since(start)
+
+	if err != nil {
+		probe.Error = err.Error()
+		logrus.WithFields(logrus.Fields{
+			"url":      url,
+			"service":  c.config.GRPCService,
+			"error":    err.Error(),
+			"duration": duration.String(),
+		}).Warn("gRPC health check failed")
+		return false
+	}
+
+	probe.Status = grpcStatusName(status)
+	success := status == grpcStatusServing
+
+	logLevel := logrus.DebugLevel
+	if !success {
+		logLevel = logrus.WarnLevel
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"url":      url,
+		"service":  c.config.GRPCService,
+		"status":   grpcStatusName(status),
+		"duration": duration.String(),
+		"success":  success,
+	}).Log(logLevel, "Health check completed")
+
+	return success
+}
+
+// callGRPCHealth sends the health check request and returns the serving
+// status of the response
+func (c *Checker) callGRPCHealth(url string) (uint64, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(grpcHealthRequest(c.config.GRPCService)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("User-Agent", "quic-reverse-proxy-health-checker/1.0")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxGRPCResponse))
+	if err != nil {
+		return 0, err
+	}
+
+	// Errors may be sent as trailers-only responses, in the headers
+	code := resp.Trailer.Get("Grpc-Status")
+	if code == "" {
+		code = resp.Header.Get("Grpc-Status")
+	}
+	if code != "0" {
+		message := resp.Trailer.Get("Grpc-Message")
+		if message == "" {
+			message = resp.Header.Get("Grpc-Message")
+		}
+		return 0, fmt.Errorf("grpc status %q: %s", code, message)
+	}
+
+	return parseGRPCHealthResponse(body)
+}
+
+// grpcHealthRequest returns the framed
+// HealthCheckRequest { string service = 1; }
+func grpcHealthRequest(service string) []byte {
+	var message []byte
+	if service != "" {
+		message = protowire.AppendTag(message, 1, protowire.BytesType)
+		message = protowire.AppendString(message, service)
+	}
+	return grpcFrame(message)
+}
+
+// grpcFrame prefixes a message with the gRPC length-prefixed framing of an
+// uncompressed message
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+// parseGRPCHealthResponse returns the status of a framed
+// HealthCheckResponse { ServingStatus status = 1; }
+func parseGRPCHealthResponse(frame []byte) (uint64, error) {
+	if len(frame) < 5 {
+		return 0, fmt.Errorf("short gRPC response")
+	}
+	if frame[0] != 0 {
+		return 0, fmt.Errorf("compressed gRPC response not supported")
+	}
+	length := binary.BigEndian.Uint32(frame[1:5])
+	if uint32(len(frame)-5) < length {
+		return 0, fmt.Errorf("truncated gRPC response")
+	}
+	message := frame[5 : 5+length]
+
+	status := uint64(grpcStatusUnknown)
+	for len(message) > 0 {
+		num, typ, n := protowire.ConsumeTag(message)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		message = message[n:]
+
+		if num == 1 && typ == protowire.VarintType {
+			value, n := protowire.ConsumeVarint(message)
+			if n < 0 {
+				return 0, protowire.ParseError(n)
+			}
+			status = value
+			message = message[n:]
+			continue
+		}
+
+		n = protowire.ConsumeFieldValue(num, typ, message)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		message = message[n:]
+	}
+	return status, nil
+}
+
+// grpcStatusName returns the name of a serving status
+func grpcStatusName(status uint64) string {
+	switch status {
+	case grpcStatusServing:
+		return "SERVING"
+	case grpcStatusNotServing:
+		return "NOT_SERVING"
+	case grpcStatusServiceUnknown:
+		return "SERVICE_UNKNOWN"
+	default:
+		return "UNKNOWN"
+	}
+}
@@ -0,0 +1,112 @@
+package health
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Wire encodings of grpc.health.v1 messages, as produced by the protobuf
+// runtime for the generated grpc_health_v1 types
+var (
+	requestAPI      = []byte{0x0a, 0x03, 'a', 'p', 'i'}
+	responseServing = []byte{0x08, 0x01}
+)
+
+// frame prefixes a message with an uncompressed gRPC message header
+func frame(message ...byte) []byte {
+	return append([]byte{0, 0, 0, 0, byte(len(message))}, message...)
+}
+
+func TestGRPCHealthRequest(t *testing.T) {
+	tests := []struct {
+		service string
+		want    []byte
+	}{
+		{service: "", want: frame()},
+		{service: "api", want: frame(requestAPI...)},
+	}
+
+	for _, tt := range tests {
+		if got := grpcHealthRequest(tt.service); !bytes.Equal(got, tt.want) {
+			t.Errorf("grpcHealthRequest(%q) = %x, want %x", tt.service, got, tt.want)
+		}
+	}
+}
+
+func TestParseGRPCHealthResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "serving", frame: frame(responseServing...), want: "SERVING"},
+		{name: "not serving", frame: frame(0x08, 0x02), want: "NOT_SERVING"},
+		{name: "service unknown", frame: frame(0x08, 0x03), want: "SERVICE_UNKNOWN"},
+		{name: "missing status", frame: frame(), want: "UNKNOWN"},
+		{name: "unknown field skipped", frame: frame(0x12, 0x02, 'o', 'k', 0x08, 0x01), want: "SERVING"},
+		{name: "trailing bytes ignored", frame: append(frame(0x08, 0x02), 0xff), want: "NOT_SERVING"},
+		{name: "short", frame: []byte{0, 0, 0}, wantErr: true},
+		{name: "compressed", frame: []byte{1, 0, 0, 0, 2, 0x08, 0x01}, wantErr: true},
+		{name: "truncated", frame: []byte{0, 0, 0, 0, 4, 0x08, 0x01}, wantErr: true},
+		{name: "truncated varint", frame: frame(0x08, 0x80), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		status, err := parseGRPCHealthResponse(tt.frame)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && grpcStatusName(status) != tt.want {
+			t.Errorf("%s: status = %s, want %s", tt.name, grpcStatusName(status), tt.want)
+		}
+	}
+}
+
+func TestProbeGRPC(t *testing.T) {
+	tests := []struct {
+		name     string
+		response []byte
+		code     string // grpc-status trailer
+		want     result
+		status   string
+	}{
+		{name: "serving", response: frame(responseServing...), code: "0", want: resultHealthy, status: "SERVING"},
+		{name: "not serving", response: frame(0x08, 0x02), code: "0", want: resultUnhealthy, status: "NOT_SERVING"},
+		{name: "service unknown", response: frame(0x08, 0x03), code: "0", want: resultUnhealthy, status: "SERVICE_UNKNOWN"},
+		{name: "missing status", response: frame(), code: "0", want: resultUnhealthy, status: "UNKNOWN"},
+		{name: "grpc error", code: "5", want: resultUnhealthy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if r.URL.Path != grpcHealthPath || r.Header.Get("Content-Type") != "application/grpc" || !bytes.Equal(body, frame(requestAPI...)) {
+					t.Errorf("request %s %q %x", r.URL.Path, r.Header.Get("Content-Type"), body)
+				}
+
+				w.Header().Set("Content-Type", "application/grpc")
+				w.Header().Set("Trailer", "Grpc-Status")
+				w.Write(tt.response)
+				w.Header().Set("Grpc-Status", tt.code)
+			}), &http2.Server{}))
+			defer server.Close()
+
+			c := NewChecker(server.URL, "", Config{Type: "grpc", GRPCService: "api"})
+			defer c.Close()
+
+			res, probe := c.performCheck()
+			if res != tt.want || probe.Status != tt.status {
+				t.Errorf("probe = %v %q, want %v %q", res, probe.Status, tt.want, tt.status)
+			}
+		})
+	}
+}
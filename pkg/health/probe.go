@@ -0,0 +1,79 @@
+package health
+
+import (
+	"crypto/tls"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// probeConnect checks that the target accepts TCP connections and, for the
+// tls probe, completes a TLS handshake
+func (c *Checker) probeConnect(probe *Probe) bool {
+	address := c.address()
+	dialer := &net.Dialer{Timeout: c.config.Timeout}
+
+	start := time.Now()
+	var (
+		conn net.Conn
+		err  error
+	)
+	if c.config.Type == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, c.tlsConfig())
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	duration := time.Since(start)
+
+	if err != nil {
+		probe.Error = err.Error()
+		logrus.WithFields(logrus.Fields{
+			"address":  address,
+			"type":     c.config.Type,
+			"error":    err.Error(),
+			"duration": duration.String(),
+		}).Warn("Health check connection failed")
+		return false
+	}
+	conn.Close()
+
+	logrus.WithFields(logrus.Fields{
+		"address":  address,
+		"type":     c.config.Type,
+		"duration": duration.String(),
+	}).Debug("Health check completed")
+
+	return true
+}
+
+// address returns the host and port probed by the tcp and tls probes
+func (c *Checker) address() string {
+	target, err := url.Parse(c.baseURL)
+	if err != nil || target.Host == "" {
+		return c.baseURL
+	}
+	if target.Port() != "" {
+		return target.Host
+	}
+
+	port := "80"
+	if c.config.Type == "tls" || target.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(target.Hostname(), port)
+}
+
+// tlsConfig returns a copy of the configured TLS settings negotiating the
+// given application protocols
+func (c *Checker) tlsConfig(protos ...string) *tls.Config {
+	config := &tls.Config{}
+	if c.config.TLSConfig != nil {
+		config = c.config.TLSConfig.Clone()
+	}
+	if len(protos) > 0 {
+		config.NextProtos = protos
+	}
+	return config
+}
@@ -0,0 +1,187 @@
+package health
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// tcpListener returns the address of a raw TCP listener accepting and
+// closing connections, and the address of a closed port
+func tcpListener(t *testing.T) (string, string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	closed.Close()
+
+	return ln.Addr().String(), closed.Addr().String()
+}
+
+// trusting returns a TLS config trusting the certificate of a test server
+func trusting(server *httptest.Server) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	return &tls.Config{RootCAs: pool}
+}
+
+func TestProbeConnect(t *testing.T) {
+	listening, closed := tcpListener(t)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		baseURL   string
+		config    Config
+		want      result
+		wantError bool
+	}{
+		{name: "tcp", baseURL: "http://" + listening, config: Config{Type: "tcp"}, want: resultHealthy},
+		{name: "tcp refused", baseURL: "http://" + closed, config: Config{Type: "tcp"}, want: resultUnhealthy, wantError: true},
+		{name: "tls skip verify", baseURL: server.URL, config: Config{Type: "tls", TLSConfig: &tls.Config{InsecureSkipVerify: true}}, want: resultHealthy},
+		{name: "tls custom ca", baseURL: server.URL, config: Config{Type: "tls", TLSConfig: trusting(server)}, want: resultHealthy},
+		{name: "tls untrusted", baseURL: server.URL, config: Config{Type: "tls"}, want: resultUnhealthy, wantError: true},
+		{name: "tls without tls", baseURL: "http://" + listening, config: Config{Type: "tls", TLSConfig: &tls.Config{InsecureSkipVerify: true}}, want: resultUnhealthy, wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.Timeout = time.Second
+			c := NewChecker(tt.baseURL, "", tt.config)
+			defer c.Close()
+
+			res, probe := c.performCheck()
+			if res != tt.want {
+				t.Errorf("result = %v, want %v", res, tt.want)
+			}
+			if (probe.Error != "") != tt.wantError {
+				t.Errorf("probe error %q, want error %v", probe.Error, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestProbeAddress(t *testing.T) {
+	tests := []struct {
+		baseURL string
+		typ     string
+		want    string
+	}{
+		{baseURL: "http://10.0.0.1:8080", typ: "tcp", want: "10.0.0.1:8080"},
+		{baseURL: "http://10.0.0.1", typ: "tcp", want: "10.0.0.1:80"},
+		{baseURL: "https://10.0.0.1", typ: "tcp", want: "10.0.0.1:443"},
+		{baseURL: "http://[fd00::1]", typ: "tls", want: "[fd00::1]:443"},
+	}
+
+	for _, tt := range tests {
+		c := NewChecker(tt.baseURL, "", Config{Type: tt.typ})
+		if got := c.address(); got != tt.want {
+			t.Errorf("%s %s: address = %s, want %s", tt.typ, tt.baseURL, got, tt.want)
+		}
+	}
+}
+
+func TestProbeHTTPS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || r.TLS == nil {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	// The target may be configured with its plain address; the https probe
+	// reaches it over TLS
+	plain := "http://" + server.Listener.Addr().String()
+
+	tests := []struct {
+		name   string
+		config Config
+		want   result
+	}{
+		{name: "skip verify", config: Config{Type: "https", TLSConfig: &tls.Config{InsecureSkipVerify: true}}, want: resultHealthy},
+		{name: "custom ca", config: Config{Type: "https", TLSConfig: trusting(server)}, want: resultHealthy},
+		{name: "untrusted", config: Config{Type: "https"}, want: resultUnhealthy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.Timeout = time.Second
+			c := NewChecker(plain, "/health", tt.config)
+			defer c.Close()
+
+			if res, probe := c.performCheck(); res != tt.want {
+				t.Errorf("result = %v (%s), want %v", res, probe.Error, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckerTransport(t *testing.T) {
+	custom := &tls.Config{ServerName: "api.internal"}
+
+	tests := []struct {
+		typ       string
+		transport reflect.Type // nil for the probes connecting without HTTP
+		protos    []string
+	}{
+		{typ: "http", transport: reflect.TypeOf(&http.Transport{})},
+		{typ: "https", transport: reflect.TypeOf(&http.Transport{})},
+		{typ: "grpc", transport: reflect.TypeOf(&http2.Transport{})},
+		{typ: "h3", protos: []string{"h3"}},
+		{typ: "tcp"},
+		{typ: "tls"},
+	}
+
+	for _, tt := range tests {
+		c := NewChecker("https://10.0.0.1", "/health", Config{Type: tt.typ, TLSConfig: custom})
+
+		switch {
+		case tt.typ == "h3":
+			// The h3 probe runs over QUIC with the configured TLS settings
+			if c.h3 == nil || c.client == nil || c.client.Transport != c.h3 {
+				t.Errorf("h3: probe does not use an HTTP/3 transport")
+				continue
+			}
+			if cfg := c.h3.TLSClientConfig; cfg.ServerName != "api.internal" || !reflect.DeepEqual(cfg.NextProtos, tt.protos) {
+				t.Errorf("h3: tls config %q %v, want api.internal %v", cfg.ServerName, cfg.NextProtos, tt.protos)
+			}
+			if custom.NextProtos != nil {
+				t.Errorf("h3: configured tls settings modified")
+			}
+		case tt.transport == nil:
+			if c.client != nil || c.h3 != nil {
+				t.Errorf("%s: probe uses an HTTP client", tt.typ)
+			}
+		default:
+			if c.client == nil || reflect.TypeOf(c.client.Transport) != tt.transport || c.h3 != nil {
+				t.Errorf("%s: transport %T, want %v", tt.typ, c.client.Transport, tt.transport)
+			}
+		}
+		c.Close()
+	}
+}